@@ -6,17 +6,25 @@ package main
 //
 
 import (
+	"3scale-envoy/pkg/fake_threescale"
+	"3scale-envoy/pkg/logging"
+	"3scale-envoy/pkg/threescale_client"
 	"3scale-envoy/pkg/threescale_control_plane"
-	"github.com/sirupsen/logrus"
+	"errors"
+	"fmt"
 	"gopkg.in/alecthomas/kingpin.v2"
+	"net/http"
+	"os"
+	"strconv"
 )
 
 var (
-	log                  = logrus.New()
-	hostname             = kingpin.Flag("hostname", "The hostname or address used by Envoy to reach this control plane.").Required().Envar("HOSTNAME").String()
-	accessToken          = kingpin.Flag("access_token", "Your 3scale admin portal access token.").Required().Envar("ACCESS_TOKEN").String()
-	threescaleAdminUrl   = kingpin.Flag("3scale_admin_url", "The URL of your 3scale Admin portal: \"https://tenant-admin.3scale.net:443/\".").Required().Envar("3SCALE_ADMIN_URL").String()
-	serviceID            = kingpin.Flag("service_id", "The Service ID from 3scale to be used.").Required().Envar("SERVICE_ID").String()
+	log                  = logging.Logger
+	hostname             = kingpin.Flag("hostname", "The hostname or address used by Envoy to reach this control plane.").Envar("HOSTNAME").String()
+	configFile           = kingpin.Flag("config", "JSON file with the 3scale tenants and services to expose, replaces the single tenant flags.").Envar("CONFIG_FILE").String()
+	accessToken          = kingpin.Flag("access_token", "Your 3scale admin portal access token.").Envar("ACCESS_TOKEN").String()
+	threescaleAdminUrl   = kingpin.Flag("3scale_admin_url", "The URL of your 3scale Admin portal: \"https://tenant-admin.3scale.net:443/\".").Envar("3SCALE_ADMIN_URL").String()
+	serviceID            = kingpin.Flag("service_id", "The Service ID from 3scale to be used.").Envar("SERVICE_ID").String()
 	publicPort           = kingpin.Flag("public_port", "Gateway Public port, for external traffic.").Default("10000").Uint()
 	xdsPort              = kingpin.Flag("xds_port", "xDS server, this is where Envoy should connect to get the configuration.").Default("18000").Uint()
 	adminEnabled         = kingpin.Flag("admin_enabled", "Enable the admin endpoint in Envoy. (true or false)").Default("false").Bool()
@@ -25,15 +33,180 @@ var (
 	cacheTTL             = kingpin.Flag("cache_ttl", "Porta Cache time to wait before purging expired items from the cache.").Default("1m").Duration()
 	cacheRefreshInterval = kingpin.Flag("cache_refresh_interval", "Porta cache time difference to refresh the cache element before expiry time.").Default("30s").Duration()
 	cacheEntriesMax      = kingpin.Flag("cache_entries_max", "Porta cache max number of items that can be stored in the cache at any time.").Default("1000").Int()
+	upstreamCAFile       = kingpin.Flag("upstream_ca_file", "CA bundle on the Envoy host used to verify https API backends without their own.").Default(threescale_control_plane.DefaultUpstreamCAFile).String()
+	reportInterval       = kingpin.Flag("report_interval", "How often the response codes of the authorized requests are reported to 3scale backend.").Default("10s").Duration()
+	reportLogs           = kingpin.Flag("report_logs", "Also report the method and path of each authorized request to 3scale backend.").Default("false").Bool()
+	accessLog            = kingpin.Flag("access_log", "Where the structured access logs of the requests are written: \"stdout\" or a file path. Disabled when empty.").Envar("ACCESS_LOG").String()
+	accessLogMaxSize     = kingpin.Flag("access_log_max_size", "Size in megabytes of an access log file before it is rotated.").Default("100").Int()
+	accessLogMaxBackups  = kingpin.Flag("access_log_max_backups", "Number of rotated access log files kept.").Default("3").Int()
+	accessLogMaxAge      = kingpin.Flag("access_log_max_age", "Days a rotated access log file is kept, forever when 0.").Default("0").Int()
+	logLevel             = kingpin.Flag("log_level", "Log level: \"debug\", \"info\", \"warn\" or \"error\".").Default("info").Envar("LOG_LEVEL").String()
+	logFormat            = kingpin.Flag("log_format", "Log format: \"text\" or \"json\".").Default("text").Envar("LOG_FORMAT").Enum("text", "json")
+	logOutput            = kingpin.Flag("log_output", "Where the logs are written: \"stderr\", \"stdout\" or a file path.").Default("stderr").Envar("LOG_OUTPUT").String()
+	tracingCollector     = kingpin.Flag("tracing_collector_url", "Zipkin v2 spans endpoint of a Zipkin or Jaeger collector, like \"http://zipkin:9411/api/v2/spans\". Tracing is disabled when empty.").Envar("TRACING_COLLECTOR_URL").String()
+	tracingSampling      = kingpin.Flag("tracing_sampling", "Percentage of the requests traced by Envoy and the External AuthZ service.").Default("100").Float64()
+	adminAPIPort         = kingpin.Flag("admin_api_port", "Control plane admin API port.").Default("18001").Uint()
+	adminAPIToken        = kingpin.Flag("admin_api_token", "Bearer token of the control plane admin API. The admin API is disabled when empty.").Envar("ADMIN_API_TOKEN").String()
+	metricsPort          = kingpin.Flag("metrics_port", "Port of the Prometheus metrics endpoint. Disabled when 0.").Default("0").Uint()
+	rollbackOnNack       = kingpin.Flag("rollback_on_nack", "Roll Envoy back to the last configuration it accepted when it rejects a new one.").Default("false").Bool()
 	cacheUpdateRetries   = kingpin.Flag("cache_update_retries", "Porta Cache number of additional attempts made to update cached entries for unreachable hosts.").Default("2").Int()
+	xdsTLSCert           = kingpin.Flag("xds_tls_cert", "Certificate of the xDS server. TLS is disabled when empty.").Envar("XDS_TLS_CERT").String()
+	xdsTLSKey            = kingpin.Flag("xds_tls_key", "Private key of the xDS server certificate.").Envar("XDS_TLS_KEY").String()
+	xdsTLSCA             = kingpin.Flag("xds_tls_ca", "CA bundle on the Envoy host used to verify the xDS server certificate.").Default(threescale_control_plane.DefaultUpstreamCAFile).String()
+	envoyAdminPort       = kingpin.Flag("envoy_admin_port", "Envoy admin interface port in the generated bootstraps.").Default(strconv.Itoa(threescale_control_plane.DefaultEnvoyAdminPort)).Uint()
+	statsSinks           = kingpin.Flag("stats_sink", "\"ip:port\" UDP address of a statsd server Envoy sends its stats to, in the generated bootstraps. Repeatable.").Strings()
+
+	threescaleDialTimeout    = kingpin.Flag("threescale_dial_timeout", "Timeout of the TCP connections to the 3scale APIs.").Default("5s").Duration()
+	threescaleTLSTimeout     = kingpin.Flag("threescale_tls_timeout", "Timeout of the TLS handshakes with the 3scale APIs.").Default("5s").Duration()
+	threescaleRequestTimeout = kingpin.Flag("threescale_request_timeout", "Timeout of a whole request to the 3scale APIs, response included.").Default("10s").Duration()
+	threescaleKeepAlive      = kingpin.Flag("threescale_keep_alive", "Interval of the TCP keep-alive probes of the connections to the 3scale APIs. Disabled when negative.").Default("30s").Duration()
+	threescaleIdleTimeout    = kingpin.Flag("threescale_idle_conn_timeout", "How long an idle connection to the 3scale APIs is kept for reuse.").Default("90s").Duration()
+	threescaleMaxIdle        = kingpin.Flag("threescale_max_idle_conns", "Max number of idle connections kept to the 3scale APIs.").Default("100").Int()
+	threescaleMaxIdlePerHost = kingpin.Flag("threescale_max_idle_conns_per_host", "Max number of idle connections kept to each 3scale host.").Default("100").Int()
+	threescaleHTTP2          = kingpin.Flag("threescale_http2", "Use HTTP/2 with the 3scale APIs supporting it.").Default("true").Bool()
+	threescaleCAFile         = kingpin.Flag("threescale_ca_file", "CA bundle trusted in addition to the system CAs to verify the 3scale APIs, like the CA of an on-premises 3scale.").Envar("THREESCALE_CA_FILE").ExistingFile()
+
+	adminPortalHTTPProxy        = kingpin.Flag("admin_portal_http_proxy", "Proxy of the http requests to the 3scale Admin portals. Defaults to HTTP_PROXY.").Envar("ADMIN_PORTAL_HTTP_PROXY").String()
+	adminPortalHTTPSProxy       = kingpin.Flag("admin_portal_https_proxy", "Proxy of the https requests to the 3scale Admin portals. Defaults to HTTPS_PROXY.").Envar("ADMIN_PORTAL_HTTPS_PROXY").String()
+	adminPortalNoProxy          = kingpin.Flag("admin_portal_no_proxy", "Comma-separated hosts, domains and CIDRs of the 3scale Admin portals reached without proxy, \"*\" for all. Defaults to NO_PROXY.").Envar("ADMIN_PORTAL_NO_PROXY").String()
+	serviceManagementHTTPProxy  = kingpin.Flag("service_management_http_proxy", "Proxy of the http requests to the 3scale Service Management API. Defaults to HTTP_PROXY.").Envar("SERVICE_MANAGEMENT_HTTP_PROXY").String()
+	serviceManagementHTTPSProxy = kingpin.Flag("service_management_https_proxy", "Proxy of the https requests to the 3scale Service Management API. Defaults to HTTPS_PROXY.").Envar("SERVICE_MANAGEMENT_HTTPS_PROXY").String()
+	serviceManagementNoProxy    = kingpin.Flag("service_management_no_proxy", "Comma-separated hosts, domains and CIDRs of the 3scale Service Management API reached without proxy, \"*\" for all. Defaults to NO_PROXY.").Envar("SERVICE_MANAGEMENT_NO_PROXY").String()
+
+	serveCmd = kingpin.Command("serve", "Run the control plane.").Default()
+
+	renderCmd         = kingpin.Command("render", "Print the Envoy configuration generated for the 3scale services, without running the control plane.")
+	renderProxyConfig = renderCmd.Flag("proxy_config", "Proxy config JSON file, as returned by the 3scale Account Management API, used instead of fetching the services from 3scale. Repeatable.").ExistingFiles()
+	renderFormat      = renderCmd.Flag("format", "Output format: \"yaml\" or \"json\".").Default("yaml").Enum("yaml", "json")
+	renderBootstrap   = renderCmd.Flag("bootstrap", "Print a complete static Envoy bootstrap, without xDS. Envoy still calls the External AuthZ, rate limit and access log services at --hostname.").Default("false").Bool()
+	renderShowSecrets = renderCmd.Flag("show_secrets", "Print the access tokens instead of redacting them. Required for a bootstrap Envoy runs.").Default("false").Bool()
+
+	bootstrapCmd         = kingpin.Command("bootstrap", "Print the Envoy bootstrap of a node fetching its configuration from this control plane.")
+	bootstrapNodeID      = bootstrapCmd.Flag("node_id", "Envoy node ID.").Default(threescale_control_plane.DefaultNodeID).String()
+	bootstrapNodeCluster = bootstrapCmd.Flag("node_cluster", "Envoy node cluster.").Default(threescale_control_plane.DefaultNodeCluster).String()
+	bootstrapFormat      = bootstrapCmd.Flag("format", "Output format: \"yaml\" or \"json\".").Default("yaml").Enum("yaml", "json")
+
+	fakeCmd     = kingpin.Command("fake-3scale", "Run a fake 3scale Account Management and Service Management API, seeded from a fixture, to test without a 3scale account.")
+	fakeFixture = fakeCmd.Flag("fixture", "YAML fixture with the services, applications, keys and limits of the fake 3scale.").Required().ExistingFile()
+	fakePort    = fakeCmd.Flag("port", "Port of the fake 3scale.").Default("3000").Uint()
 )
 
 func main() {
-	kingpin.Parse()
+	command := kingpin.Parse()
+
+	if err := logging.Configure(*logLevel, *logFormat, *logOutput); err != nil {
+		log.Fatal(err)
+	}
+
+	threescale_control_plane.DefaultUpstreamCAFile = *upstreamCAFile
+
+	switch command {
+	case serveCmd.FullCommand():
+		serve()
+	case renderCmd.FullCommand():
+		if err := render(); err != nil {
+			log.Fatal(err)
+		}
+	case fakeCmd.FullCommand():
+		fixture, err := fake_threescale.LoadFixture(*fakeFixture)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Starting fake 3scale on Port %d", *fakePort)
+		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *fakePort), fake_threescale.NewServer(fixture)))
+	case bootstrapCmd.FullCommand():
+		if *hostname == "" {
+			*hostname = "127.0.0.1"
+		}
+		ec := newControlPlane(nil)
+		if err := ec.WriteBootstrap(os.Stdout, *bootstrapFormat, *bootstrapNodeID, *bootstrapNodeCluster); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func serve() {
+	if *hostname == "" {
+		log.Fatal("--hostname is required")
+	}
 
 	log.Info("Starting 3scale Envoy Control Plane")
 
-	ec := threescale_control_plane.ControlPlane{
+	tenants, err := loadTenants()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ec := newControlPlane(tenants)
+	ec.Start()
+}
+
+// render prints the Envoy configuration generated from the proxy config files, or from the services of the tenants.
+func render() error {
+	if *hostname == "" {
+		*hostname = "127.0.0.1"
+	}
+
+	if len(*renderProxyConfig) == 0 {
+		tenants, err := loadTenants()
+		if err != nil {
+			return err
+		}
+		ec := newControlPlane(tenants)
+		if err := ec.LoadConfig(); err != nil {
+			return err
+		}
+		return ec.Render(os.Stdout, *renderFormat, *renderBootstrap, *renderShowSecrets)
+	}
+
+	// The External AuthZ service fetches the proxy configs of the rendered routes from this tenant.
+	if *accessToken == "" || *threescaleAdminUrl == "" {
+		return errors.New("--proxy_config requires --access_token and --3scale_admin_url, the tenant the External AuthZ service authorizes the requests with")
+	}
+	source, err := threescale_client.NewFileSource(*renderProxyConfig...)
+	if err != nil {
+		return err
+	}
+	// Every service of the proxy config files is rendered.
+	tenant := &threescale_control_plane.ThreescaleConfig{
+		Name:        "default",
+		AccessToken: *accessToken,
+		SystemURL:   *threescaleAdminUrl,
+	}
+	ec := newControlPlane([]*threescale_control_plane.ThreescaleConfig{tenant})
+	ec.Source = source
+	if err := ec.LoadConfig(); err != nil {
+		return err
+	}
+	return ec.Render(os.Stdout, *renderFormat, *renderBootstrap, *renderShowSecrets)
+}
+
+func newControlPlane(tenants []*threescale_control_plane.ThreescaleConfig) *threescale_control_plane.ControlPlane {
+	// The connections to 3scale are shared by every tenant and service. The Admin portals and the Service
+	// Management API have their own clients, as they can be reached through different proxies.
+	httpConfig := threescale_client.HTTPConfig{
+		DialTimeout:         *threescaleDialTimeout,
+		TLSHandshakeTimeout: *threescaleTLSTimeout,
+		RequestTimeout:      *threescaleRequestTimeout,
+		KeepAlive:           *threescaleKeepAlive,
+		IdleConnTimeout:     *threescaleIdleTimeout,
+		MaxIdleConns:        *threescaleMaxIdle,
+		MaxIdleConnsPerHost: *threescaleMaxIdlePerHost,
+		HTTP2:               *threescaleHTTP2,
+		CAFile:              *threescaleCAFile,
+	}
+	httpConfig.Proxy = threescale_client.HTTPProxy{HTTPProxy: *adminPortalHTTPProxy, HTTPSProxy: *adminPortalHTTPSProxy, NoProxy: *adminPortalNoProxy}
+	systemHTTPClient, err := threescale_client.NewHTTPClient(httpConfig)
+	if err != nil {
+		log.Fatalf("Invalid 3scale HTTP client settings: %v", err)
+	}
+	httpConfig.Proxy = threescale_client.HTTPProxy{HTTPProxy: *serviceManagementHTTPProxy, HTTPSProxy: *serviceManagementHTTPSProxy, NoProxy: *serviceManagementNoProxy}
+	backendHTTPClient, err := threescale_client.NewHTTPClient(httpConfig)
+	if err != nil {
+		log.Fatalf("Invalid 3scale HTTP client settings: %v", err)
+	}
+
+	return &threescale_control_plane.ControlPlane{
 		CacheTTL:             *cacheTTL,
 		CacheRefreshInterval: *cacheRefreshInterval,
 		CacheUpdateRetries:   *cacheUpdateRetries,
@@ -44,13 +217,54 @@ func main() {
 		AdminEnabled:         *adminEnabled,
 		PublicPort:           *publicPort,
 		Host:                 *hostname,
-		Config: threescale_control_plane.ThreescaleConfig{
-			AccessToken: *accessToken,
-			SystemURL:   *threescaleAdminUrl,
-			ServiceID:   *serviceID,
-			Environment: "production",
+		Tenants:              tenants,
+		ReportInterval:       *reportInterval,
+		ReportLogs:           *reportLogs,
+		MetricsPort:          *metricsPort,
+		RollbackOnNack:       *rollbackOnNack,
+		AccessLog: threescale_control_plane.AccessLogConfig{
+			Output:     *accessLog,
+			MaxSizeMB:  *accessLogMaxSize,
+			MaxBackups: *accessLogMaxBackups,
+			MaxAgeDays: *accessLogMaxAge,
 		},
+		AdminAPI: threescale_control_plane.AdminAPIConfig{
+			Port:  *adminAPIPort,
+			Token: *adminAPIToken,
+		},
+		Tracing: threescale_control_plane.TracingConfig{
+			CollectorURL: *tracingCollector,
+			Sampling:     *tracingSampling,
+		},
+		Bootstrap: threescale_control_plane.BootstrapConfig{
+			AdminPort:       *envoyAdminPort,
+			StatsdAddresses: *statsSinks,
+		},
+		XDSTLS: threescale_control_plane.XDSTLSConfig{
+			CertFile: *xdsTLSCert,
+			KeyFile:  *xdsTLSKey,
+			CAFile:   *xdsTLSCA,
+		},
+		Source:  threescale_client.NewSystemClient(systemHTTPClient),
+		Backend: threescale_client.NewBackendClient(backendHTTPClient),
+	}
+}
+
+// loadTenants reads the tenants from the config file, or builds a single tenant from the command line flags.
+func loadTenants() ([]*threescale_control_plane.ThreescaleConfig, error) {
+	if *configFile != "" {
+		return threescale_control_plane.LoadTenants(*configFile)
 	}
 
-	ec.Start()
+	if *accessToken == "" || *threescaleAdminUrl == "" || *serviceID == "" {
+		return nil, errors.New("either --config or --access_token, --3scale_admin_url and --service_id are required")
+	}
+
+	tenants := []*threescale_control_plane.ThreescaleConfig{{
+		Name:        "default",
+		AccessToken: *accessToken,
+		SystemURL:   *threescaleAdminUrl,
+		Services:    []threescale_control_plane.ServiceConfig{{ID: *serviceID}},
+	}}
+	return tenants, threescale_control_plane.ValidateTenants(tenants)
 }
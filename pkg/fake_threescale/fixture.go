@@ -0,0 +1,243 @@
+package fake_threescale
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+)
+
+// Fixture seeds the fake 3scale with the services of a tenant, their metrics, mapping rules and applications.
+type Fixture struct {
+	// AccessToken is the admin portal access token accepted by the Account Management API.
+	AccessToken string `yaml:"access_token"`
+	// BackendURL is the Service Management API URL returned in the proxy configs, the URL the fake is
+	// reached at when empty.
+	BackendURL string    `yaml:"backend_url"`
+	Services   []Service `yaml:"services"`
+}
+
+// Service is a 3scale service (product) and the applications subscribed to it.
+type Service struct {
+	ID           string `yaml:"id"`
+	Name         string `yaml:"name"`
+	ServiceToken string `yaml:"service_token"`
+	// Version is the version of the production proxy config, 1 when 0.
+	Version int `yaml:"version"`
+	// Endpoint is the public base URL of the service, APIBackend its private base URL.
+	Endpoint   string `yaml:"endpoint"`
+	APIBackend string `yaml:"api_backend"`
+	// Backends compose the service of several API backends, each mounted at a path.
+	Backends     []BackendAPI  `yaml:"backends"`
+	Metrics      []Metric      `yaml:"metrics"`
+	MappingRules []MappingRule `yaml:"mapping_rules"`
+	Applications []Application `yaml:"applications"`
+	// ProxyConfig is the path of a proxy config recorded from 3scale, served as is instead of the one built
+	// from the fixture. Relative paths are relative to the fixture file.
+	ProxyConfig string `yaml:"proxy_config"`
+
+	recorded []byte
+}
+
+// BackendAPI is an API backend mounted at a path of the public endpoint of a service.
+type BackendAPI struct {
+	Name            string `yaml:"name"`
+	Path            string `yaml:"path"`
+	PrivateEndpoint string `yaml:"private_endpoint"`
+}
+
+// Metric is a metric of a service and the system names of its methods. The "hits" metric always exists.
+type Metric struct {
+	Name    string   `yaml:"name"`
+	Methods []string `yaml:"methods"`
+}
+
+// MappingRule increments a metric or method by Delta for the requests matching Method and Pattern.
+type MappingRule struct {
+	Method  string `yaml:"method"`
+	Pattern string `yaml:"pattern"`
+	Metric  string `yaml:"metric"`
+	Delta   int    `yaml:"delta"`
+}
+
+// Application authenticates either with an application ID and one of its keys, or with a user key.
+type Application struct {
+	AppID     string   `yaml:"app_id"`
+	AppKeys   []string `yaml:"app_keys"`
+	UserKey   string   `yaml:"user_key"`
+	Plan      string   `yaml:"plan"`
+	Suspended bool     `yaml:"suspended"`
+	Limits    []Limit  `yaml:"limits"`
+}
+
+// Limit is the maximum usage of a metric or method by an application in a period.
+type Limit struct {
+	Metric string `yaml:"metric"`
+	Period string `yaml:"period"`
+	Value  int    `yaml:"value"`
+}
+
+// LoadFixture reads a YAML fixture.
+func LoadFixture(path string) (*Fixture, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := parseFixture(data, filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("invalid fixture %s: %v", path, err)
+	}
+	return f, nil
+}
+
+// ParseFixture decodes a YAML fixture, checking that it's consistent. The recorded proxy configs are read
+// relative to the working directory.
+func ParseFixture(data []byte) (*Fixture, error) {
+	return parseFixture(data, "")
+}
+
+func parseFixture(data []byte, dir string) (*Fixture, error) {
+	var f Fixture
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, err
+	}
+	if err := f.validate(dir); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func (f *Fixture) validate(dir string) error {
+	if f.AccessToken == "" {
+		return fmt.Errorf("missing access_token")
+	}
+
+	ids := make(map[string]bool, len(f.Services))
+	for i := range f.Services {
+		s := &f.Services[i]
+		// The proxy configs hold the service ID as a number.
+		if _, err := strconv.ParseInt(s.ID, 10, 64); err != nil {
+			return fmt.Errorf("service %q: the id must be a number", s.ID)
+		}
+		if ids[s.ID] {
+			return fmt.Errorf("service %s: duplicated id", s.ID)
+		}
+		ids[s.ID] = true
+		if s.ServiceToken == "" {
+			return fmt.Errorf("service %s: missing service_token", s.ID)
+		}
+		if s.ProxyConfig != "" {
+			if err := s.loadProxyConfig(dir); err != nil {
+				return fmt.Errorf("service %s: %v", s.ID, err)
+			}
+		} else if s.Endpoint == "" || (s.APIBackend == "" && len(s.Backends) == 0) {
+			return fmt.Errorf("service %s: endpoint and either api_backend or backends are required", s.ID)
+		}
+		if s.Version == 0 {
+			s.Version = 1
+		}
+
+		metrics := s.metricNames()
+		for _, r := range s.MappingRules {
+			if !metrics[r.Metric] {
+				return fmt.Errorf("service %s: mapping rule %s %s: unknown metric %s", s.ID, r.Method, r.Pattern, r.Metric)
+			}
+		}
+
+		keys := make(map[string]bool, len(s.Applications))
+		for _, app := range s.Applications {
+			if (app.AppID == "") == (app.UserKey == "") {
+				return fmt.Errorf("service %s: an application needs either an app_id or a user_key", s.ID)
+			}
+			if keys[app.key()] {
+				return fmt.Errorf("service %s: application %s: duplicated", s.ID, app.key())
+			}
+			keys[app.key()] = true
+			for _, l := range app.Limits {
+				if !metrics[l.Metric] {
+					return fmt.Errorf("service %s: application %s: limit of unknown metric %s", s.ID, app.key(), l.Metric)
+				}
+				if _, ok := periods[l.Period]; !ok {
+					return fmt.Errorf("service %s: application %s: unknown period %q", s.ID, app.key(), l.Period)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// loadProxyConfig reads the recorded proxy config of a service, which sets its version.
+func (s *Service) loadProxyConfig(dir string) error {
+	path := s.ProxyConfig
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var recorded struct {
+		ProxyConfig struct {
+			Version int `json:"version"`
+			Content struct {
+				ID int64 `json:"id"`
+			} `json:"content"`
+		} `json:"proxy_config"`
+	}
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		return fmt.Errorf("invalid proxy config %s: %v", s.ProxyConfig, err)
+	}
+	if strconv.FormatInt(recorded.ProxyConfig.Content.ID, 10) != s.ID {
+		return fmt.Errorf("proxy config %s: recorded from service %d", s.ProxyConfig, recorded.ProxyConfig.Content.ID)
+	}
+	if s.Version != 0 && s.Version != recorded.ProxyConfig.Version {
+		return fmt.Errorf("proxy config %s: recorded version %d, not %d", s.ProxyConfig, recorded.ProxyConfig.Version, s.Version)
+	}
+
+	s.Version = recorded.ProxyConfig.Version
+	s.recorded = data
+	return nil
+}
+
+// metricNames returns the system names of the metrics and methods of a service.
+func (s *Service) metricNames() map[string]bool {
+	names := map[string]bool{hitsMetric: true}
+	for _, m := range s.Metrics {
+		names[m.Name] = true
+		for _, method := range m.Methods {
+			names[method] = true
+		}
+	}
+	return names
+}
+
+// parents maps the system name of each method of a service to the one of its metric.
+func (s *Service) parents() map[string]string {
+	parents := make(map[string]string)
+	for _, m := range s.Metrics {
+		for _, method := range m.Methods {
+			parents[method] = m.Name
+		}
+	}
+	return parents
+}
+
+// key identifies an application in the usage of a service, by its application ID or its user key.
+func (a *Application) key() string {
+	if a.UserKey != "" {
+		return a.UserKey
+	}
+	return a.AppID
+}
+
+func (a *Application) hasKey(key string) bool {
+	for _, k := range a.AppKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,574 @@
+package fake_threescale
+
+import (
+	"3scale-envoy/pkg/logging"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	sysC "github.com/3scale/3scale-porta-go-client/client"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var log = logging.Logger
+
+// timeLayout is the format of the times in the Service Management API.
+const timeLayout = "2006-01-02 15:04:05 -0700"
+
+var (
+	servicesPath    = regexp.MustCompile(`^/admin/api/services\.xml$`)
+	metricsPath     = regexp.MustCompile(`^/admin/api/services/([^/]+)/metrics\.xml$`)
+	methodsPath     = regexp.MustCompile(`^/admin/api/services/([^/]+)/metrics/([^/]+)/methods\.xml$`)
+	proxyConfigPath = regexp.MustCompile(`^/admin/api/services/([^/]+)/proxy/configs/([^/]+)/([^/]+)\.json$`)
+	transactionKey  = regexp.MustCompile(`^transactions\[(\d+)\]`)
+)
+
+// Transaction is a transaction reported to the fake Service Management API.
+type Transaction struct {
+	ServiceID string         `json:"service_id"`
+	App       string         `json:"app"`
+	Usage     map[string]int `json:"usage"`
+	Code      int            `json:"code,omitempty"`
+	Request   string         `json:"request,omitempty"`
+	Timestamp string         `json:"timestamp,omitempty"`
+}
+
+// Server fakes the parts of the 3scale Account Management API and of the Service Management API used by
+// the control plane and the authorizer. It serves both from the same address:
+//
+//	GET  /admin/api/services.xml                                   services of the tenant
+//	GET  /admin/api/services/{id}/metrics.xml                      metrics of a service
+//	GET  /admin/api/services/{id}/metrics/{metric}/methods.xml     methods of a metric
+//	GET  /admin/api/services/{id}/proxy/configs/{env}/{version}.json   proxy config, also as latest.json
+//	GET  /transactions/authrep.xml                                 authorize and report a request
+//	GET  /transactions/authorize.xml                               authorize a request
+//	POST /transactions.xml                                         report transactions
+//	GET  /fake/usage.json                                          usage in the current period windows
+//	GET  /fake/transactions.json                                   reported transactions
+//	POST /fake/reset                                               forget the usage and the transactions
+type Server struct {
+	fixture *Fixture
+
+	mu           sync.Mutex
+	usage        usage
+	transactions []Transaction
+	// now returns the current time, used for the limit periods.
+	now func() time.Time
+}
+
+// NewServer returns a fake 3scale serving the services of a fixture.
+func NewServer(fixture *Fixture) *Server {
+	return &Server{
+		fixture: fixture,
+		usage:   make(usage),
+		now:     time.Now,
+	}
+}
+
+// Usage returns the usage of a metric by an application, identified by its application ID or user key,
+// in the current window of a period.
+func (s *Server) Usage(serviceID, app, metric, period string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := periods[period]; !ok {
+		return 0
+	}
+	return s.usage.get(serviceID, app, metric, period, s.now())
+}
+
+// Transactions returns the transactions reported so far.
+func (s *Server) Transactions() []Transaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Transaction{}, s.transactions...)
+}
+
+// Reset forgets the usage and the reported transactions.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.usage = make(usage)
+	s.transactions = nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Debugf("Fake 3scale: %s %s", r.Method, r.URL.RequestURI())
+
+	path := r.URL.Path
+	switch {
+	case path == "/transactions/authrep.xml":
+		s.handleAuthorize(w, r, true)
+	case path == "/transactions/authorize.xml":
+		s.handleAuthorize(w, r, false)
+	case path == "/transactions.xml":
+		s.handleReport(w, r)
+	case path == "/fake/usage.json":
+		s.mu.Lock()
+		values := s.usage.current(s.now())
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, values)
+	case path == "/fake/transactions.json":
+		writeJSON(w, http.StatusOK, s.Transactions())
+	case path == "/fake/reset" && r.Method == http.MethodPost:
+		s.Reset()
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(path, "/admin/api/"):
+		s.handleAccountManagement(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+//
+// Account Management API
+//
+
+type serviceXML struct {
+	XMLName    xml.Name `xml:"service"`
+	ID         string   `xml:"id"`
+	Name       string   `xml:"name"`
+	State      string   `xml:"state"`
+	SystemName string   `xml:"system_name"`
+}
+
+type servicesXML struct {
+	XMLName  xml.Name     `xml:"services"`
+	Services []serviceXML `xml:"service"`
+}
+
+type metricXML struct {
+	XMLName    xml.Name `xml:"metric"`
+	ID         string   `xml:"id"`
+	Name       string   `xml:"name"`
+	SystemName string   `xml:"system_name"`
+	ServiceID  string   `xml:"service_id"`
+	Unit       string   `xml:"unit"`
+}
+
+type metricsXML struct {
+	XMLName xml.Name    `xml:"metrics"`
+	Metrics []metricXML `xml:"metric"`
+}
+
+type methodXML struct {
+	ID         string `xml:"id"`
+	SystemName string `xml:"system_name"`
+}
+
+type methodsXML struct {
+	XMLName xml.Name    `xml:"methods"`
+	Methods []methodXML `xml:"method"`
+}
+
+type backendAPIConfig struct {
+	Path       string `json:"path"`
+	BackendAPI struct {
+		SystemName      string `json:"system_name"`
+		PrivateEndpoint string `json:"private_endpoint"`
+	} `json:"backend_api"`
+}
+
+// proxyConfigContent adds the API backends of the services composed of several backends to the proxy config.
+type proxyConfigContent struct {
+	sysC.Content
+	BackendAPIConfigs []backendAPIConfig `json:"backend_api_configs,omitempty"`
+}
+
+type proxyConfigElement struct {
+	ProxyConfig struct {
+		ID          int                `json:"id"`
+		Version     int                `json:"version"`
+		Environment string             `json:"environment"`
+		Content     proxyConfigContent `json:"content"`
+	} `json:"proxy_config"`
+}
+
+func (s *Server) handleAccountManagement(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeXMLError(w, http.StatusMethodNotAllowed, "", "method not allowed")
+		return
+	}
+	if r.URL.Query().Get("access_token") != s.fixture.AccessToken {
+		if strings.HasSuffix(r.URL.Path, ".json") {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "Access denied"})
+		} else {
+			writeXMLError(w, http.StatusForbidden, "", "Access denied")
+		}
+		return
+	}
+
+	path := r.URL.Path
+	switch {
+	case servicesPath.MatchString(path):
+		list := servicesXML{}
+		for _, service := range s.fixture.Services {
+			list.Services = append(list.Services, serviceXML{ID: service.ID, Name: service.Name, State: "incomplete", SystemName: service.Name})
+		}
+		writeXML(w, http.StatusOK, list)
+
+	case metricsPath.MatchString(path):
+		service, ok := s.service(metricsPath.FindStringSubmatch(path)[1])
+		if !ok {
+			writeXMLError(w, http.StatusNotFound, "", "Not found")
+			return
+		}
+		list := metricsXML{}
+		for i, name := range metricSystemNames(service) {
+			list.Metrics = append(list.Metrics, metricXML{ID: strconv.Itoa(i + 1), Name: name, SystemName: name, ServiceID: service.ID, Unit: "hit"})
+		}
+		writeXML(w, http.StatusOK, list)
+
+	case methodsPath.MatchString(path):
+		match := methodsPath.FindStringSubmatch(path)
+		service, ok := s.service(match[1])
+		names := metricSystemNames(service)
+		index, err := strconv.Atoi(match[2])
+		if !ok || err != nil || index < 1 || index > len(names) {
+			writeXMLError(w, http.StatusNotFound, "", "Not found")
+			return
+		}
+		list := methodsXML{}
+		for _, m := range service.Metrics {
+			if m.Name != names[index-1] {
+				continue
+			}
+			for i, method := range m.Methods {
+				list.Methods = append(list.Methods, methodXML{ID: fmt.Sprintf("%d%02d", index, i+1), SystemName: method})
+			}
+		}
+		writeXML(w, http.StatusOK, list)
+
+	case proxyConfigPath.MatchString(path):
+		match := proxyConfigPath.FindStringSubmatch(path)
+		service, ok := s.service(match[1])
+		if !ok || (match[3] != "latest" && match[3] != strconv.Itoa(service.Version)) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"status": "Not found"})
+			return
+		}
+		if service.recorded != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(service.recorded)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.proxyConfig(r, service, match[2]))
+
+	default:
+		writeXMLError(w, http.StatusNotFound, "", "Not found")
+	}
+}
+
+// metricSystemNames returns the system names of the metrics of a service, the "hits" metric first.
+func metricSystemNames(service Service) []string {
+	names := []string{hitsMetric}
+	for _, m := range service.Metrics {
+		if m.Name != hitsMetric {
+			names = append(names, m.Name)
+		}
+	}
+	return names
+}
+
+func (s *Server) proxyConfig(r *http.Request, service Service, environment string) proxyConfigElement {
+	backendURL := s.fixture.BackendURL
+	if backendURL == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		backendURL = scheme + "://" + r.Host
+	}
+
+	id, _ := strconv.ParseInt(service.ID, 10, 64)
+
+	var pc proxyConfigElement
+	pc.ProxyConfig.ID = service.Version
+	pc.ProxyConfig.Version = service.Version
+	pc.ProxyConfig.Environment = environment
+
+	content := &pc.ProxyConfig.Content
+	content.ID = id
+	content.Name = service.Name
+	content.SystemName = service.Name
+	content.BackendVersion = "1"
+	content.BackendAuthenticationType = "service_token"
+	content.BackendAuthenticationValue = service.ServiceToken
+	content.Proxy.ServiceID = id
+	content.Proxy.Endpoint = service.Endpoint
+	content.Proxy.APIBackend = service.APIBackend
+	content.Proxy.AuthAppID = "app_id"
+	content.Proxy.AuthAppKey = "app_key"
+	content.Proxy.AuthUserKey = "user_key"
+	content.Proxy.CredentialsLocation = "query"
+	content.Proxy.Backend = sysC.Backend{Endpoint: backendURL, Host: strings.TrimPrefix(strings.TrimPrefix(backendURL, "http://"), "https://")}
+	for i, rule := range service.MappingRules {
+		delta := rule.Delta
+		if delta == 0 {
+			delta = 1
+		}
+		content.Proxy.ProxyRules = append(content.Proxy.ProxyRules, sysC.ProxyRule{
+			ID:               int64(i + 1),
+			HTTPMethod:       rule.Method,
+			Pattern:          rule.Pattern,
+			MetricSystemName: rule.Metric,
+			Delta:            int64(delta),
+		})
+	}
+	for _, b := range service.Backends {
+		config := backendAPIConfig{Path: b.Path}
+		config.BackendAPI.SystemName = b.Name
+		config.BackendAPI.PrivateEndpoint = b.PrivateEndpoint
+		content.BackendAPIConfigs = append(content.BackendAPIConfigs, config)
+	}
+	return pc
+}
+
+//
+// Service Management API
+//
+
+type statusXML struct {
+	XMLName      xml.Name         `xml:"status"`
+	Authorized   bool             `xml:"authorized"`
+	Reason       string           `xml:"reason,omitempty"`
+	Plan         string           `xml:"plan"`
+	UsageReports []usageReportXML `xml:"usage_reports>usage_report,omitempty"`
+}
+
+type usageReportXML struct {
+	Metric       string `xml:"metric,attr"`
+	Period       string `xml:"period,attr"`
+	PeriodStart  string `xml:"period_start"`
+	PeriodEnd    string `xml:"period_end"`
+	MaxValue     int    `xml:"max_value"`
+	CurrentValue int    `xml:"current_value"`
+}
+
+type errorXML struct {
+	XMLName xml.Name `xml:"error"`
+	Code    string   `xml:"code,attr,omitempty"`
+	Text    string   `xml:",chardata"`
+}
+
+// handleAuthorize authorizes a request, and accounts its usage when report is set, like authrep does.
+func (s *Server) handleAuthorize(w http.ResponseWriter, r *http.Request, report bool) {
+	query := r.URL.Query()
+
+	service, ok := s.authenticateService(w, query.Get("service_id"), query.Get("service_token"))
+	if !ok {
+		return
+	}
+
+	var app *Application
+	switch userKey, appID := query.Get("user_key"), query.Get("app_id"); {
+	case userKey != "":
+		if app = findApplication(service, func(a *Application) bool { return a.UserKey == userKey }); app == nil {
+			writeXMLError(w, http.StatusForbidden, "user_key_invalid", fmt.Sprintf("user key %q is invalid", userKey))
+			return
+		}
+	case appID != "":
+		if app = findApplication(service, func(a *Application) bool { return a.AppID == appID }); app == nil {
+			writeXMLError(w, http.StatusNotFound, "application_not_found", fmt.Sprintf("application with id=%q was not found", appID))
+			return
+		}
+	default:
+		writeXMLError(w, http.StatusForbidden, "user_key_or_app_id_missing", "user key or app id is missing")
+		return
+	}
+
+	deltas, ok := requestUsage(w, query, service)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+
+	status := statusXML{Authorized: true, Plan: app.Plan}
+	switch appKey := query.Get("app_key"); {
+	case app.UserKey == "" && len(app.AppKeys) > 0 && appKey == "":
+		status.Authorized, status.Reason = false, "application key is missing"
+	case app.UserKey == "" && len(app.AppKeys) > 0 && !app.hasKey(appKey):
+		status.Authorized, status.Reason = false, fmt.Sprintf("application key %q is invalid", appKey)
+	case app.Suspended:
+		status.Authorized, status.Reason = false, "application is not active"
+	}
+
+	for _, l := range app.Limits {
+		if s.usage.get(service.ID, app.key(), l.Metric, l.Period, now)+deltas[l.Metric] > l.Value && status.Authorized {
+			status.Authorized, status.Reason = false, "usage limits are exceeded"
+		}
+	}
+
+	if status.Authorized && report {
+		s.usage.add(service.ID, app.key(), deltas, now)
+	}
+
+	for _, l := range app.Limits {
+		start := periods[l.Period](now.UTC())
+		status.UsageReports = append(status.UsageReports, usageReportXML{
+			Metric:       l.Metric,
+			Period:       l.Period,
+			PeriodStart:  start.Format(timeLayout),
+			PeriodEnd:    periodEnd(l.Period, start).Format(timeLayout),
+			MaxValue:     l.Value,
+			CurrentValue: s.usage.get(service.ID, app.key(), l.Metric, l.Period, now),
+		})
+	}
+
+	code := http.StatusOK
+	if !status.Authorized {
+		code = http.StatusConflict
+	}
+	writeXML(w, code, status)
+}
+
+// handleReport accounts the usage of the reported transactions. Transactions of unknown applications are
+// ignored, as 3scale backend only reports them asynchronously.
+func (s *Server) handleReport(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeXMLError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	service, ok := s.authenticateService(w, r.Form.Get("service_id"), r.Form.Get("service_token"))
+	if !ok {
+		return
+	}
+
+	count := 0
+	for key := range r.Form {
+		if match := transactionKey.FindStringSubmatch(key); match != nil {
+			if i, _ := strconv.Atoi(match[1]); i+1 > count {
+				count = i + 1
+			}
+		}
+	}
+
+	parents := service.parents()
+	metrics := service.metricNames()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+
+	for i := 0; i < count; i++ {
+		prefix := fmt.Sprintf("transactions[%d]", i)
+		appID, userKey := r.Form.Get(prefix+"[app_id]"), r.Form.Get(prefix+"[user_key]")
+		app := findApplication(service, func(a *Application) bool {
+			return (userKey != "" && a.UserKey == userKey) || (userKey == "" && appID != "" && a.AppID == appID)
+		})
+		if app == nil {
+			continue
+		}
+
+		deltas := make(map[string]int)
+		for key, values := range r.Form {
+			if metric := strings.TrimPrefix(key, prefix+"[usage]["); metric != key && strings.HasSuffix(metric, "]") {
+				metric = strings.TrimSuffix(metric, "]")
+				if delta, err := strconv.Atoi(values[0]); err == nil && metrics[metric] {
+					deltas[metric] = delta
+				}
+			}
+		}
+		deltas = withParents(deltas, parents)
+		s.usage.add(service.ID, app.key(), deltas, now)
+
+		code, _ := strconv.Atoi(r.Form.Get(prefix + "[log][code]"))
+		s.transactions = append(s.transactions, Transaction{
+			ServiceID: service.ID,
+			App:       app.key(),
+			Usage:     deltas,
+			Code:      code,
+			Request:   r.Form.Get(prefix + "[log][request]"),
+			Timestamp: r.Form.Get(prefix + "[timestamp]"),
+		})
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// authenticateService returns the service of a Service Management API call, writing the error when
+// it's unknown or the service token is invalid.
+func (s *Server) authenticateService(w http.ResponseWriter, serviceID, serviceToken string) (Service, bool) {
+	if serviceID == "" {
+		writeXMLError(w, http.StatusForbidden, "service_id_missing", "service id is missing")
+		return Service{}, false
+	}
+	service, ok := s.service(serviceID)
+	if !ok {
+		writeXMLError(w, http.StatusNotFound, "service_id_invalid", fmt.Sprintf("service id %q is invalid", serviceID))
+		return Service{}, false
+	}
+	if serviceToken == "" || serviceToken != service.ServiceToken {
+		writeXMLError(w, http.StatusForbidden, "service_token_invalid", fmt.Sprintf("service token %q is invalid", serviceToken))
+		return Service{}, false
+	}
+	return service, true
+}
+
+// requestUsage returns the usage[] parameters of a request, accounted to the parent metrics of the methods
+// too, writing the error when a metric is unknown.
+func requestUsage(w http.ResponseWriter, query map[string][]string, service Service) (map[string]int, bool) {
+	metrics := service.metricNames()
+	deltas := make(map[string]int)
+	for key, values := range query {
+		if !strings.HasPrefix(key, "usage[") || !strings.HasSuffix(key, "]") {
+			continue
+		}
+		metric := strings.TrimSuffix(strings.TrimPrefix(key, "usage["), "]")
+		if !metrics[metric] {
+			writeXMLError(w, http.StatusNotFound, "metric_invalid", fmt.Sprintf("metric %q is invalid", metric))
+			return nil, false
+		}
+		delta, err := strconv.Atoi(values[0])
+		if err != nil || delta < 0 {
+			writeXMLError(w, http.StatusBadRequest, "usage_value_invalid", fmt.Sprintf("usage value %q for metric %q is invalid", values[0], metric))
+			return nil, false
+		}
+		deltas[metric] = delta
+	}
+	return withParents(deltas, service.parents()), true
+}
+
+func (s *Server) service(id string) (Service, bool) {
+	for _, service := range s.fixture.Services {
+		if service.ID == id {
+			return service, true
+		}
+	}
+	return Service{}, false
+}
+
+func findApplication(service Service, match func(*Application) bool) *Application {
+	for i := range service.Applications {
+		if match(&service.Applications[i]) {
+			return &service.Applications[i]
+		}
+	}
+	return nil
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Failed to write the fake 3scale response: %v", err)
+	}
+}
+
+func writeXMLError(w http.ResponseWriter, status int, code, message string) {
+	writeXML(w, status, errorXML{Code: code, Text: message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Failed to write the fake 3scale response: %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+package fake_threescale
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testFixture = `
+access_token: access-token
+services:
+  - id: "1001"
+    name: echo-api
+    service_token: service-token
+    endpoint: http://echo-api.example.com
+    api_backend: http://127.0.0.1:8080
+    metrics:
+      - name: hits
+        methods: [get_hello]
+    applications:
+      - app_id: app
+        app_keys: [app-key]
+        limits:
+          - {metric: hits, period: minute, value: 2}
+          - {metric: get_hello, period: day, value: 3}
+      - user_key: user-key
+      - app_id: suspended-app
+        suspended: true
+`
+
+func newTestServer(t *testing.T, now *time.Time) *Server {
+	fixture, err := ParseFixture([]byte(testFixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(fixture)
+	s.now = func() time.Time { return *now }
+	return s
+}
+
+func TestAuthRep(t *testing.T) {
+	now := time.Date(2019, 6, 3, 10, 0, 0, 0, time.UTC)
+	s := newTestServer(t, &now)
+
+	tests := []struct {
+		name       string
+		query      string
+		advance    time.Duration
+		wantCode   int
+		wantReason string
+		// wantUsage is the usage of hits by minute and of get_hello by day after the call.
+		wantUsage [2]int
+	}{
+		{name: "authorized", query: "app_id=app&app_key=app-key&usage[get_hello]=1", wantCode: 200, wantUsage: [2]int{1, 1}},
+		{name: "parent metric", query: "app_id=app&app_key=app-key&usage[hits]=1", wantCode: 200, wantUsage: [2]int{2, 1}},
+		{name: "minute limit", query: "app_id=app&app_key=app-key&usage[get_hello]=1", wantCode: 409, wantReason: "usage limits are exceeded", wantUsage: [2]int{2, 1}},
+		{name: "next minute", query: "app_id=app&app_key=app-key&usage[get_hello]=2", advance: time.Minute, wantCode: 200, wantUsage: [2]int{2, 3}},
+		{name: "day limit", query: "app_id=app&app_key=app-key&usage[get_hello]=1", advance: time.Minute, wantCode: 409, wantReason: "usage limits are exceeded", wantUsage: [2]int{0, 3}},
+		{name: "next day", query: "app_id=app&app_key=app-key&usage[get_hello]=1", advance: 24 * time.Hour, wantCode: 200, wantUsage: [2]int{1, 1}},
+		{name: "invalid app key", query: "app_id=app&app_key=invalid&usage[hits]=1", wantCode: 409, wantReason: `application key "invalid" is invalid`, wantUsage: [2]int{1, 1}},
+		{name: "suspended", query: "app_id=suspended-app&usage[hits]=1", wantCode: 409, wantReason: "application is not active", wantUsage: [2]int{1, 1}},
+		{name: "unknown application", query: "app_id=unknown&usage[hits]=1", wantCode: 404, wantUsage: [2]int{1, 1}},
+		{name: "unknown metric", query: "app_id=app&app_key=app-key&usage[unknown]=1", wantCode: 404, wantUsage: [2]int{1, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.advance)
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/transactions/authrep.xml?service_id=1001&service_token=service-token&"+tt.query, nil))
+			if w.Code != tt.wantCode {
+				t.Fatalf("code = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantReason != "" {
+				var status statusXML
+				if err := xml.Unmarshal(w.Body.Bytes(), &status); err != nil {
+					t.Fatal(err)
+				}
+				if status.Reason != tt.wantReason {
+					t.Errorf("reason = %q, want %q", status.Reason, tt.wantReason)
+				}
+			}
+			usage := [2]int{s.Usage("1001", "app", "hits", "minute"), s.Usage("1001", "app", "get_hello", "day")}
+			if usage != tt.wantUsage {
+				t.Errorf("usage = %v, want %v", usage, tt.wantUsage)
+			}
+		})
+	}
+}
+
+func TestAuthRepUsageReports(t *testing.T) {
+	now := time.Date(2019, 6, 3, 10, 30, 15, 0, time.UTC)
+	s := newTestServer(t, &now)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/transactions/authrep.xml?service_id=1001&service_token=service-token&app_id=app&app_key=app-key&usage[get_hello]=1", nil))
+	var status statusXML
+	if err := xml.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	want := []usageReportXML{
+		{Metric: "hits", Period: "minute", PeriodStart: "2019-06-03 10:30:00 +0000", PeriodEnd: "2019-06-03 10:31:00 +0000", MaxValue: 2, CurrentValue: 1},
+		{Metric: "get_hello", Period: "day", PeriodStart: "2019-06-03 00:00:00 +0000", PeriodEnd: "2019-06-04 00:00:00 +0000", MaxValue: 3, CurrentValue: 1},
+	}
+	if !reflect.DeepEqual(status.UsageReports, want) {
+		t.Errorf("usage reports = %+v, want %+v", status.UsageReports, want)
+	}
+}
+
+func TestReport(t *testing.T) {
+	now := time.Date(2019, 6, 3, 10, 0, 0, 0, time.UTC)
+	s := newTestServer(t, &now)
+
+	form := url.Values{
+		"service_id":                        {"1001"},
+		"service_token":                     {"service-token"},
+		"transactions[0][app_id]":           {"app"},
+		"transactions[0][usage][get_hello]": {"2"},
+		"transactions[0][log][code]":        {"200"},
+		"transactions[1][user_key]":         {"user-key"},
+		"transactions[1][usage][hits]":      {"1"},
+		"transactions[2][app_id]":           {"unknown"},
+		"transactions[2][usage][hits]":      {"1"},
+		"transactions[3][app_id]":           {"app"},
+		"transactions[3][usage][unknown]":   {"1"},
+		"transactions[3][usage][hits]":      {"1"},
+		"transactions[3][log][request]":     {"GET /hello"},
+		"transactions[3][timestamp]":        {"2019-06-03 10:00:00 +0000"},
+		"transactions[4][user_key]":         {"user-key"},
+		"transactions[4][usage][get_hello]": {"invalid"},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/transactions.xml", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("code = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+
+	// Reports are accounted even over the limits, and the unknown applications and metrics are ignored.
+	for _, u := range []struct {
+		app, metric string
+		want        int
+	}{
+		{"app", "get_hello", 2},
+		{"app", "hits", 3},
+		{"user-key", "hits", 1},
+		{"user-key", "get_hello", 0},
+		{"unknown", "hits", 0},
+	} {
+		if got := s.Usage("1001", u.app, u.metric, "minute"); got != u.want {
+			t.Errorf("usage of %s by %s = %d, want %d", u.metric, u.app, got, u.want)
+		}
+	}
+
+	want := []Transaction{
+		{ServiceID: "1001", App: "app", Usage: map[string]int{"get_hello": 2, "hits": 2}, Code: 200},
+		{ServiceID: "1001", App: "user-key", Usage: map[string]int{"hits": 1}},
+		{ServiceID: "1001", App: "app", Usage: map[string]int{"hits": 1}, Request: "GET /hello", Timestamp: "2019-06-03 10:00:00 +0000"},
+		{ServiceID: "1001", App: "user-key", Usage: map[string]int{}},
+	}
+	if got := s.Transactions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("transactions = %+v, want %+v", got, want)
+	}
+
+	s.Reset()
+	if got := s.Usage("1001", "app", "hits", "minute"); got != 0 || len(s.Transactions()) != 0 {
+		t.Errorf("usage = %d and %d transactions after a reset", got, len(s.Transactions()))
+	}
+}
+
+func TestUsageWindows(t *testing.T) {
+	now := time.Date(2019, 6, 3, 10, 0, 0, 0, time.UTC)
+	u := make(usage)
+	u.add("1001", "app", map[string]int{"hits": 1}, now)
+	if len(u) != len(periods) {
+		t.Fatalf("%d windows, want %d", len(u), len(periods))
+	}
+
+	// A new second, minute and hour only keep the current windows of those periods.
+	now = now.Add(time.Hour)
+	u.add("1001", "app", map[string]int{"hits": 1}, now)
+	if len(u) != len(periods) {
+		t.Errorf("%d windows, want %d", len(u), len(periods))
+	}
+	for period, want := range map[string]int{"second": 1, "minute": 1, "hour": 1, "day": 2, "week": 2, "month": 2, "year": 2, "eternity": 2} {
+		if got := u.get("1001", "app", "hits", period, now); got != want {
+			t.Errorf("usage by %s = %d, want %d", period, got, want)
+		}
+	}
+}
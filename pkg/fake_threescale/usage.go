@@ -0,0 +1,124 @@
+package fake_threescale
+
+import (
+	"sort"
+	"time"
+)
+
+const hitsMetric = "hits"
+
+// periods maps the 3scale limit periods to the start of the period holding a time, in UTC.
+var periods = map[string]func(t time.Time) time.Time{
+	"second": func(t time.Time) time.Time { return t.Truncate(time.Second) },
+	"minute": func(t time.Time) time.Time { return t.Truncate(time.Minute) },
+	"hour":   func(t time.Time) time.Time { return t.Truncate(time.Hour) },
+	"day": func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	},
+	"week": func(t time.Time) time.Time {
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	},
+	"month": func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	},
+	"year": func(t time.Time) time.Time {
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	},
+	"eternity": func(time.Time) time.Time { return time.Unix(0, 0).UTC() },
+}
+
+// periodEnd returns the end of the period starting at start.
+func periodEnd(period string, start time.Time) time.Time {
+	switch period {
+	case "second":
+		return start.Add(time.Second)
+	case "minute":
+		return start.Add(time.Minute)
+	case "hour":
+		return start.Add(time.Hour)
+	case "day":
+		return start.AddDate(0, 0, 1)
+	case "week":
+		return start.AddDate(0, 0, 7)
+	case "month":
+		return start.AddDate(0, 1, 0)
+	case "year":
+		return start.AddDate(1, 0, 0)
+	default:
+		return time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+	}
+}
+
+type usageKey struct {
+	serviceID, app, metric, period string
+	start                          int64
+}
+
+// UsageValue is the usage of a metric by an application in the current window of a period.
+type UsageValue struct {
+	ServiceID string `json:"service_id"`
+	App       string `json:"app"`
+	Metric    string `json:"metric"`
+	Period    string `json:"period"`
+	Value     int    `json:"value"`
+}
+
+// usage counts the usage of every metric of every application, in every period.
+type usage map[usageKey]int
+
+func (u usage) get(serviceID, app, metric, period string, now time.Time) int {
+	return u[usageKey{serviceID, app, metric, period, periods[period](now.UTC()).Unix()}]
+}
+
+// add accounts the usage of a request in the current window of every period, and forgets the previous windows.
+func (u usage) add(serviceID, app string, deltas map[string]int, now time.Time) {
+	for metric, delta := range deltas {
+		for period, start := range periods {
+			u[usageKey{serviceID, app, metric, period, start(now.UTC()).Unix()}] += delta
+		}
+	}
+	for key := range u {
+		if key.start < periods[key.period](now.UTC()).Unix() {
+			delete(u, key)
+		}
+	}
+}
+
+// current returns the usage in the current window of every period, ordered by service, application,
+// metric and period.
+func (u usage) current(now time.Time) []UsageValue {
+	values := []UsageValue{}
+	for key, value := range u {
+		if key.start != periods[key.period](now.UTC()).Unix() {
+			continue
+		}
+		values = append(values, UsageValue{key.serviceID, key.app, key.metric, key.period, value})
+	}
+	sort.Slice(values, func(i, j int) bool {
+		a, b := values[i], values[j]
+		if a.ServiceID != b.ServiceID {
+			return a.ServiceID < b.ServiceID
+		}
+		if a.App != b.App {
+			return a.App < b.App
+		}
+		if a.Metric != b.Metric {
+			return a.Metric < b.Metric
+		}
+		return a.Period < b.Period
+	})
+	return values
+}
+
+// withParents returns the usage of a request once the usage of each method is accounted to its metric too.
+func withParents(deltas map[string]int, parents map[string]string) map[string]int {
+	total := make(map[string]int, len(deltas))
+	for metric, delta := range deltas {
+		total[metric] += delta
+		if parent, ok := parents[metric]; ok {
+			total[parent] += delta
+		}
+	}
+	return total
+}
@@ -0,0 +1,100 @@
+package logging
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"regexp"
+)
+
+// Logger is shared by every package, so the whole process is configured at once.
+var Logger = logrus.New()
+
+const redacted = "[REDACTED]"
+
+// secretParams are the names of the parameters, query arguments and fields holding credentials.
+var secretParams = `access_token|user_key|app_key|provider_key|service_token|secret_token|token`
+
+var (
+	// secretQueryRegex matches credentials in URLs and form values, like "?access_token=abc".
+	secretQueryRegex = regexp.MustCompile(`((?:^|[?&\s"])(?:` + secretParams + `)=)[^&\s"]+`)
+	// secretJSONRegex matches credentials in JSON documents, like `"access_token":"abc"`.
+	secretJSONRegex  = regexp.MustCompile(`("(?:` + secretParams + `)\\?"\s*:\s*\\?")[^"\\]+`)
+	secretFieldRegex = regexp.MustCompile(`^(?:` + secretParams + `)$`)
+)
+
+// Configure sets the level, the format ("text" or "json") and the output ("stderr", "stdout" or a
+// file path) of the shared Logger.
+func Configure(level, format, output string) error {
+	l, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	var formatter logrus.Formatter
+	switch format {
+	case "text":
+		formatter = &logrus.TextFormatter{FullTimestamp: true}
+	case "json":
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	var out io.Writer
+	switch output {
+	case "stderr":
+		out = os.Stderr
+	case "stdout":
+		out = os.Stdout
+	default:
+		f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		out = f
+	}
+
+	Logger.SetLevel(l)
+	Logger.SetFormatter(&redactingFormatter{formatter: formatter})
+	Logger.SetOutput(out)
+	return nil
+}
+
+// Redact replaces the values of the credentials found in s.
+func Redact(s string) string {
+	s = secretQueryRegex.ReplaceAllString(s, "${1}"+redacted)
+	return secretJSONRegex.ReplaceAllString(s, "${1}"+redacted)
+}
+
+// redactingFormatter removes the credentials from the message and the fields of every entry before
+// formatting it, as formatters escape the values.
+type redactingFormatter struct {
+	formatter logrus.Formatter
+}
+
+func (f *redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	data := make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		switch value := v.(type) {
+		case string:
+			v = Redact(value)
+		case error:
+			v = Redact(value.Error())
+		}
+		if secretFieldRegex.MatchString(k) {
+			v = redacted
+		}
+		data[k] = v
+	}
+
+	e := *entry
+	e.Data = data
+	e.Message = Redact(entry.Message)
+	return f.formatter.Format(&e)
+}
+
+func init() {
+	Logger.SetFormatter(&redactingFormatter{formatter: &logrus.TextFormatter{FullTimestamp: true}})
+}
@@ -0,0 +1,100 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "access token in a URL",
+			in:   "GET https://tenant-admin.3scale.net/admin/api/services.xml?access_token=secret-token&page=1",
+			want: "GET https://tenant-admin.3scale.net/admin/api/services.xml?access_token=[REDACTED]&page=1",
+		},
+		{
+			name: "user key in a query string",
+			in:   "/transactions/authrep.xml?service_id=1&user_key=secret-key",
+			want: "/transactions/authrep.xml?service_id=1&user_key=[REDACTED]",
+		},
+		{
+			name: "app key and service token in a form",
+			in:   "app_id=app&app_key=secret-key&service_token=secret-token",
+			want: "app_id=app&app_key=[REDACTED]&service_token=[REDACTED]",
+		},
+		{
+			name: "key=value pairs in a message",
+			in:   "Authorizing app_key=secret-key user_key=other-key for app_id=app",
+			want: "Authorizing app_key=[REDACTED] user_key=[REDACTED] for app_id=app",
+		},
+		{
+			name: "quoted key=value pair",
+			in:   `request="access_token=secret-token"`,
+			want: `request="access_token=[REDACTED]"`,
+		},
+		{
+			name: "JSON document",
+			in:   `{"access_token": "secret-token", "user_key":"secret-key", "app_key":"secret", "app_id":"app"}`,
+			want: `{"access_token": "[REDACTED]", "user_key":"[REDACTED]", "app_key":"[REDACTED]", "app_id":"app"}`,
+		},
+		{
+			name: "escaped JSON document",
+			in:   `body: {\"access_token\":\"secret-token\"}`,
+			want: `body: {\"access_token\":\"[REDACTED]\"}`,
+		},
+		{
+			name: "names containing a credential name",
+			in:   "my_user_key=value access_tokens=value",
+			want: "my_user_key=value access_tokens=value",
+		},
+		{
+			name: "no credentials",
+			in:   "Refreshing config 3scale",
+			want: "Refreshing config 3scale",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Redact(tt.in); got != tt.want {
+				t.Errorf("Redact(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactingFormatter(t *testing.T) {
+	for _, formatter := range []logrus.Formatter{&logrus.TextFormatter{}, &logrus.JSONFormatter{}} {
+		var out bytes.Buffer
+		logger := logrus.New()
+		logger.SetOutput(&out)
+		logger.SetFormatter(&redactingFormatter{formatter: formatter})
+
+		logger.WithField("url", "https://tenant-admin.3scale.net/?access_token=secret-1").Info("field holding a URL")
+		logger.WithField("user_key", "secret-2").Info("field named after a credential")
+		logger.WithField("app_key", 12345).Info("field named after a credential, not a string")
+		logger.WithError(errors.New(`Get /transactions/authrep.xml?app_key=secret-3: timeout`)).Error("error field")
+		logger.Infof("message with {\"access_token\":\"%s\"}", "secret-4")
+		logger.WithFields(logrus.Fields{"app_id": "my-app", "service_id": "2555417777777"}).Info("plain fields")
+
+		logs := out.String()
+		for _, secret := range []string{"secret-1", "secret-2", "12345", "secret-3", "secret-4"} {
+			if strings.Contains(logs, secret) {
+				t.Errorf("%T: %s logged:\n%s", formatter, secret, logs)
+			}
+		}
+		if n := strings.Count(logs, redacted); n != 5 {
+			t.Errorf("%T: %d values redacted, want 5:\n%s", formatter, n, logs)
+		}
+		if !strings.Contains(logs, "my-app") || !strings.Contains(logs, "2555417777777") {
+			t.Errorf("%T: fields without credentials are missing:\n%s", formatter, logs)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package threescale_authorizer
+
+import (
+	"3scale-envoy/pkg/threescale_client"
+	"fmt"
+	backendC "github.com/3scale/3scale-go-client/client"
+	"golang.org/x/sync/singleflight"
+	"sync"
+	"time"
+)
+
+// hierarchyRetryInterval is how long a hierarchy that failed to load is not loaded again.
+const hierarchyRetryInterval = 30 * time.Second
+
+// metricHierarchy maps the system name of each 3scale method to the one of its parent metric.
+type metricHierarchy map[string]string
+
+type hierarchyEntry struct {
+	version   int
+	hierarchy metricHierarchy
+	loaded    bool
+	// loading is set while the hierarchy is loaded in the background.
+	loading bool
+	// err is the last failure to load the hierarchy of failedVersion, not retried before retryAt.
+	err           error
+	failedVersion int
+	retryAt       time.Time
+}
+
+// hierarchyCache holds the metric hierarchy of each service. Methods referenced by the mapping rules
+// can only change with a new proxy config, so a hierarchy is reloaded when the proxy config version changes.
+// Loading a hierarchy takes a call per metric of the service, so it's never done while a request waits.
+type hierarchyCache struct {
+	sync.Mutex
+	entries map[serviceKey]hierarchyEntry
+	loads   singleflight.Group
+	now     func() time.Time
+}
+
+func newHierarchyCache() *hierarchyCache {
+	return &hierarchyCache{entries: make(map[serviceKey]hierarchyEntry), now: time.Now}
+}
+
+// get returns the hierarchy of a proxy config version without calling 3scale, and whether it's loaded.
+// Otherwise the hierarchy is loaded in the background, and the one of the previous version, if any, is
+// returned meanwhile.
+func (h *hierarchyCache) get(source threescale_client.ProxyConfigSource, tenant threescale_client.Tenant, serviceID string, version int) (metricHierarchy, bool) {
+	key := serviceKey{systemURL: tenant.SystemURL, serviceID: serviceID}
+
+	h.Lock()
+	defer h.Unlock()
+	entry := h.entries[key]
+	if entry.loaded && entry.version == version {
+		return entry.hierarchy, true
+	}
+	if !entry.loading && !h.backingOff(entry, version) {
+		entry.loading = true
+		h.entries[key] = entry
+		go func() {
+			if err := h.load(source, tenant, serviceID, version); err != nil {
+				log.WithField("service_id", serviceID).Warnf("Failed to load the metrics of the service: %v", err)
+			}
+		}()
+	}
+	return entry.hierarchy, false
+}
+
+// load fetches the hierarchy of a proxy config version, unless it's already loaded. Concurrent loads of a
+// service share the same calls, and failures are not retried before hierarchyRetryInterval.
+func (h *hierarchyCache) load(source threescale_client.ProxyConfigSource, tenant threescale_client.Tenant, serviceID string, version int) error {
+	key := serviceKey{systemURL: tenant.SystemURL, serviceID: serviceID}
+
+	h.Lock()
+	entry := h.entries[key]
+	h.Unlock()
+	if entry.loaded && entry.version == version {
+		return nil
+	}
+	if h.backingOff(entry, version) {
+		return entry.err
+	}
+
+	_, err, _ := h.loads.Do(fmt.Sprintf("%s/%s/%d", key.systemURL, key.serviceID, version), func() (interface{}, error) {
+		hierarchy, err := source.GetMetricHierarchy(tenant, serviceID)
+
+		h.Lock()
+		defer h.Unlock()
+		entry := h.entries[key]
+		entry.loading = false
+		if err != nil {
+			entry.err, entry.failedVersion, entry.retryAt = err, version, h.now().Add(hierarchyRetryInterval)
+		} else {
+			entry = hierarchyEntry{version: version, hierarchy: hierarchy, loaded: true}
+		}
+		h.entries[key] = entry
+		return nil, err
+	})
+	return err
+}
+
+// backingOff reports whether loading the hierarchy of a version failed less than hierarchyRetryInterval ago.
+func (h *hierarchyCache) backingOff(entry hierarchyEntry, version int) bool {
+	return entry.err != nil && entry.failedVersion == version && h.now().Before(entry.retryAt)
+}
+
+// effectiveUsage returns the usage of a request once 3scale backend has accounted the usage of each
+// method to its parent metrics as well. Only the methods themselves are reported, as backend does that.
+func effectiveUsage(reported backendC.Metrics, hierarchy metricHierarchy) backendC.Metrics {
+	usage := make(backendC.Metrics, len(reported))
+	for metric, delta := range reported {
+		usage[metric] += delta
+		// Guard against cycles in a malformed hierarchy.
+		seen := map[string]bool{metric: true}
+		for parent, ok := hierarchy[metric]; ok && !seen[parent]; parent, ok = hierarchy[parent] {
+			usage[parent] += delta
+			seen[parent] = true
+		}
+	}
+	return usage
+}
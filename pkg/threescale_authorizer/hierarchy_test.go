@@ -0,0 +1,98 @@
+package threescale_authorizer
+
+import (
+	"3scale-envoy/pkg/threescale_client"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hierarchySource serves a metric hierarchy, blocking each call until release is closed.
+type hierarchySource struct {
+	threescale_client.ProxyConfigSource
+	mu        sync.Mutex
+	calls     int
+	hierarchy map[string]string
+	err       error
+	release   chan struct{}
+}
+
+func (s *hierarchySource) GetMetricHierarchy(tenant threescale_client.Tenant, serviceID string) (map[string]string, error) {
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	return s.hierarchy, s.err
+}
+
+func TestHierarchyCacheGet(t *testing.T) {
+	source := &hierarchySource{hierarchy: map[string]string{"get_hello": "hits"}, release: make(chan struct{})}
+	tenant := threescale_client.Tenant{SystemURL: "https://tenant-admin.3scale.net"}
+	h := newHierarchyCache()
+
+	// Concurrent requests don't wait for the hierarchy, and load it once in the background.
+	for i := 0; i < 10; i++ {
+		if hierarchy, loaded := h.get(source, tenant, "1001", 1); loaded || hierarchy != nil {
+			t.Fatalf("get = %v, %t before the hierarchy is loaded", hierarchy, loaded)
+		}
+	}
+	close(source.release)
+	waitFor(t, func() bool {
+		_, loaded := h.get(source, tenant, "1001", 1)
+		return loaded
+	})
+	if hierarchy, _ := h.get(source, tenant, "1001", 1); !reflect.DeepEqual(hierarchy, metricHierarchy{"get_hello": "hits"}) {
+		t.Errorf("hierarchy = %v", hierarchy)
+	}
+	if source.calls != 1 {
+		t.Errorf("calls = %d, want 1", source.calls)
+	}
+
+	// A new proxy config version keeps the previous hierarchy until the new one is loaded.
+	if hierarchy, loaded := h.get(source, tenant, "1001", 2); loaded || hierarchy == nil {
+		t.Errorf("get = %v, %t, want the previous hierarchy", hierarchy, loaded)
+	}
+}
+
+func TestHierarchyCacheBackoff(t *testing.T) {
+	source := &hierarchySource{err: errors.New("unavailable"), release: make(chan struct{})}
+	close(source.release)
+	tenant := threescale_client.Tenant{SystemURL: "https://tenant-admin.3scale.net"}
+	now := time.Now()
+	h := newHierarchyCache()
+	h.now = func() time.Time { return now }
+
+	if err := h.load(source, tenant, "1001", 1); err == nil {
+		t.Fatal("expected an error")
+	}
+	if err := h.load(source, tenant, "1001", 1); err == nil {
+		t.Fatal("expected the cached error")
+	}
+	if _, loaded := h.get(source, tenant, "1001", 1); loaded {
+		t.Fatal("unexpected hierarchy")
+	}
+	if source.calls != 1 {
+		t.Fatalf("calls = %d during the backoff, want 1", source.calls)
+	}
+
+	source.err, source.hierarchy = nil, map[string]string{"get_hello": "hits"}
+	now = now.Add(hierarchyRetryInterval)
+	if err := h.load(source, tenant, "1001", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, loaded := h.get(source, tenant, "1001", 1); !loaded {
+		t.Error("hierarchy not loaded after the backoff")
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
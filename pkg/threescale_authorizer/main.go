@@ -1,22 +1,21 @@
 package threescale_authorizer
 
 import (
+	"3scale-envoy/pkg/logging"
+	"3scale-envoy/pkg/threescale_client"
+	"3scale-envoy/pkg/tracing"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	backendC "github.com/3scale/3scale-go-client/client"
-	"github.com/3scale/3scale-istio-adapter/config"
-	"github.com/3scale/3scale-istio-adapter/pkg/threescale"
 	"github.com/3scale/3scale-istio-adapter/pkg/threescale/metrics"
-	sysC "github.com/3scale/3scale-porta-go-client/client"
-	logger "github.com/sirupsen/logrus"
-	"net"
-	"net/http"
 	"net/url"
-	"regexp"
 	"strconv"
 	"strings"
 )
 
 var (
-	log = logger.New()
+	log = logging.Logger
 )
 
 //
@@ -24,154 +23,209 @@ var (
 // and adapted to this use case.
 //
 
-type authRepRequest struct {
-	svcID   string
-	authKey string
-	params  backendC.AuthRepParams
-	auth    backendC.TokenAuth
-}
-
 type AuthorizeRequest struct {
 	Host        string `json:"host"` // not used yet...
 	ServiceId   string `json:"service_id"`
 	SystemUrl   string `json:"system_url"`
 	AccessToken string `json:"access_token"`
 	Path        string `json:"path"`
-	Method      string `json:"method"`
-	AppID       string `json:"appID"`
-	AppKey      string `json:"appKey"`
-	UserKey     string `json:"userKey"`
+	// Query holds the query string parameters of the request, matched by the mapping rules.
+	Query   url.Values `json:"query"`
+	Method  string     `json:"method"`
+	AppID   string     `json:"appID"`
+	AppKey  string     `json:"appKey"`
+	UserKey string     `json:"userKey"`
+	// BackendPath is the mount path of the API backend the request is routed to, and BackendPaths
+	// the mount paths of every backend of the service. Both are empty for single backend services.
+	BackendPath  string   `json:"backend_path"`
+	BackendPaths []string `json:"backend_paths"`
+	// RequestID correlates the request with its access log, to report its response.
+	RequestID string `json:"request_id"`
 }
 
-type authRepFn func(auth backendC.TokenAuth, key string, svcID string, params backendC.AuthRepParams, ext map[string]string) (backendC.ApiResponse, error)
+// Decision is the outcome of authorizing a request.
+type Decision int
+
+const (
+	Denied Decision = iota
+	Authorized
+	// NoMappingRuleMatched requests are denied without reaching 3scale backend.
+	NoMappingRuleMatched
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Authorized:
+		return "authorized"
+	case NoMappingRuleMatched:
+		return "no_mapping_rule_matched"
+	default:
+		return "denied"
+	}
+}
+
+// AuthRepResult is the outcome of authorizing and reporting a request to 3scale.
+type AuthRepResult struct {
+	Decision Decision
+	// App identifies the application making the request, user keys are hashed so they are not leaked.
+	App string
+	// Usage holds the usage of the request, including the one accounted to the parents of its methods.
+	Usage backendC.Metrics
+	// UsageReports holds the limits of the application, when it has any.
+	UsageReports backendC.UsageReports
+}
+
+// serviceKey identifies a service of a tenant in the caches of the Authorizer.
+type serviceKey struct {
+	systemURL, serviceID string
+}
 
 type Authorizer struct {
-	systemCache     *threescale.ProxyConfigCache
+	source          threescale_client.ProxyConfigSource
+	backend         threescale_client.Backend
+	hierarchyCache  *hierarchyCache
+	ruleCache       *ruleCache
 	metricsReporter *metrics.Reporter
+	reporter        *Reporter
 }
 
-func (a *Authorizer) systemClientBuilder(systemURL string) (*sysC.ThreeScaleClient, error) {
-	sysURL, err := url.ParseRequestURI(systemURL)
-	if err != nil {
-		return nil, err
-	}
+func (a *Authorizer) AuthRep(ctx context.Context, request AuthorizeRequest) AuthRepResult {
+	tenant := threescale_client.Tenant{SystemURL: request.SystemUrl, AccessToken: request.AccessToken}
 
-	scheme, host, port := parseURL(sysURL)
-	ap, err := sysC.NewAdminPortal(scheme, host, port)
-	if err != nil {
-		return nil, err
-	}
+	entry := log.WithField("request_id", request.RequestID).WithField("service_id", request.ServiceId)
 
-	return sysC.NewThreeScale(ap, &http.Client{}), nil
-}
-func (a *Authorizer) backendClientBuilder(backendURL string) (*backendC.ThreeScaleClient, error) {
-	parsedUrl, err := url.ParseRequestURI(backendURL)
+	span, _ := tracing.StartSpan(ctx, "proxy_config_lookup", tracing.Client)
+	span.SetTag("service_id", request.ServiceId)
+	pce, err := a.source.GetProxyConfig(tenant, request.ServiceId)
 	if err != nil {
-		return nil, err
+		span.SetTag("error", logging.Redact(err.Error()))
 	}
-
-	scheme, host, port := parseURL(parsedUrl)
-	be, err := backendC.NewBackend(scheme, host, port)
+	span.Finish()
 	if err != nil {
-		return nil, err
+		entry.Errorf("Failed to get the proxy config: %v", err)
+		return AuthRepResult{Decision: Denied}
 	}
 
-	return backendC.NewThreeScale(be, &http.Client{}), nil
-}
-func (a *Authorizer) AuthRep(request AuthorizeRequest) bool {
-
-	var (
-		authRep authRepFn
-	)
+	rules := a.ruleCache.get(serviceKey{systemURL: tenant.SystemURL, serviceID: request.ServiceId}, pce.ProxyConfig)
+	if request.BackendPath != "" {
+		rules = backendProxyRules(rules, request.BackendPath, request.BackendPaths)
+	}
 
-	params := config.Params{
-		ServiceId:   request.ServiceId,
-		SystemUrl:   request.SystemUrl,
-		AccessToken: request.AccessToken,
+	m := generateMetrics(request.Path, request.Method, request.Query, rules)
+	if len(m) == 0 {
+		return AuthRepResult{Decision: NoMappingRuleMatched}
 	}
 
-	threeScaleClient, err := a.systemClientBuilder(params.SystemUrl)
-	if err != nil {
-		log.Fatal(err)
+	// Until the hierarchy is loaded the usage of the methods is not accounted to their parents locally,
+	// 3scale backend still does it.
+	hierarchy, _ := a.hierarchyCache.get(a.source, tenant, request.ServiceId, pce.ProxyConfig.Version)
+
+	authRepRequest := threescale_client.AuthRepRequest{
+		ServiceID: request.ServiceId,
+		Auth: backendC.TokenAuth{
+			Type:  pce.ProxyConfig.Content.BackendAuthenticationType,
+			Value: pce.ProxyConfig.Content.BackendAuthenticationValue,
+		},
+		AppID:   request.AppID,
+		AppKey:  request.AppKey,
+		UserKey: request.UserKey,
+		Usage:   m,
 	}
+	backendURL := pce.ProxyConfig.Content.Proxy.Backend.Endpoint
 
-	pce, err := a.systemCache.Get(&params, threeScaleClient)
+	span, _ = tracing.StartSpan(ctx, "backend_authrep", tracing.Client)
+	span.SetTag("service_id", request.ServiceId)
+	span.SetTag("peer.service", "3scale-backend")
+	resp, err := a.backend.AuthRep(backendURL, authRepRequest)
 	if err != nil {
-		log.Fatal(err)
+		entry.Errorf("Failed to call 3scale backend: %v", err)
+		span.SetTag("error", logging.Redact(err.Error()))
 	}
+	span.SetTag("authorized", strconv.FormatBool(resp.Success))
+	span.Finish()
 
-	m := generateMetrics(request.Path, request.Method, pce.ProxyConfig)
-	if len(m) == 0 {
-		return false
+	decision := Denied
+	if resp.Success {
+		decision = Authorized
+		a.reporter.authorized(request.RequestID, backendURL, request, authRepRequest.Auth)
 	}
 
-	backendClient, err := a.backendClientBuilder(pce.ProxyConfig.Content.Proxy.Backend.Endpoint)
-
-	var authRepRequest authRepRequest
-	if request.UserKey != "" {
-		authRepRequest.authKey = request.UserKey
-		authRepRequest.params = backendC.NewAuthRepParamsUserKey("", "", m, nil)
-		authRep = backendClient.AuthRepUserKey
-	} else {
-		authRepRequest.authKey = request.AppID
-		authRepRequest.params = backendC.NewAuthRepParamsAppID(request.AppKey, "", "", m, nil)
-		authRep = backendClient.AuthRepAppID
+	return AuthRepResult{
+		Decision:     decision,
+		App:          appIdentity(request),
+		Usage:        effectiveUsage(m, hierarchy),
+		UsageReports: resp.GetUsageReports(),
 	}
+}
 
-	authRepRequest.auth.Type = pce.ProxyConfig.Content.BackendAuthenticationType
-	authRepRequest.auth.Value = pce.ProxyConfig.Content.BackendAuthenticationValue
-
-	resp, _ := authRep(authRepRequest.auth, authRepRequest.authKey, params.ServiceId, authRepRequest.params, nil)
+// LoadMetricHierarchy loads the metric hierarchy of a proxy config version of a service, so the requests
+// to the service don't wait for it. It's a no-op once loaded.
+func (a *Authorizer) LoadMetricHierarchy(tenant threescale_client.Tenant, serviceID string, version int) error {
+	return a.hierarchyCache.load(a.source, tenant, serviceID, version)
+}
 
-	return resp.Success
+// appIdentity returns the application ID of a request, or a hash of its user key.
+func appIdentity(request AuthorizeRequest) string {
+	if request.UserKey == "" {
+		return request.AppID
+	}
+	sum := sha256.Sum256([]byte(request.UserKey))
+	return "user_key:" + hex.EncodeToString(sum[:8])
 }
 
-func NewAuthorizer(cache *threescale.ProxyConfigCache) *Authorizer {
+// NewAuthorizer returns an Authorizer getting the proxy configs from source, and authorizing the requests
+// through backend. The responses of the authorized requests are reported through reporter, when it's not nil.
+func NewAuthorizer(source threescale_client.ProxyConfigSource, backend threescale_client.Backend, reporter *Reporter) *Authorizer {
 	return &Authorizer{
-		systemCache:     cache,
+		source:          source,
+		backend:         backend,
+		reporter:        reporter,
+		hierarchyCache:  newHierarchyCache(),
+		ruleCache:       newRuleCache(),
 		metricsReporter: nil,
 	}
 }
 
-func generateMetrics(path string, method string, conf sysC.ProxyConfig) backendC.Metrics {
+// generateMetrics returns the usage of a request, adding up the deltas of every mapping rule it matches.
+func generateMetrics(path string, method string, query url.Values, rules []proxyRule) backendC.Metrics {
 	m := make(backendC.Metrics)
 
-	for _, pr := range conf.Content.Proxy.ProxyRules {
-		if match, err := regexp.MatchString(pr.Pattern, path); err == nil {
-			if match && strings.ToUpper(pr.HTTPMethod) == strings.ToUpper(method) {
-				baseDelta := 0
-				if val, ok := m[pr.MetricSystemName]; ok {
-					baseDelta = val
-				}
-				err = m.Add(pr.MetricSystemName, baseDelta+int(pr.Delta))
-				if err != nil {
-					log.Println(err)
-				}
-			}
+	for _, pr := range rules {
+		if !pr.rule.matches(method, path, query) {
+			continue
+		}
+		if err := m.Add(pr.MetricSystemName, m[pr.MetricSystemName]+int(pr.Delta)); err != nil {
+			log.Warnf("Failed to add the usage of metric %s: %v", pr.MetricSystemName, err)
 		}
 	}
 	return m
 }
 
-func parseURL(url *url.URL) (string, string, int) {
-	scheme := url.Scheme
-	if scheme == "" {
-		scheme = "https"
-	}
-
-	host, port, _ := net.SplitHostPort(url.Host)
-	if port == "" {
-		if scheme == "http" {
-			port = "80"
-		} else if scheme == "https" {
-			port = "443"
+// backendProxyRules returns the mapping rules that apply to the requests routed to the backend mounted at
+// backendPath: the rules of the backend itself and the ones defined at the product level. The mapping rules
+// of a backend are prefixed with its mount path, so each rule belongs to the backend with the longest mount
+// path prefixing its pattern.
+func backendProxyRules(rules []proxyRule, backendPath string, backendPaths []string) []proxyRule {
+	scoped := make([]proxyRule, 0, len(rules))
+	for _, pr := range rules {
+		owner := ruleOwner(pr.Pattern, backendPaths)
+		if owner == "/" || owner == backendPath {
+			scoped = append(scoped, pr)
 		}
 	}
+	return scoped
+}
 
-	if host == "" {
-		host = url.Host
+func ruleOwner(pattern string, backendPaths []string) string {
+	pattern = strings.TrimPrefix(pattern, "^")
+	owner := "/"
+	for _, p := range backendPaths {
+		if p == "/" || len(p) <= len(owner) {
+			continue
+		}
+		if pattern == p || strings.HasPrefix(pattern, p+"/") || strings.HasPrefix(pattern, p+"$") || strings.HasPrefix(pattern, p+"?") {
+			owner = p
+		}
 	}
-
-	p, _ := strconv.Atoi(port)
-	return scheme, host, p
+	return owner
 }
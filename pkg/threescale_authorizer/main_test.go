@@ -0,0 +1,218 @@
+package threescale_authorizer
+
+import (
+	backendC "github.com/3scale/3scale-go-client/client"
+	sysC "github.com/3scale/3scale-porta-go-client/client"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func rule(method, pattern, metric string, delta int64) sysC.ProxyRule {
+	return sysC.ProxyRule{HTTPMethod: method, Pattern: pattern, MetricSystemName: metric, Delta: delta}
+}
+
+func TestGenerateMetrics(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  []sysC.ProxyRule
+		method string
+		path   string
+		query  string
+		want   backendC.Metrics
+	}{
+		{
+			name:   "root pattern matches every path",
+			rules:  []sysC.ProxyRule{rule("GET", "/", "hits", 1)},
+			method: "GET",
+			path:   "/any/path",
+			want:   backendC.Metrics{"hits": 1},
+		},
+		{
+			name:   "method must match",
+			rules:  []sysC.ProxyRule{rule("POST", "/", "hits", 1)},
+			method: "GET",
+			path:   "/",
+			want:   backendC.Metrics{},
+		},
+		{
+			name:   "method is case insensitive",
+			rules:  []sysC.ProxyRule{rule("get", "/", "hits", 1)},
+			method: "GET",
+			path:   "/",
+			want:   backendC.Metrics{"hits": 1},
+		},
+		{
+			name:   "pattern is a prefix",
+			rules:  []sysC.ProxyRule{rule("GET", "/foo", "foo", 1)},
+			method: "GET",
+			path:   "/foobar",
+			want:   backendC.Metrics{"foo": 1},
+		},
+		{
+			name:   "pattern is anchored at the start of the path",
+			rules:  []sysC.ProxyRule{rule("GET", "/foo", "foo", 1)},
+			method: "GET",
+			path:   "/bar/foo",
+			want:   backendC.Metrics{},
+		},
+		{
+			name:   "dollar matches the whole path",
+			rules:  []sysC.ProxyRule{rule("GET", "/foo$", "foo", 1)},
+			method: "GET",
+			path:   "/foo/bar",
+			want:   backendC.Metrics{},
+		},
+		{
+			name:   "dollar matches the exact path",
+			rules:  []sysC.ProxyRule{rule("GET", "/foo$", "foo", 1)},
+			method: "GET",
+			path:   "/foo",
+			want:   backendC.Metrics{"foo": 1},
+		},
+		{
+			name:   "placeholder matches a segment",
+			rules:  []sysC.ProxyRule{rule("GET", "/products/{id}/price$", "price", 1)},
+			method: "GET",
+			path:   "/products/abc-1.2/price",
+			want:   backendC.Metrics{"price": 1},
+		},
+		{
+			name:   "placeholder doesn't match several segments",
+			rules:  []sysC.ProxyRule{rule("GET", "/products/{id}/price$", "price", 1)},
+			method: "GET",
+			path:   "/products/a/b/price",
+			want:   backendC.Metrics{},
+		},
+		{
+			name:   "placeholder doesn't match an empty segment",
+			rules:  []sysC.ProxyRule{rule("GET", "/products/{id}$", "product", 1)},
+			method: "GET",
+			path:   "/products/",
+			want:   backendC.Metrics{},
+		},
+		{
+			name:   "dots are literal",
+			rules:  []sysC.ProxyRule{rule("GET", "/file.json", "file", 1)},
+			method: "GET",
+			path:   "/file_json",
+			want:   backendC.Metrics{},
+		},
+		{
+			name:   "query parameter value must match",
+			rules:  []sysC.ProxyRule{rule("GET", "/search?type=book", "books", 1)},
+			method: "GET",
+			path:   "/search",
+			query:  "type=movie",
+			want:   backendC.Metrics{},
+		},
+		{
+			name:   "query parameter with the same value",
+			rules:  []sysC.ProxyRule{rule("GET", "/search?type=book", "books", 1)},
+			method: "GET",
+			path:   "/search",
+			query:  "type=book&page=2",
+			want:   backendC.Metrics{"books": 1},
+		},
+		{
+			name:   "query parameter placeholder matches any value",
+			rules:  []sysC.ProxyRule{rule("GET", "/search?q={query}", "search", 1)},
+			method: "GET",
+			path:   "/search",
+			query:  "q=envoy",
+			want:   backendC.Metrics{"search": 1},
+		},
+		{
+			name:   "query parameter placeholder requires the parameter",
+			rules:  []sysC.ProxyRule{rule("GET", "/search?q={query}", "search", 1)},
+			method: "GET",
+			path:   "/search",
+			want:   backendC.Metrics{},
+		},
+		{
+			name: "deltas of every matching rule are added up",
+			rules: []sysC.ProxyRule{
+				rule("GET", "/", "hits", 1),
+				rule("GET", "/foo", "hits", 2),
+				rule("GET", "/foo", "foo", 3),
+				rule("GET", "/bar", "bar", 1),
+			},
+			method: "GET",
+			path:   "/foo",
+			want:   backendC.Metrics{"hits": 3, "foo": 3},
+		},
+		{
+			name:   "no rules",
+			method: "GET",
+			path:   "/",
+			want:   backendC.Metrics{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := generateMetrics(tt.path, tt.method, query, compileRules(tt.rules))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("generateMetrics(%s %s?%s) = %v, want %v", tt.method, tt.path, tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackendProxyRules(t *testing.T) {
+	rules := []sysC.ProxyRule{
+		rule("GET", "/", "hits", 1),
+		rule("GET", "/echo/hello", "hello", 1),
+		rule("GET", "/echo$", "echo", 1),
+		rule("GET", "/echoes/hello", "echoes", 1),
+		rule("GET", "/echo/v2/hello", "hello_v2", 1),
+	}
+	backendPaths := []string{"/echo", "/echoes", "/echo/v2", "/"}
+
+	tests := []struct {
+		backendPath string
+		want        []string
+	}{
+		{"/echo", []string{"hits", "hello", "echo"}},
+		{"/echoes", []string{"hits", "echoes"}},
+		{"/echo/v2", []string{"hits", "hello_v2"}},
+		{"/", []string{"hits"}},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, pr := range backendProxyRules(compileRules(rules), tt.backendPath, backendPaths) {
+			got = append(got, pr.MetricSystemName)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("backendProxyRules(%s) = %v, want %v", tt.backendPath, got, tt.want)
+		}
+	}
+}
+
+func TestRuleCache(t *testing.T) {
+	c := newRuleCache()
+	key := serviceKey{systemURL: "https://tenant-admin.3scale.net", serviceID: "1001"}
+	var conf sysC.ProxyConfig
+	conf.Version = 1
+	conf.Content.Proxy.ProxyRules = []sysC.ProxyRule{rule("GET", "/", "hits", 1)}
+
+	first := c.get(key, conf)
+	if len(first) != 1 {
+		t.Fatalf("got %d rules, want 1", len(first))
+	}
+
+	// The rules are only compiled again for a new proxy config version.
+	conf.Content.Proxy.ProxyRules = append(conf.Content.Proxy.ProxyRules, rule("GET", "/hello", "hello", 1))
+	if rules := c.get(key, conf); len(rules) != 1 || rules[0].rule.path != first[0].rule.path {
+		t.Errorf("rules of the same version compiled again: %v", rules)
+	}
+	conf.Version = 2
+	if rules := c.get(key, conf); len(rules) != 2 {
+		t.Errorf("got %d rules for the new version, want 2", len(rules))
+	}
+}
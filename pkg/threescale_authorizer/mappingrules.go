@@ -0,0 +1,132 @@
+package threescale_authorizer
+
+import (
+	sysC "github.com/3scale/3scale-porta-go-client/client"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// placeholder matches the "{name}" placeholders of a mapping rule pattern.
+var placeholder = regexp.MustCompile(`\{[^}]*\}`)
+
+// placeholderValue is what a placeholder matches in a request path, like APIcast does.
+const placeholderValue = `[\w\-.~%!$&'()*+,;=@:]+`
+
+// mappingRule is a mapping rule matched like APIcast does: the pattern matches from the start of the
+// path, a trailing "$" requires the whole path to match, and the "{name}" placeholders match a path
+// segment. The query string parameters of the pattern must be present in the request, with the same
+// value unless the value is a placeholder.
+type mappingRule struct {
+	method string
+	path   *regexp.Regexp
+	query  url.Values
+}
+
+func newMappingRule(pr sysC.ProxyRule) (mappingRule, error) {
+	pattern, rawQuery := pr.Pattern, ""
+	if i := strings.Index(pattern, "?"); i >= 0 {
+		pattern, rawQuery = pattern[:i], pattern[i+1:]
+	}
+
+	exact := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimPrefix(strings.TrimSuffix(pattern, "$"), "^")
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	last := 0
+	for _, loc := range placeholder.FindAllStringIndex(pattern, -1) {
+		expr.WriteString(regexp.QuoteMeta(pattern[last:loc[0]]))
+		expr.WriteString(placeholderValue)
+		last = loc[1]
+	}
+	expr.WriteString(regexp.QuoteMeta(pattern[last:]))
+	if exact {
+		expr.WriteString("$")
+	}
+
+	path, err := regexp.Compile(expr.String())
+	if err != nil {
+		return mappingRule{}, err
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return mappingRule{}, err
+	}
+	return mappingRule{method: pr.HTTPMethod, path: path, query: query}, nil
+}
+
+// proxyRule is a mapping rule of a proxy config, with its pattern compiled.
+type proxyRule struct {
+	sysC.ProxyRule
+	rule mappingRule
+}
+
+// compileRules compiles the mapping rules of a proxy config, skipping the invalid ones.
+func compileRules(rules []sysC.ProxyRule) []proxyRule {
+	compiled := make([]proxyRule, 0, len(rules))
+	for _, pr := range rules {
+		rule, err := newMappingRule(pr)
+		if err != nil {
+			log.Warnf("Invalid mapping rule %s %s: %v", pr.HTTPMethod, pr.Pattern, err)
+			continue
+		}
+		compiled = append(compiled, proxyRule{ProxyRule: pr, rule: rule})
+	}
+	return compiled
+}
+
+type ruleEntry struct {
+	version int
+	rules   []proxyRule
+}
+
+// ruleCache holds the compiled mapping rules of each service. They only change with a new proxy config,
+// so they are compiled once per proxy config version rather than on every request.
+type ruleCache struct {
+	sync.Mutex
+	entries map[serviceKey]ruleEntry
+}
+
+func newRuleCache() *ruleCache {
+	return &ruleCache{entries: make(map[serviceKey]ruleEntry)}
+}
+
+// get returns the compiled mapping rules of a proxy config, compiling them the first time its version is seen.
+func (c *ruleCache) get(key serviceKey, conf sysC.ProxyConfig) []proxyRule {
+	c.Lock()
+	defer c.Unlock()
+	if entry, ok := c.entries[key]; ok && entry.version == conf.Version {
+		return entry.rules
+	}
+	rules := compileRules(conf.Content.Proxy.ProxyRules)
+	c.entries[key] = ruleEntry{version: conf.Version, rules: rules}
+	return rules
+}
+
+func (r mappingRule) matches(method, path string, query url.Values) bool {
+	if !strings.EqualFold(r.method, method) || !r.path.MatchString(path) {
+		return false
+	}
+	for name, values := range r.query {
+		if _, ok := query[name]; !ok {
+			return false
+		}
+		for _, value := range values {
+			if placeholder.FindString(value) != value && !hasValue(query[name], value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func hasValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
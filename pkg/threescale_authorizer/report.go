@@ -0,0 +1,140 @@
+package threescale_authorizer
+
+import (
+	"3scale-envoy/pkg/threescale_client"
+	"context"
+	backendC "github.com/3scale/3scale-go-client/client"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pendingReportTTL is how long an authorized request waits for its response to be reported.
+	pendingReportTTL = 5 * time.Minute
+	// maxBatchSize is the number of transactions reported to 3scale backend in a single call.
+	maxBatchSize = 500
+)
+
+// pendingReport is an authorized request waiting for its response.
+type pendingReport struct {
+	batch   batchKey
+	appID   string
+	userKey string
+	expires time.Time
+}
+
+// batchKey groups the transactions reported to 3scale backend in the same call.
+type batchKey struct {
+	backendURL string
+	serviceID  string
+	auth       backendC.TokenAuth
+}
+
+// Reporter reports the response codes, and optionally the request lines, of the authorized requests
+// to 3scale backend in batches, once Envoy logs their responses. The usage of the requests is not
+// reported again, it was already reported when they were authorized.
+type Reporter struct {
+	sync.Mutex
+	interval time.Duration
+	logs     bool
+	pending  map[string]pendingReport
+	batches  map[batchKey][]threescale_client.Transaction
+	backend  threescale_client.Backend
+}
+
+// NewReporter returns a Reporter flushing the batches to backend every interval. Request lines are only
+// reported when logs is true.
+func NewReporter(backend threescale_client.Backend, interval time.Duration, logs bool) *Reporter {
+	return &Reporter{
+		interval: interval,
+		logs:     logs,
+		pending:  make(map[string]pendingReport),
+		batches:  make(map[batchKey][]threescale_client.Transaction),
+		backend:  backend,
+	}
+}
+
+// authorized records an authorized request, so its response can be reported once it completes.
+func (r *Reporter) authorized(requestID, backendURL string, request AuthorizeRequest, auth backendC.TokenAuth) {
+	if r == nil || requestID == "" {
+		return
+	}
+
+	p := pendingReport{
+		batch:   batchKey{backendURL: backendURL, serviceID: request.ServiceId, auth: auth},
+		expires: time.Now().Add(pendingReportTTL),
+	}
+	if request.UserKey != "" {
+		p.userKey = request.UserKey
+	} else {
+		p.appID = request.AppID
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.pending[requestID] = p
+}
+
+// Completed queues the response of an authorized request to be reported. Requests that were not
+// authorized by this process are ignored.
+func (r *Reporter) Completed(requestID string, start time.Time, method, path string, code int) {
+	r.Lock()
+	defer r.Unlock()
+
+	p, ok := r.pending[requestID]
+	if !ok {
+		return
+	}
+	delete(r.pending, requestID)
+
+	t := threescale_client.Transaction{AppID: p.appID, UserKey: p.userKey, Timestamp: start, Code: code}
+	if r.logs {
+		// The query string is left out, as it can hold the credentials of the application.
+		t.Request = method + " " + strings.SplitN(path, "?", 2)[0]
+	}
+	r.batches[p.batch] = append(r.batches[p.batch], t)
+}
+
+// Run flushes the batches every interval, until the context is done.
+func (r *Reporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			r.flush()
+			return
+		case <-ticker.C:
+			r.flush()
+		}
+	}
+}
+
+func (r *Reporter) flush() {
+	r.Lock()
+	batches := r.batches
+	r.batches = make(map[batchKey][]threescale_client.Transaction)
+
+	now := time.Now()
+	for id, p := range r.pending {
+		if now.After(p.expires) {
+			delete(r.pending, id)
+		}
+	}
+	r.Unlock()
+
+	for key, transactions := range batches {
+		for len(transactions) > 0 {
+			n := len(transactions)
+			if n > maxBatchSize {
+				n = maxBatchSize
+			}
+			if err := r.backend.Report(key.backendURL, key.serviceID, key.auth, transactions[:n]); err != nil {
+				log.Errorf("Failed to report %d transactions of service %s: %v", n, key.serviceID, err)
+			}
+			transactions = transactions[n:]
+		}
+	}
+}
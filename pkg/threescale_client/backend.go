@@ -0,0 +1,78 @@
+package threescale_client
+
+import (
+	"fmt"
+	backendC "github.com/3scale/3scale-go-client/client"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const transactionsPath = "/transactions.xml"
+
+// BackendClient calls the 3scale Service Management API.
+type BackendClient struct {
+	httpClient *http.Client
+}
+
+// NewBackendClient returns a BackendClient calling the Service Management API with httpClient.
+func NewBackendClient(httpClient *http.Client) *BackendClient {
+	return &BackendClient{httpClient: httpClient}
+}
+
+func (c *BackendClient) AuthRep(backendURL string, request AuthRepRequest) (backendC.ApiResponse, error) {
+	parsedURL, err := url.ParseRequestURI(backendURL)
+	if err != nil {
+		return backendC.ApiResponse{}, err
+	}
+
+	scheme, host, port := parseURL(parsedURL)
+	be, err := backendC.NewBackend(scheme, host, port)
+	if err != nil {
+		return backendC.ApiResponse{}, err
+	}
+	client := backendC.NewThreeScale(be, c.httpClient)
+
+	if request.UserKey != "" {
+		params := backendC.NewAuthRepParamsUserKey("", "", request.Usage, nil)
+		return client.AuthRepUserKey(request.Auth, request.UserKey, request.ServiceID, params, nil)
+	}
+	params := backendC.NewAuthRepParamsAppID(request.AppKey, "", "", request.Usage, nil)
+	return client.AuthRepAppID(request.Auth, request.AppID, request.ServiceID, params, nil)
+}
+
+// Report reports the responses of a batch of requests, without usage as it was reported when they
+// were authorized.
+func (c *BackendClient) Report(backendURL, serviceID string, auth backendC.TokenAuth, transactions []Transaction) error {
+	values := url.Values{}
+	if err := auth.SetURLValues(&values); err != nil {
+		return err
+	}
+	values.Set("service_id", serviceID)
+
+	for i, t := range transactions {
+		prefix := fmt.Sprintf("transactions[%d]", i)
+		if t.UserKey != "" {
+			values.Set(prefix+"[user_key]", t.UserKey)
+		} else {
+			values.Set(prefix+"[app_id]", t.AppID)
+		}
+		values.Set(prefix+"[timestamp]", t.Timestamp.Format("2006-01-02 15:04:05 -0700"))
+		values.Set(prefix+"[log][code]", strconv.Itoa(t.Code))
+		if t.Request != "" {
+			values.Set(prefix+"[log][request]", t.Request)
+		}
+	}
+
+	resp, err := c.httpClient.PostForm(strings.TrimSuffix(backendURL, "/")+transactionsPath, values)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package threescale_client
+
+import (
+	"sync"
+	"time"
+)
+
+type cacheKey struct {
+	systemURL, accessToken, serviceID string
+}
+
+type cacheEntry struct {
+	proxyConfig ProxyConfig
+	expires     time.Time
+	refreshing  bool
+}
+
+// CachingSource caches the proxy configs of another source. Cached proxy configs expire after a TTL, and
+// are refreshed in the background when requested during the refresh interval before they expire, so the
+// services in use are rarely fetched while a request waits. The services and the metric hierarchies are
+// not cached.
+type CachingSource struct {
+	source          ProxyConfigSource
+	ttl             time.Duration
+	refreshInterval time.Duration
+	// retries is the number of additional attempts made to refresh a proxy config.
+	retries    int
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+}
+
+// NewCachingSource returns a CachingSource caching up to maxEntries proxy configs of source.
+func NewCachingSource(source ProxyConfigSource, ttl, refreshInterval time.Duration, retries, maxEntries int) *CachingSource {
+	return &CachingSource{
+		source:          source,
+		ttl:             ttl,
+		refreshInterval: refreshInterval,
+		retries:         retries,
+		maxEntries:      maxEntries,
+		entries:         make(map[cacheKey]*cacheEntry),
+	}
+}
+
+func (c *CachingSource) ListServices(tenant Tenant) ([]string, error) {
+	return c.source.ListServices(tenant)
+}
+
+func (c *CachingSource) GetMetricHierarchy(tenant Tenant, serviceID string) (map[string]string, error) {
+	return c.source.GetMetricHierarchy(tenant, serviceID)
+}
+
+func (c *CachingSource) GetProxyConfig(tenant Tenant, serviceID string) (ProxyConfig, error) {
+	key := cacheKey{systemURL: tenant.SystemURL, accessToken: tenant.AccessToken, serviceID: serviceID}
+	now := time.Now()
+
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok && now.Before(entry.expires) {
+		if !entry.refreshing && !now.Before(entry.expires.Add(-c.refreshInterval)) {
+			entry.refreshing = true
+			go c.refresh(key, tenant, serviceID)
+		}
+		proxyConf := entry.proxyConfig
+		c.mu.Unlock()
+		return proxyConf, nil
+	}
+	c.mu.Unlock()
+
+	proxyConf, err := c.source.GetProxyConfig(tenant, serviceID)
+	if err != nil {
+		return ProxyConfig{}, err
+	}
+	c.set(key, proxyConf)
+	return proxyConf, nil
+}
+
+// Invalidate drops the cached proxy config of a service, so it's fetched again the next time.
+func (c *CachingSource) Invalidate(tenant Tenant, serviceID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, cacheKey{systemURL: tenant.SystemURL, accessToken: tenant.AccessToken, serviceID: serviceID})
+}
+
+// Len returns the number of proxy configs cached and not expired.
+func (c *CachingSource) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	now := time.Now()
+	for _, entry := range c.entries {
+		if now.Before(entry.expires) {
+			n++
+		}
+	}
+	return n
+}
+
+// Flush drops every cached proxy config.
+func (c *CachingSource) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[cacheKey]*cacheEntry)
+}
+
+func (c *CachingSource) refresh(key cacheKey, tenant Tenant, serviceID string) {
+	var err error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		var proxyConf ProxyConfig
+		if proxyConf, err = c.source.GetProxyConfig(tenant, serviceID); err == nil {
+			c.set(key, proxyConf)
+			return
+		}
+	}
+	log.WithField("service_id", serviceID).Warnf("Failed to refresh the cached proxy config: %v", err)
+
+	// The proxy config is still served until it expires, and refreshed again when requested.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok {
+		entry.refreshing = false
+	}
+}
+
+// set caches a proxy config. When the cache is full, the expired proxy configs are dropped first,
+// then the one expiring the soonest.
+func (c *CachingSource) set(key cacheKey, proxyConf ProxyConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := c.entries[key]; !ok && c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		var oldest cacheKey
+		var oldestExpires time.Time
+		for k, entry := range c.entries {
+			if !entry.expires.After(now) {
+				delete(c.entries, k)
+			} else if oldestExpires.IsZero() || entry.expires.Before(oldestExpires) {
+				oldest, oldestExpires = k, entry.expires
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[key] = &cacheEntry{proxyConfig: proxyConf, expires: now.Add(c.ttl)}
+}
@@ -0,0 +1,143 @@
+package threescale_client
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingSource returns a new proxy config version on every call, and fails while failing is set.
+type countingSource struct {
+	sync.Mutex
+	calls   map[string]int
+	failing bool
+}
+
+func (s *countingSource) ListServices(tenant Tenant) ([]string, error) {
+	return nil, nil
+}
+
+func (s *countingSource) GetProxyConfig(tenant Tenant, serviceID string) (ProxyConfig, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.failing {
+		return ProxyConfig{}, errors.New("unreachable")
+	}
+	s.calls[tenant.AccessToken+"/"+serviceID]++
+
+	var proxyConf ProxyConfig
+	proxyConf.ProxyConfig.Version = s.calls[tenant.AccessToken+"/"+serviceID]
+	return proxyConf, nil
+}
+
+func (s *countingSource) GetMetricHierarchy(tenant Tenant, serviceID string) (map[string]string, error) {
+	return nil, nil
+}
+
+func (s *countingSource) count(tenant Tenant, serviceID string) int {
+	s.Lock()
+	defer s.Unlock()
+	return s.calls[tenant.AccessToken+"/"+serviceID]
+}
+
+func TestCachingSource(t *testing.T) {
+	tenant := Tenant{SystemURL: "https://example-admin.3scale.net", AccessToken: "token"}
+	version := func(c *CachingSource, tenant Tenant, serviceID string) int {
+		proxyConf, err := c.GetProxyConfig(tenant, serviceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proxyConf.ProxyConfig.Version
+	}
+
+	t.Run("cached until invalidated", func(t *testing.T) {
+		source := &countingSource{calls: map[string]int{}}
+		c := NewCachingSource(source, time.Minute, time.Second, 0, 10)
+
+		if v := version(c, tenant, "1"); v != 1 {
+			t.Errorf("version = %d, want 1", v)
+		}
+		if v := version(c, tenant, "1"); v != 1 || source.count(tenant, "1") != 1 {
+			t.Errorf("version = %d after %d calls, want the cached version 1", v, source.count(tenant, "1"))
+		}
+
+		// The access token is part of the key, a tenant can't read the proxy configs cached for another one.
+		other := Tenant{SystemURL: tenant.SystemURL, AccessToken: "other"}
+		version(c, other, "1")
+		if source.count(other, "1") != 1 {
+			t.Errorf("proxy config of another access token served from the cache")
+		}
+
+		c.Invalidate(tenant, "1")
+		if v := version(c, tenant, "1"); v != 2 {
+			t.Errorf("version after invalidation = %d, want 2", v)
+		}
+		c.Flush()
+		if v := version(c, tenant, "1"); v != 3 {
+			t.Errorf("version after flush = %d, want 3", v)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		source := &countingSource{calls: map[string]int{}}
+		c := NewCachingSource(source, 10*time.Millisecond, 0, 0, 10)
+
+		version(c, tenant, "1")
+		time.Sleep(20 * time.Millisecond)
+		if v := version(c, tenant, "1"); v != 2 {
+			t.Errorf("version after expiry = %d, want 2", v)
+		}
+	})
+
+	t.Run("refreshed before expiry", func(t *testing.T) {
+		source := &countingSource{calls: map[string]int{}}
+		c := NewCachingSource(source, time.Minute, time.Minute, 0, 10)
+
+		// Within the refresh interval, the cached proxy config is returned and refreshed in the background.
+		if v := version(c, tenant, "1"); v != 1 {
+			t.Errorf("version = %d, want 1", v)
+		}
+		if v := version(c, tenant, "1"); v != 1 {
+			t.Errorf("version = %d, want the cached version 1", v)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for source.count(tenant, "1") != 2 {
+			if time.Now().After(deadline) {
+				t.Fatal("the proxy config was not refreshed")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	t.Run("failed refresh keeps the cached proxy config", func(t *testing.T) {
+		source := &countingSource{calls: map[string]int{}}
+		c := NewCachingSource(source, time.Minute, time.Minute, 2, 10)
+
+		version(c, tenant, "1")
+		source.Lock()
+		source.failing = true
+		source.Unlock()
+		for i := 0; i < 3; i++ {
+			if v := version(c, tenant, "1"); v != 1 {
+				t.Errorf("version = %d, want the cached version 1", v)
+			}
+		}
+	})
+
+	t.Run("evicts the entry expiring the soonest", func(t *testing.T) {
+		source := &countingSource{calls: map[string]int{}}
+		c := NewCachingSource(source, time.Minute, time.Second, 0, 2)
+
+		for _, id := range []string{"1", "2", "3"} {
+			version(c, tenant, id)
+			time.Sleep(time.Millisecond)
+		}
+		if v := version(c, tenant, "1"); v != 2 {
+			t.Errorf("version of the evicted service = %d, want 2", v)
+		}
+		if v := version(c, tenant, "3"); v != 1 {
+			t.Errorf("version of the last cached service = %d, want 1", v)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package threescale_client
+
+import (
+	"3scale-envoy/pkg/logging"
+	backendC "github.com/3scale/3scale-go-client/client"
+	sysC "github.com/3scale/3scale-porta-go-client/client"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	log = logging.Logger
+)
+
+// Tenant is the Admin portal of a 3scale account, and the access token its Account Management API is called with.
+type Tenant struct {
+	SystemURL   string
+	AccessToken string
+}
+
+// ProxyConfig is the production proxy config of a service, as returned by the Account Management API.
+type ProxyConfig struct {
+	sysC.ProxyConfigElement
+	// Raw is the JSON document the proxy config was decoded from, holding the parts the 3scale client
+	// doesn't decode, like the API backends of a product.
+	Raw []byte
+}
+
+// ProxyConfigSource retrieves the services of the 3scale tenants and their configuration.
+type ProxyConfigSource interface {
+	// ListServices returns the IDs of the services of a tenant.
+	ListServices(tenant Tenant) ([]string, error)
+	// GetProxyConfig returns the latest proxy config of a service.
+	GetProxyConfig(tenant Tenant, serviceID string) (ProxyConfig, error)
+	// GetMetricHierarchy maps the system name of each method of a service to the one of its parent metric.
+	GetMetricHierarchy(tenant Tenant, serviceID string) (map[string]string, error)
+}
+
+// AuthRepRequest is a request authorized, and reported when authorized, to the Service Management API.
+type AuthRepRequest struct {
+	ServiceID string
+	Auth      backendC.TokenAuth
+	// The application is identified by its AppID and AppKey, or by its UserKey.
+	AppID, AppKey, UserKey string
+	Usage                  backendC.Metrics
+}
+
+// Transaction is the response of an authorized request, reported once it completes.
+type Transaction struct {
+	AppID, UserKey string
+	Timestamp      time.Time
+	Code           int
+	// Request is the request line, only reported when not empty.
+	Request string
+}
+
+// Backend authorizes and reports the requests to the 3scale Service Management API at backendURL.
+type Backend interface {
+	AuthRep(backendURL string, request AuthRepRequest) (backendC.ApiResponse, error)
+	Report(backendURL, serviceID string, auth backendC.TokenAuth, transactions []Transaction) error
+}
+
+// parseURL returns the scheme, host and port of a 3scale URL, https and the default port of the scheme
+// when they are missing.
+func parseURL(url *url.URL) (string, string, int) {
+	scheme := url.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+
+	host, port, _ := net.SplitHostPort(url.Host)
+	if port == "" {
+		if scheme == "http" {
+			port = "80"
+		} else if scheme == "https" {
+			port = "443"
+		}
+	}
+
+	if host == "" {
+		host = url.Host
+	}
+
+	p, _ := strconv.Atoi(port)
+	return scheme, host, p
+}
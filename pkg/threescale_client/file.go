@@ -0,0 +1,55 @@
+package threescale_client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+)
+
+// FileSource serves the proxy configs read from files, as returned by the Account Management API, to
+// every tenant. It has no metric hierarchies, so the usage of the methods is not accounted to their
+// parent metrics locally.
+type FileSource struct {
+	proxyConfigs map[string]ProxyConfig
+}
+
+// NewFileSource reads the proxy config files, keyed by the ID of their service.
+func NewFileSource(paths ...string) (*FileSource, error) {
+	s := &FileSource{proxyConfigs: make(map[string]ProxyConfig, len(paths))}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		proxyConf := ProxyConfig{Raw: data}
+		if err := json.Unmarshal(data, &proxyConf.ProxyConfigElement); err != nil {
+			return nil, fmt.Errorf("%s: invalid proxy config: %v", path, err)
+		}
+		s.proxyConfigs[strconv.FormatInt(proxyConf.ProxyConfig.Content.ID, 10)] = proxyConf
+	}
+	return s, nil
+}
+
+func (s *FileSource) ListServices(tenant Tenant) ([]string, error) {
+	ids := make([]string, 0, len(s.proxyConfigs))
+	for id := range s.proxyConfigs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (s *FileSource) GetProxyConfig(tenant Tenant, serviceID string) (ProxyConfig, error) {
+	proxyConf, ok := s.proxyConfigs[serviceID]
+	if !ok {
+		return ProxyConfig{}, fmt.Errorf("no proxy config file for service %s", serviceID)
+	}
+	return proxyConf, nil
+}
+
+func (s *FileSource) GetMetricHierarchy(tenant Tenant, serviceID string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
@@ -0,0 +1,130 @@
+package threescale_client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/http2"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// HTTPConfig tunes the HTTP clients calling 3scale.
+type HTTPConfig struct {
+	DialTimeout, TLSHandshakeTimeout time.Duration
+	// RequestTimeout bounds a whole request, from dialing to reading the response body.
+	RequestTimeout time.Duration
+	// KeepAlive is the interval of the TCP keep-alive probes, disabled when negative.
+	KeepAlive time.Duration
+	// Idle connections are kept for reuse up to IdleConnTimeout, at most MaxIdleConns of them and
+	// MaxIdleConnsPerHost for each 3scale host.
+	IdleConnTimeout                   time.Duration
+	MaxIdleConns, MaxIdleConnsPerHost int
+	// HTTP2 is negotiated with the https hosts when enabled.
+	HTTP2 bool
+	// CAFile is a PEM bundle trusted in addition to the system CAs, like the CA of an on-premises 3scale.
+	CAFile string
+	// Proxy is the outbound proxy of the requests, read from the environment when not set.
+	Proxy HTTPProxy
+}
+
+// DefaultHTTPConfig is the HTTPConfig of the clients calling 3scale when none is configured.
+var DefaultHTTPConfig = HTTPConfig{
+	DialTimeout:         5 * time.Second,
+	TLSHandshakeTimeout: 5 * time.Second,
+	RequestTimeout:      10 * time.Second,
+	KeepAlive:           30 * time.Second,
+	IdleConnTimeout:     90 * time.Second,
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 100,
+	HTTP2:               true,
+}
+
+// HTTPProxy routes the requests through a proxy, like the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+// variables do. The empty fields are read from those variables.
+type HTTPProxy struct {
+	// HTTPProxy and HTTPSProxy are the proxies of the http and https requests.
+	HTTPProxy, HTTPSProxy string
+	// NoProxy lists the hosts, domains and CIDRs reached without proxy, comma-separated. "*" disables the proxy.
+	NoProxy string
+}
+
+func (p HTTPProxy) proxyFunc() func(*http.Request) (*url.URL, error) {
+	env := httpproxy.FromEnvironment()
+	config := &httpproxy.Config{
+		HTTPProxy:  firstNonEmpty(p.HTTPProxy, env.HTTPProxy),
+		HTTPSProxy: firstNonEmpty(p.HTTPSProxy, env.HTTPSProxy),
+		NoProxy:    firstNonEmpty(p.NoProxy, env.NoProxy),
+		CGI:        env.CGI,
+	}
+	proxyForURL := config.ProxyFunc()
+	return func(r *http.Request) (*url.URL, error) {
+		return proxyForURL(r.URL)
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// NewHTTPClient returns an HTTP client pooling the connections to each 3scale host, to be shared by
+// every call to the same 3scale API.
+func NewHTTPClient(config HTTPConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+	if config.CAFile != "" {
+		pool, err := certPool(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := &http.Transport{
+		Proxy: config.Proxy.proxyFunc(),
+		DialContext: (&net.Dialer{
+			Timeout:   config.DialTimeout,
+			KeepAlive: config.KeepAlive,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: config.TLSHandshakeTimeout,
+		IdleConnTimeout:     config.IdleConnTimeout,
+		MaxIdleConns:        config.MaxIdleConns,
+		MaxIdleConnsPerHost: config.MaxIdleConnsPerHost,
+	}
+	if config.HTTP2 {
+		if err := http2.ConfigureTransport(transport); err != nil {
+			return nil, err
+		}
+	} else {
+		// A non-nil empty map disables HTTP/2.
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return &http.Client{Transport: transport, Timeout: config.RequestTimeout}, nil
+}
+
+// certPool returns the system CAs and the ones of a PEM bundle.
+func certPool(caFile string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificate found", caFile)
+	}
+	return pool, nil
+}
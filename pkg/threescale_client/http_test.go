@@ -0,0 +1,157 @@
+package threescale_client
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewHTTPClient(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "threescale-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	invalidCAFile := filepath.Join(dir, "invalid.pem")
+	if err := ioutil.WriteFile(invalidCAFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := HTTPConfig{
+		DialTimeout:         time.Second,
+		TLSHandshakeTimeout: time.Second,
+		RequestTimeout:      5 * time.Second,
+		IdleConnTimeout:     time.Minute,
+		MaxIdleConns:        10,
+		MaxIdleConnsPerHost: 10,
+	}
+
+	tests := []struct {
+		name      string
+		http2     bool
+		caFile    string
+		wantProto string
+		wantErr   string
+	}{
+		{name: "private CA", caFile: caFile, wantProto: "HTTP/1.1"},
+		{name: "HTTP/2", http2: true, caFile: caFile, wantProto: "HTTP/2.0"},
+		{name: "untrusted CA", wantErr: "certificate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := config
+			c.HTTP2 = tt.http2
+			c.CAFile = tt.caFile
+			client, err := NewHTTPClient(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := client.Get(server.URL)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			proto, _ := ioutil.ReadAll(resp.Body)
+			if string(proto) != tt.wantProto {
+				t.Errorf("protocol = %s, want %s", proto, tt.wantProto)
+			}
+		})
+	}
+
+	if _, err := NewHTTPClient(HTTPConfig{CAFile: invalidCAFile}); err == nil {
+		t.Error("invalid CA bundle: expected an error")
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A proxied request holds the absolute URL of the target.
+		w.Write([]byte("proxied " + r.URL.String()))
+	}))
+	defer proxy.Close()
+
+	client, err := NewHTTPClient(HTTPConfig{RequestTimeout: 5 * time.Second, Proxy: HTTPProxy{HTTPProxy: proxy.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("http://backend.3scale.example.com/transactions.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "proxied http://backend.3scale.example.com/transactions.xml" {
+		t.Errorf("response = %q, want it from the proxy", body)
+	}
+
+	for name, value := range map[string]string{"HTTP_PROXY": "http://env-proxy:3128", "HTTPS_PROXY": "http://env-proxy:3128", "NO_PROXY": "internal.example.com"} {
+		previous, ok := os.LookupEnv(name)
+		os.Setenv(name, value)
+		defer restoreEnv(name, previous, ok)
+	}
+
+	tests := []struct {
+		name      string
+		proxy     HTTPProxy
+		url       string
+		wantProxy string
+	}{
+		{name: "environment", url: "https://tenant-admin.3scale.net/", wantProxy: "http://env-proxy:3128"},
+		{name: "environment no proxy", url: "https://3scale.internal.example.com/", wantProxy: ""},
+		{name: "explicit", proxy: HTTPProxy{HTTPSProxy: "http://admin-proxy:8080"}, url: "https://tenant-admin.3scale.net/", wantProxy: "http://admin-proxy:8080"},
+		{name: "explicit scheme only", proxy: HTTPProxy{HTTPSProxy: "http://admin-proxy:8080"}, url: "http://tenant-admin.3scale.net/", wantProxy: "http://env-proxy:3128"},
+		{name: "explicit no proxy", proxy: HTTPProxy{NoProxy: "*"}, url: "https://tenant-admin.3scale.net/", wantProxy: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			proxyURL, err := tt.proxy.proxyFunc()(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if proxyURL != nil {
+				got = proxyURL.String()
+			}
+			if got != tt.wantProxy {
+				t.Errorf("proxy = %q, want %q", got, tt.wantProxy)
+			}
+		})
+	}
+}
+
+func restoreEnv(name, value string, ok bool) {
+	if ok {
+		os.Setenv(name, value)
+	} else {
+		os.Unsetenv(name)
+	}
+}
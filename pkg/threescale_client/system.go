@@ -0,0 +1,129 @@
+package threescale_client
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	sysC "github.com/3scale/3scale-porta-go-client/client"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+const (
+	// The control plane always exposes the production proxy configs.
+	latestProxyConfigPath = "/admin/api/services/%s/proxy/configs/production/latest.json"
+	methodsPath           = "/admin/api/services/%s/metrics/%s/methods.xml"
+)
+
+type methodList struct {
+	XMLName xml.Name `xml:"methods"`
+	Methods []struct {
+		SystemName string `xml:"system_name"`
+	} `xml:"method"`
+}
+
+// SystemClient retrieves the proxy configs from the Account Management API of the 3scale Admin portals.
+type SystemClient struct {
+	httpClient *http.Client
+}
+
+// NewSystemClient returns a SystemClient calling the Admin portals with httpClient.
+func NewSystemClient(httpClient *http.Client) *SystemClient {
+	return &SystemClient{httpClient: httpClient}
+}
+
+func (c *SystemClient) adminPortal(tenant Tenant) (*sysC.ThreeScaleClient, error) {
+	sysURL, err := url.ParseRequestURI(tenant.SystemURL)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme, host, port := parseURL(sysURL)
+	ap, err := sysC.NewAdminPortal(scheme, host, port)
+	if err != nil {
+		return nil, err
+	}
+	return sysC.NewThreeScale(ap, c.httpClient), nil
+}
+
+func (c *SystemClient) ListServices(tenant Tenant) ([]string, error) {
+	client, err := c.adminPortal(tenant)
+	if err != nil {
+		return nil, err
+	}
+	serviceList, err := client.ListServices(tenant.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(serviceList.Services))
+	for _, s := range serviceList.Services {
+		ids = append(ids, s.ID)
+	}
+	return ids, nil
+}
+
+// GetProxyConfig fetches the latest proxy config of a service. It's fetched as JSON rather than through
+// the 3scale client, which drops the parts it doesn't know about.
+func (c *SystemClient) GetProxyConfig(tenant Tenant, serviceID string) (ProxyConfig, error) {
+	data, err := c.get(tenant, fmt.Sprintf(latestProxyConfigPath, serviceID))
+	if err != nil {
+		return ProxyConfig{}, fmt.Errorf("failed to fetch the proxy config: %v", err)
+	}
+
+	proxyConf := ProxyConfig{Raw: data}
+	if err := json.Unmarshal(data, &proxyConf.ProxyConfigElement); err != nil {
+		return ProxyConfig{}, fmt.Errorf("invalid proxy config: %v", err)
+	}
+	return proxyConf, nil
+}
+
+// GetMetricHierarchy lists the metrics of a service and the methods of each one.
+func (c *SystemClient) GetMetricHierarchy(tenant Tenant, serviceID string) (map[string]string, error) {
+	client, err := c.adminPortal(tenant)
+	if err != nil {
+		return nil, err
+	}
+	metrics, err := client.ListMetrics(tenant.AccessToken, serviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	hierarchy := make(map[string]string)
+	for _, metric := range metrics.Metrics {
+		data, err := c.get(tenant, fmt.Sprintf(methodsPath, serviceID, metric.ID))
+		if err != nil {
+			return nil, fmt.Errorf("methods of metric %s: %v", metric.SystemName, err)
+		}
+		var methods methodList
+		if err := xml.Unmarshal(data, &methods); err != nil {
+			return nil, fmt.Errorf("methods of metric %s: %v", metric.SystemName, err)
+		}
+		for _, method := range methods.Methods {
+			hierarchy[method.SystemName] = metric.SystemName
+		}
+	}
+	return hierarchy, nil
+}
+
+// get calls an endpoint of the Account Management API, returning its response body.
+func (c *SystemClient) get(tenant Tenant, path string) ([]byte, error) {
+	u, err := url.Parse(tenant.SystemURL)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path
+	u.RawQuery = url.Values{"access_token": []string{tenant.AccessToken}}.Encode()
+
+	resp, err := c.httpClient.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
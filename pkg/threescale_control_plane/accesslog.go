@@ -0,0 +1,216 @@
+package threescale_control_plane
+
+import (
+	"3scale-envoy/pkg/threescale_authorizer"
+	"encoding/json"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	alsConfig "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v2"
+	accessLogFilter "github.com/envoyproxy/go-control-plane/envoy/config/filter/accesslog/v2"
+	accessLogData "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v2"
+	als "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/util"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	accessLogName = "3scale"
+
+	// pendingAccessLogTTL is how long the authorization of a request waits for its access log.
+	pendingAccessLogTTL = 5 * time.Minute
+	// maxPendingAccessLogs is the number of pending authorizations kept before the expired ones are removed.
+	maxPendingAccessLogs = 10000
+)
+
+// authorization is the outcome of the External AuthZ check of a request, waiting for its access log.
+type authorization struct {
+	serviceID string
+	app       string
+	usage     map[string]int
+	decision  string
+	expires   time.Time
+}
+
+// accessLogEntry is a structured access log, one JSON object per line.
+type accessLogEntry struct {
+	Time              time.Time      `json:"time"`
+	RequestID         string         `json:"request_id,omitempty"`
+	ServiceID         string         `json:"service_id,omitempty"`
+	AppID             string         `json:"app_id,omitempty"`
+	Metrics           map[string]int `json:"metrics,omitempty"`
+	Decision          string         `json:"decision,omitempty"`
+	Method            string         `json:"method"`
+	Authority         string         `json:"authority,omitempty"`
+	Path              string         `json:"path"`
+	Status            uint32         `json:"status"`
+	UpstreamCluster   string         `json:"upstream_cluster,omitempty"`
+	UpstreamLatencyMs float64        `json:"upstream_latency_ms,omitempty"`
+	DurationMs        float64        `json:"duration_ms,omitempty"`
+}
+
+// accessLogWriter writes the access logs of Envoy together with the authorization of each request.
+type accessLogWriter struct {
+	sync.Mutex
+	out     io.Writer
+	pending map[string]authorization
+}
+
+// newAccessLogWriter returns the writer of the configured output, or nil when the access logs are disabled.
+func newAccessLogWriter(conf AccessLogConfig) *accessLogWriter {
+	var out io.Writer
+	switch conf.Output {
+	case "":
+		return nil
+	case "stdout":
+		out = os.Stdout
+	default:
+		out = &lumberjack.Logger{
+			Filename:   conf.Output,
+			MaxSize:    conf.MaxSizeMB,
+			MaxBackups: conf.MaxBackups,
+			MaxAge:     conf.MaxAgeDays,
+		}
+	}
+	return &accessLogWriter{out: out, pending: make(map[string]authorization)}
+}
+
+// authorized keeps the authorization of a request until its access log is received.
+func (w *accessLogWriter) authorized(requestID, serviceID string, result threescale_authorizer.AuthRepResult) {
+	if w == nil || requestID == "" {
+		return
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	now := time.Now()
+	if len(w.pending) > maxPendingAccessLogs {
+		for id, a := range w.pending {
+			if now.After(a.expires) {
+				delete(w.pending, id)
+			}
+		}
+	}
+	w.pending[requestID] = authorization{
+		serviceID: serviceID,
+		app:       result.App,
+		usage:     result.Usage,
+		decision:  result.Decision.String(),
+		expires:   now.Add(pendingAccessLogTTL),
+	}
+}
+
+func (w *accessLogWriter) write(entry *accessLogData.HTTPAccessLogEntry, start time.Time) {
+	if w == nil {
+		return
+	}
+
+	e := accessLogEntry{
+		Time:      start,
+		RequestID: entry.Request.RequestId,
+		Method:    entry.Request.RequestMethod.String(),
+		Authority: entry.Request.Authority,
+		// The query string is left out, as it can hold the credentials of the application.
+		Path:   strings.SplitN(entry.Request.Path, "?", 2)[0],
+		Status: entry.Response.ResponseCode.Value,
+	}
+	if c := entry.CommonProperties; c != nil {
+		e.UpstreamCluster = c.UpstreamCluster
+		if c.TimeToLastUpstreamTxByte != nil && c.TimeToFirstUpstreamRxByte != nil {
+			e.UpstreamLatencyMs = milliseconds(*c.TimeToFirstUpstreamRxByte - *c.TimeToLastUpstreamTxByte)
+		}
+		if c.TimeToLastDownstreamTxByte != nil {
+			e.DurationMs = milliseconds(*c.TimeToLastDownstreamTxByte)
+		}
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	if a, ok := w.pending[e.RequestID]; ok {
+		delete(w.pending, e.RequestID)
+		e.ServiceID, e.AppID, e.Metrics, e.Decision = a.serviceID, a.app, a.usage, a.decision
+	}
+
+	if err := json.NewEncoder(w.out).Encode(e); err != nil {
+		log.Errorf("Failed to write the access log: %v", err)
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// AccessLogConfig configures the structured access logs written for the requests proxied by Envoy.
+type AccessLogConfig struct {
+	// Output is "stdout", a file path, or empty to disable the access logs.
+	Output string
+	// MaxSizeMB, MaxBackups and MaxAgeDays control the rotation of the access log files.
+	MaxSizeMB, MaxBackups, MaxAgeDays int
+}
+
+// accessLogService receives the access logs of Envoy, reporting the responses of the authorized requests
+// to 3scale and writing them as structured logs.
+type accessLogService struct {
+	reporter *threescale_authorizer.Reporter
+	writer   *accessLogWriter
+}
+
+func (a *accessLogService) StreamAccessLogs(stream als.AccessLogService_StreamAccessLogsServer) error {
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&als.StreamAccessLogsResponse{})
+		}
+		if err != nil {
+			return err
+		}
+
+		httpLogs := msg.GetHttpLogs()
+		if httpLogs == nil {
+			continue
+		}
+		for _, entry := range httpLogs.LogEntry {
+			if entry.Request == nil || entry.Response == nil || entry.Response.ResponseCode == nil {
+				continue
+			}
+
+			start := time.Now()
+			if entry.CommonProperties != nil && entry.CommonProperties.StartTime != nil {
+				start = *entry.CommonProperties.StartTime
+			}
+			a.reporter.Completed(entry.Request.RequestId, start, entry.Request.RequestMethod.String(),
+				entry.Request.Path, int(entry.Response.ResponseCode.Value))
+			a.writer.write(entry, start)
+		}
+	}
+}
+
+// newAccessLog returns the access log of the HTTP connection manager, streamed to the access log service
+// of the External AuthZ cluster.
+func newAccessLog() (*accessLogFilter.AccessLog, error) {
+	alsConf, err := util.MessageToStruct(&alsConfig.HttpGrpcAccessLogConfig{
+		CommonConfig: &alsConfig.CommonGrpcAccessLogConfig{
+			LogName: accessLogName,
+			GrpcService: &core.GrpcService{
+				TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &core.GrpcService_EnvoyGrpc{
+						ClusterName: "extauthz",
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &accessLogFilter.AccessLog{
+		Name:       util.HTTPGRPCAccessLog,
+		ConfigType: &accessLogFilter.AccessLog_Config{Config: alsConf},
+	}, nil
+}
@@ -0,0 +1,272 @@
+package threescale_control_plane
+
+import (
+	"3scale-envoy/pkg/logging"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/gogo/protobuf/jsonpb"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// AdminAPIConfig sets the port and the bearer token of the admin API. The API is disabled without a token.
+type AdminAPIConfig struct {
+	Port  uint
+	Token string
+}
+
+func (a AdminAPIConfig) enabled() bool {
+	return a.Token != ""
+}
+
+type serviceStatus struct {
+	Tenant             string `json:"tenant"`
+	ServiceID          string `json:"service_id"`
+	Name               string `json:"name"`
+	ProxyConfigVersion int    `json:"proxy_config_version"`
+}
+
+type resourcesStatus struct {
+	Version string                     `json:"version"`
+	Items   map[string]json.RawMessage `json:"items"`
+}
+
+// snapshotResourceTypes names the resource types of a snapshot in the admin API.
+var snapshotResourceTypes = map[string]string{
+	"endpoints": cache.EndpointType,
+	"clusters":  cache.ClusterType,
+	"routes":    cache.RouteType,
+	"listeners": cache.ListenerType,
+}
+
+// RunAdminAPI starts the admin REST API, used to inspect and control the control plane:
+//
+//	GET  /api/services                                  configured services and their proxy config versions
+//	POST /api/tenants/{tenant}/services/{id}/refresh    fetch the latest proxy config of a service
+//	POST /api/cache/flush                               drop every cached proxy config
+//	GET  /api/nodes                                     Envoy nodes and the versions they acked or rejected
+//	GET  /api/nodes/{id}/snapshot                       snapshot of a node, as JSON
+//	GET  /api/bootstrap                                 Envoy bootstrap of a node, as YAML or JSON
+func (ec *ControlPlane) RunAdminAPI(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/services", ec.handleServices)
+	mux.HandleFunc("/api/tenants/", ec.handleRefreshService)
+	mux.HandleFunc("/api/cache/flush", ec.handleFlushCache)
+	mux.HandleFunc("/api/nodes", ec.handleNodes)
+	mux.HandleFunc("/api/nodes/", ec.handleSnapshot)
+	mux.HandleFunc("/api/bootstrap", ec.handleBootstrap)
+
+	log.Infof("Starting Admin API on Port %d", ec.AdminAPI.Port)
+	server := &http.Server{Addr: fmt.Sprintf(":%d", ec.AdminAPI.Port), Handler: ec.AdminAPI.authorize(mux)}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Admin API stopped: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	if err := server.Shutdown(context.Background()); err != nil {
+		log.Error(err)
+	}
+}
+
+// authorize rejects the requests without the bearer token of the admin API.
+func (a AdminAPIConfig) authorize(next http.Handler) http.Handler {
+	expected := []byte("Bearer " + a.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="3scale-envoy"`)
+			writeError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (ec *ControlPlane) handleServices(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	ec.mu.Lock()
+	services := []serviceStatus{}
+	for _, tenant := range ec.Tenants {
+		for id, resources := range tenant.resources {
+			services = append(services, serviceStatus{
+				Tenant:             tenant.Name,
+				ServiceID:          id,
+				Name:               tenant.resourceName(id),
+				ProxyConfigVersion: resources.version,
+			})
+		}
+	}
+	ec.mu.Unlock()
+
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	writeJSON(w, http.StatusOK, services)
+}
+
+func (ec *ControlPlane) handleRefreshService(w http.ResponseWriter, r *http.Request) {
+	// /api/tenants/{tenant}/services/{id}/refresh
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/tenants/"), "/")
+	if len(parts) != 4 || parts[1] != "services" || parts[3] != "refresh" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	tenantName, serviceID := parts[0], parts[2]
+
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	var tenant *ThreescaleConfig
+	for _, t := range ec.Tenants {
+		if t.Name == tenantName {
+			tenant = t
+		}
+	}
+	if tenant == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown tenant %s", tenantName))
+		return
+	}
+
+	ec.proxyCache.Invalidate(tenant.threescaleTenant(), serviceID)
+	changed, err := tenant.RefreshService(ec.proxyCache, serviceID)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, logging.Redact(err.Error()))
+		return
+	}
+	if changed {
+		if err := ec.publishSnapshot(); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	resources := tenant.resources[serviceID]
+	writeJSON(w, http.StatusOK, serviceStatus{
+		Tenant:             tenant.Name,
+		ServiceID:          serviceID,
+		Name:               tenant.resourceName(serviceID),
+		ProxyConfigVersion: resources.version,
+	})
+}
+
+// handleFlushCache empties the proxy config cache, so the authorizer and the next refresh fetch every
+// proxy config again.
+func (ec *ControlPlane) handleFlushCache(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	ec.proxyCache.Flush()
+	log.Info("Flushed the proxy config cache")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ec *ControlPlane) handleNodes(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, ec.callbacks.nodeStatuses())
+}
+
+func (ec *ControlPlane) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	// /api/nodes/{id}/snapshot
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/nodes/"), "/")
+	if len(parts) != 2 || parts[1] != "snapshot" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	snapshot, err := config.GetSnapshot(parts[0])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	body := make(map[string]resourcesStatus, len(snapshotResourceTypes))
+	marshaler := &jsonpb.Marshaler{OrigName: true}
+	for name, typ := range snapshotResourceTypes {
+		resources := resourcesStatus{Version: snapshot.GetVersion(typ), Items: make(map[string]json.RawMessage)}
+		for resourceName, resource := range snapshot.GetResources(typ) {
+			var b bytes.Buffer
+			if err := marshaler.Marshal(&b, resource); err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			// The External AuthZ context extensions hold the access tokens of the tenants.
+			resources.Items[resourceName] = json.RawMessage(logging.Redact(b.String()))
+		}
+		body[name] = resources
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+// handleBootstrap writes the bootstrap of the node given by the node_id and cluster query parameters,
+// as YAML unless format=json. Any node ID is accepted: every node gets the same configuration.
+func (ec *ControlPlane) handleBootstrap(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	query := r.URL.Query()
+	node, cluster, format := query.Get("node_id"), query.Get("cluster"), query.Get("format")
+	if node == "" {
+		node = DefaultNodeID
+	}
+	if cluster == "" {
+		cluster = DefaultNodeCluster
+	}
+	contentType := "application/yaml"
+	switch format {
+	case "", "yaml":
+		format = "yaml"
+	case "json":
+		contentType = "application/json"
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown format %q", format))
+		return
+	}
+
+	var b bytes.Buffer
+	if err := ec.WriteBootstrap(&b, format, node, cluster); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if _, err := b.WriteTo(w); err != nil {
+		log.Errorf("Failed to write the Admin API response: %v", err)
+	}
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Failed to write the Admin API response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,230 @@
+package threescale_control_plane
+
+import (
+	"fmt"
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	bootstrap "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v2"
+	metrics "github.com/envoyproxy/go-control-plane/envoy/config/metrics/v2"
+	trace "github.com/envoyproxy/go-control-plane/envoy/config/trace/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/util"
+	"github.com/gogo/protobuf/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultNodeID is the ID of the Envoy node the configuration is generated for.
+	DefaultNodeID = nodeID
+	// DefaultNodeCluster is the cluster of the Envoy nodes in the generated bootstraps.
+	DefaultNodeCluster = "3scale-envoy"
+	// DefaultEnvoyAdminPort is the port of the Envoy admin interface in the generated bootstraps.
+	DefaultEnvoyAdminPort = 19000
+
+	xdsClusterName    = "xds_cluster"
+	zipkinClusterName = "zipkin"
+	bootstrapTimeout  = time.Second
+)
+
+// BootstrapConfig sets the admin interface and the stats sinks of the generated Envoy bootstraps.
+type BootstrapConfig struct {
+	// AdminPort is the port of the Envoy admin interface, DefaultEnvoyAdminPort when 0.
+	AdminPort uint
+	// StatsdAddresses are the "ip:port" UDP addresses of the statsd servers Envoy flushes its stats to.
+	StatsdAddresses []string
+}
+
+// XDSTLSConfig enables TLS on the xDS server when CertFile is set. The generated bootstraps verify the
+// certificate of the control plane against CAFile, a path on the Envoy host.
+type XDSTLSConfig struct {
+	CertFile, KeyFile string
+	// CAFile is the trusted CA bundle, DefaultUpstreamCAFile when empty.
+	CAFile string
+}
+
+func (t XDSTLSConfig) enabled() bool {
+	return t.CertFile != ""
+}
+
+func (t XDSTLSConfig) serverOptions() ([]grpc.ServerOption, error) {
+	if !t.enabled() {
+		return nil, nil
+	}
+	creds, err := credentials.NewServerTLSFromFile(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid xDS TLS certificate: %v", err)
+	}
+	return []grpc.ServerOption{grpc.Creds(creds)}, nil
+}
+
+// NewBootstrap returns the bootstrap of an Envoy node fetching its configuration from the control
+// plane through ADS.
+func (ec *ControlPlane) NewBootstrap(node, cluster string) (*bootstrap.Bootstrap, error) {
+	b, err := ec.newBootstrapBase(node, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	xdsCluster := newStrictDNSCluster(xdsClusterName, ec.Host, uint32(ec.XDSport))
+	xdsCluster.Http2ProtocolOptions = &core.Http2ProtocolOptions{}
+	if ec.XDSTLS.enabled() {
+		xdsCluster.TlsContext = (&TLSConfig{CAFile: ec.XDSTLS.CAFile}).upstreamTLSContext(ec.Host)
+	}
+	b.StaticResources.Clusters = append([]v2.Cluster{xdsCluster}, b.StaticResources.Clusters...)
+
+	ads := &core.ConfigSource{
+		ConfigSourceSpecifier: &core.ConfigSource_Ads{
+			Ads: &core.AggregatedConfigSource{},
+		},
+	}
+	b.DynamicResources = &bootstrap.Bootstrap_DynamicResources{
+		AdsConfig: &core.ApiConfigSource{
+			ApiType: core.ApiConfigSource_GRPC,
+			GrpcServices: []*core.GrpcService{{
+				TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: xdsClusterName},
+				},
+			}},
+		},
+		CdsConfig: ads,
+		LdsConfig: ads,
+	}
+
+	if err := b.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid Envoy bootstrap: %v", err)
+	}
+	return b, nil
+}
+
+// WriteBootstrap writes the bootstrap of an Envoy node as "yaml" or "json".
+func (ec *ControlPlane) WriteBootstrap(w io.Writer, format, node, cluster string) error {
+	b, err := ec.NewBootstrap(node, cluster)
+	if err != nil {
+		return err
+	}
+	// The bootstrap of a node holds no credentials.
+	document, err := messageDocument(b, true)
+	if err != nil {
+		return err
+	}
+	return writeDocument(w, format, document)
+}
+
+// newBootstrapBase returns a bootstrap identifying an Envoy node, with its admin interface, its stats
+// sinks and, when tracing is enabled, the Zipkin tracer sending the spans to the collector.
+func (ec *ControlPlane) newBootstrapBase(node, cluster string) (*bootstrap.Bootstrap, error) {
+	adminPort := ec.Bootstrap.AdminPort
+	if adminPort == 0 {
+		adminPort = DefaultEnvoyAdminPort
+	}
+
+	b := &bootstrap.Bootstrap{
+		Node: &core.Node{Id: node, Cluster: cluster},
+		Admin: &bootstrap.Admin{
+			AccessLogPath: "/dev/null",
+			Address:       newSocketAddress("0.0.0.0", uint32(adminPort)),
+		},
+		StaticResources: &bootstrap.Bootstrap_StaticResources{},
+	}
+
+	for _, address := range ec.Bootstrap.StatsdAddresses {
+		sink, err := newStatsdSink(address)
+		if err != nil {
+			return nil, err
+		}
+		b.StatsSinks = append(b.StatsSinks, sink)
+	}
+
+	if ec.Tracing.enabled() {
+		zipkinCluster, tracing, err := newZipkinTracer(ec.Tracing.CollectorURL)
+		if err != nil {
+			return nil, err
+		}
+		b.StaticResources.Clusters = append(b.StaticResources.Clusters, zipkinCluster)
+		b.Tracing = tracing
+	}
+	return b, nil
+}
+
+func newStatsdSink(address string) (*metrics.StatsSink, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("invalid statsd address %q, an \"ip:port\" address is required", address)
+	}
+	portValue, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid statsd address %q: %v", address, err)
+	}
+
+	statsdAddress := newSocketAddress(host, uint32(portValue))
+	statsdAddress.GetSocketAddress().Protocol = core.UDP
+	config, err := util.MessageToStruct(&metrics.StatsdSink{
+		StatsdSpecifier: &metrics.StatsdSink_Address{Address: statsdAddress},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &metrics.StatsSink{
+		Name:       "envoy.statsd",
+		ConfigType: &metrics.StatsSink_Config{Config: config},
+	}, nil
+}
+
+// newZipkinTracer returns the cluster of a Zipkin v2 collector and the tracer sending the spans to it.
+func newZipkinTracer(collectorURL string) (v2.Cluster, *trace.Tracing, error) {
+	u, err := url.Parse(collectorURL)
+	if err != nil || u.Hostname() == "" {
+		return v2.Cluster{}, nil, fmt.Errorf("invalid tracing collector URL %q", collectorURL)
+	}
+
+	cluster := newStrictDNSCluster(zipkinClusterName, u.Hostname(), backendPort(u))
+	if u.Scheme == "https" {
+		cluster.TlsContext = (&TLSConfig{}).upstreamTLSContext(u.Hostname())
+	}
+
+	config, err := util.MessageToStruct(&trace.ZipkinConfig{
+		CollectorCluster:  zipkinClusterName,
+		CollectorEndpoint: u.Path,
+	})
+	if err != nil {
+		return v2.Cluster{}, nil, err
+	}
+	// The collector endpoint version is missing from the protos vendored here, and Envoy defaults to
+	// the v1 JSON format.
+	config.Fields["collector_endpoint_version"] = &types.Value{Kind: &types.Value_StringValue{StringValue: "HTTP_JSON"}}
+
+	return cluster, &trace.Tracing{
+		Http: &trace.Tracing_Http{
+			Name:       "envoy.zipkin",
+			ConfigType: &trace.Tracing_Http_Config{Config: config},
+		},
+	}, nil
+}
+
+func newStrictDNSCluster(name, host string, port uint32) v2.Cluster {
+	return v2.Cluster{
+		Name: name,
+		ClusterDiscoveryType: &v2.Cluster_Type{
+			Type: v2.Cluster_STRICT_DNS,
+		},
+		ConnectTimeout: bootstrapTimeout,
+		LoadAssignment: newLoadAssignment(name, []string{host}, port),
+	}
+}
+
+func newSocketAddress(address string, port uint32) *core.Address {
+	return &core.Address{
+		Address: &core.Address_SocketAddress{
+			SocketAddress: &core.SocketAddress{
+				Protocol:      core.TCP,
+				Address:       address,
+				PortSpecifier: &core.SocketAddress_PortValue{PortValue: port},
+			},
+		},
+	}
+}
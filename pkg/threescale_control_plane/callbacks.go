@@ -3,47 +3,231 @@ package threescale_control_plane
 import (
 	"context"
 	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"sort"
 	"sync"
+	"time"
 )
 
 type callbacks struct {
-	signal        chan struct{}
 	fetches       int
 	requests      int
 	mu            sync.Mutex
 	callbackError bool
+
+	// streams maps each open xDS stream to the ID of its node.
+	streams map[int64]string
+	// sent holds the last response sent on each stream, by type URL, to find the versions Envoy rejects.
+	sent  map[int64]map[string]sentResponse
+	nodes map[string]*nodeStatus
+
+	// onAck and onNack are called, in their own goroutine, when a node accepts or rejects a response,
+	// onNode when a node opens a stream, and onNodeGone when the last stream of a node is closed.
+	onAck      func(node string)
+	onNack     func(node, typeURL string)
+	onNode     func(node string)
+	onNodeGone func(node string)
 }
 
-func (cb *callbacks) Report() {
-	cb.mu.Lock()
-	defer cb.mu.Unlock()
+type sentResponse struct {
+	nonce, version string
 }
+
+// nodeStatus is the state of the configuration of an Envoy node, as reported by its discovery requests.
+type nodeStatus struct {
+	ID       string                 `json:"id"`
+	Cluster  string                 `json:"cluster"`
+	Streams  int                    `json:"streams"`
+	LastSeen time.Time              `json:"last_seen"`
+	Types    map[string]*typeStatus `json:"types"`
+}
+
+// typeStatus is the state of a resource type of a node. Envoy acknowledges a version by requesting the
+// next one, and rejects (NACKs) it by sending the error together with the last accepted version.
+type typeStatus struct {
+	SentVersion   string `json:"sent_version"`
+	AckedVersion  string `json:"acked_version"`
+	NackedVersion string `json:"nacked_version,omitempty"`
+	NackError     string `json:"nack_error,omitempty"`
+	// Rejected is true while the last response sent has been rejected.
+	Rejected bool `json:"rejected"`
+}
+
 func (cb *callbacks) OnStreamOpen(_ context.Context, id int64, typ string) error {
 	return nil
 }
 func (cb *callbacks) OnStreamClosed(id int64) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if node, ok := cb.streams[id]; ok {
+		delete(cb.streams, id)
+		if cb.nodes[node].Streams--; cb.nodes[node].Streams == 0 {
+			delete(cb.nodes, node)
+			if cb.onNodeGone != nil {
+				go cb.onNodeGone(node)
+			}
+		}
+	}
+	delete(cb.sent, id)
 }
-func (cb *callbacks) OnStreamRequest(int64, *v2.DiscoveryRequest) error {
+func (cb *callbacks) OnStreamRequest(id int64, req *v2.DiscoveryRequest) error {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 	cb.requests++
-	if cb.signal != nil {
-		close(cb.signal)
-		cb.signal = nil
+
+	// Envoy only identifies its node in the first request of a stream.
+	node, ok := cb.streams[id]
+	if !ok && req.Node != nil && req.Node.Id != "" {
+		node = req.Node.Id
+		if cb.streams == nil {
+			cb.streams = make(map[int64]string)
+		}
+		cb.streams[id] = node
+		cb.nodeStatus(node).Streams++
+		if cb.onNode != nil {
+			go cb.onNode(node)
+		}
+	}
+	if node != "" {
+		cb.recordRequest(node, req, cb.sent[id][req.TypeUrl])
 	}
 	return nil
 }
-func (cb *callbacks) OnStreamResponse(int64, *v2.DiscoveryRequest, *v2.DiscoveryResponse) {
-	cb.Report()
+func (cb *callbacks) OnStreamResponse(id int64, _ *v2.DiscoveryRequest, resp *v2.DiscoveryResponse) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	node, ok := cb.streams[id]
+	if !ok {
+		return
+	}
+	if cb.sent == nil {
+		cb.sent = make(map[int64]map[string]sentResponse)
+	}
+	if cb.sent[id] == nil {
+		cb.sent[id] = make(map[string]sentResponse)
+	}
+	cb.sent[id][resp.TypeUrl] = sentResponse{nonce: resp.Nonce, version: resp.VersionInfo}
+
+	cb.typeStatus(node, resp.TypeUrl).SentVersion = resp.VersionInfo
+	xdsResponses.WithLabelValues(node, resp.TypeUrl).Inc()
 }
 func (cb *callbacks) OnFetchRequest(_ context.Context, req *v2.DiscoveryRequest) error {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 	cb.fetches++
-	if cb.signal != nil {
-		close(cb.signal)
-		cb.signal = nil
+	// Fetches have no stream whose closing would drop the status, only the nodes streaming are tracked.
+	if req.Node != nil && cb.connectedLocked(req.Node.Id) {
+		cb.recordRequest(req.Node.Id, req, sentResponse{})
 	}
 	return nil
 }
 func (cb *callbacks) OnFetchResponse(*v2.DiscoveryRequest, *v2.DiscoveryResponse) {}
+
+// nodeStatus returns the status of a node, created on its first request. It must be called with the lock held.
+func (cb *callbacks) nodeStatus(node string) *nodeStatus {
+	if cb.nodes == nil {
+		cb.nodes = make(map[string]*nodeStatus)
+	}
+	status, ok := cb.nodes[node]
+	if !ok {
+		status = &nodeStatus{ID: node, Types: make(map[string]*typeStatus)}
+		cb.nodes[node] = status
+	}
+	return status
+}
+
+// typeStatus returns the status of a resource type of a node. It must be called with the lock held.
+func (cb *callbacks) typeStatus(node, typeURL string) *typeStatus {
+	status := cb.nodeStatus(node)
+	typ, ok := status.Types[typeURL]
+	if !ok {
+		typ = &typeStatus{}
+		status.Types[typeURL] = typ
+	}
+	return typ
+}
+
+// recordRequest updates the status of the node sending a discovery request, given the last response
+// sent on its stream. It must be called with the lock held.
+func (cb *callbacks) recordRequest(node string, req *v2.DiscoveryRequest, sent sentResponse) {
+	status := cb.nodeStatus(node)
+	if req.Node != nil && req.Node.Cluster != "" {
+		status.Cluster = req.Node.Cluster
+	}
+	status.LastSeen = time.Now()
+
+	typ := cb.typeStatus(node, req.TypeUrl)
+	entry := log.WithField("node", node).WithField("type_url", req.TypeUrl)
+	switch {
+	case req.ErrorDetail != nil:
+		typ.NackedVersion = ""
+		if sent.nonce == req.ResponseNonce {
+			typ.NackedVersion = sent.version
+		}
+		typ.NackError = req.ErrorDetail.Message
+		typ.Rejected = true
+		xdsNacks.WithLabelValues(node, req.TypeUrl).Inc()
+		xdsRejected.WithLabelValues(node, req.TypeUrl).Set(1)
+		entry.WithField("version", typ.NackedVersion).WithField("acked_version", req.VersionInfo).
+			Errorf("Envoy rejected the configuration: %s", req.ErrorDetail.Message)
+		if cb.onNack != nil {
+			go cb.onNack(node, req.TypeUrl)
+		}
+	case req.ResponseNonce != "":
+		typ.AckedVersion = req.VersionInfo
+		typ.Rejected = false
+		xdsAcks.WithLabelValues(node, req.TypeUrl).Inc()
+		xdsRejected.WithLabelValues(node, req.TypeUrl).Set(0)
+		entry.WithField("version", req.VersionInfo).Debug("Envoy accepted the configuration")
+		if cb.onAck != nil {
+			go cb.onAck(node)
+		}
+	case req.VersionInfo != "":
+		// The first request of a stream carries the version Envoy already applied, like after a reconnection.
+		typ.AckedVersion = req.VersionInfo
+	}
+}
+
+// ackedVersion returns the last version of a resource type accepted by a node.
+func (cb *callbacks) ackedVersion(node, typeURL string) string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if status, ok := cb.nodes[node]; ok {
+		if typ, ok := status.Types[typeURL]; ok {
+			return typ.AckedVersion
+		}
+	}
+	return ""
+}
+
+// connected reports whether a node has any open stream.
+func (cb *callbacks) connected(node string) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.connectedLocked(node)
+}
+
+// connectedLocked reports whether a node has any open stream. It must be called with the lock held.
+func (cb *callbacks) connectedLocked(node string) bool {
+	status, ok := cb.nodes[node]
+	return ok && status.Streams > 0
+}
+
+// nodeStatuses returns a copy of the status of every node seen, ordered by node ID.
+func (cb *callbacks) nodeStatuses() []nodeStatus {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	statuses := make([]nodeStatus, 0, len(cb.nodes))
+	for _, status := range cb.nodes {
+		s := *status
+		s.Types = make(map[string]*typeStatus, len(status.Types))
+		for typ, t := range status.Types {
+			copied := *t
+			s.Types[typ] = &copied
+		}
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
@@ -0,0 +1,102 @@
+package threescale_control_plane
+
+import (
+	"context"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"testing"
+)
+
+// nodeSeries counts the series of a node in the registered metrics.
+func nodeSeries(t *testing.T, node string) int {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "node" && label.GetValue() == node {
+					count++
+				}
+			}
+		}
+	}
+	return count
+}
+
+func TestNodeDisconnected(t *testing.T) {
+	config = cache.NewSnapshotCache(true, Hasher{}, nil)
+	if err := config.SetSnapshot(nodeID, cache.NewSnapshot("1", nil, nil, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	cb := &callbacks{}
+	ec := &ControlPlane{callbacks: cb, history: newSnapshotHistory(), RollbackOnNack: true}
+
+	// Two streams of the same node, the snapshot is dropped with the last one.
+	for _, id := range []int64{1, 2} {
+		cb.OnStreamOpen(context.Background(), id, cache.AnyType)
+		cb.OnStreamRequest(id, &v2.DiscoveryRequest{Node: &core.Node{Id: "gateway-1"}, TypeUrl: cache.ClusterType})
+	}
+	ec.nodeConnected("gateway-1")
+	if _, err := config.GetSnapshot("gateway-1"); err != nil {
+		t.Fatalf("no snapshot for the connected node: %v", err)
+	}
+	cb.OnStreamResponse(1, nil, &v2.DiscoveryResponse{TypeUrl: cache.ClusterType, VersionInfo: "1", Nonce: "1"})
+	cb.OnStreamRequest(1, &v2.DiscoveryRequest{TypeUrl: cache.ClusterType, VersionInfo: "1", ResponseNonce: "1"})
+	ec.nodeRejected("gateway-1", cache.ListenerType)
+	if series := nodeSeries(t, "gateway-1"); series == 0 {
+		t.Fatal("no metrics for the connected node")
+	}
+
+	cb.OnStreamClosed(1)
+	ec.nodeDisconnected("gateway-1")
+	if _, err := config.GetSnapshot("gateway-1"); err != nil {
+		t.Fatalf("snapshot dropped while the node has a stream: %v", err)
+	}
+
+	cb.OnStreamClosed(2)
+	ec.nodeDisconnected("gateway-1")
+	if _, err := config.GetSnapshot("gateway-1"); err == nil {
+		t.Error("snapshot kept after the last stream was closed")
+	}
+	if statuses := cb.nodeStatuses(); len(statuses) != 0 {
+		t.Errorf("statuses = %v, want none", statuses)
+	}
+	if series := nodeSeries(t, "gateway-1"); series != 0 {
+		t.Errorf("%d metric series kept for the gone node", series)
+	}
+	if _, err := config.GetSnapshot(nodeID); err != nil {
+		t.Errorf("default snapshot dropped: %v", err)
+	}
+}
+
+func TestFetchRequest(t *testing.T) {
+	cb := &callbacks{}
+
+	// A node only fetching its configuration has no stream whose closing would forget it.
+	cb.OnFetchRequest(context.Background(), &v2.DiscoveryRequest{Node: &core.Node{Id: "fetcher"}, TypeUrl: cache.ClusterType, VersionInfo: "1", ResponseNonce: "1"})
+	if statuses := cb.nodeStatuses(); len(statuses) != 0 {
+		t.Errorf("statuses = %v, want none for a fetch-only node", statuses)
+	}
+	if series := nodeSeries(t, "fetcher"); series != 0 {
+		t.Errorf("%d metric series for a fetch-only node", series)
+	}
+	if cb.fetches != 1 {
+		t.Errorf("fetches = %d, want 1", cb.fetches)
+	}
+
+	// The fetches of a streaming node still update its status.
+	cb.OnStreamRequest(1, &v2.DiscoveryRequest{Node: &core.Node{Id: "gateway-1"}, TypeUrl: cache.ClusterType})
+	cb.OnFetchRequest(context.Background(), &v2.DiscoveryRequest{Node: &core.Node{Id: "gateway-1"}, TypeUrl: cache.RouteType, VersionInfo: "2"})
+	if version := cb.ackedVersion("gateway-1", cache.RouteType); version != "2" {
+		t.Errorf("acked version = %q, want 2", version)
+	}
+	cb.OnStreamClosed(1)
+	if statuses := cb.nodeStatuses(); len(statuses) != 0 {
+		t.Errorf("statuses = %v, want none", statuses)
+	}
+}
@@ -1,392 +1,410 @@
 package threescale_control_plane
 
 import (
+	"3scale-envoy/pkg/threescale_client"
+	"encoding/json"
+	"errors"
 	"fmt"
-	conf "github.com/3scale/3scale-istio-adapter/config"
-	"github.com/3scale/3scale-istio-adapter/pkg/threescale"
 	sysC "github.com/3scale/3scale-porta-go-client/client"
 	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
-	"github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
-	"github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
-	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
 	extAuthService "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/ext_authz/v2"
 	"github.com/envoyproxy/go-control-plane/pkg/cache"
 	"github.com/envoyproxy/go-control-plane/pkg/util"
 	"github.com/gogo/protobuf/types"
-	"net"
-	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
-
-	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
 )
 
+// ThreescaleConfig holds the settings of a single 3scale tenant and the Envoy resources
+// generated from the services selected in it.
 type ThreescaleConfig struct {
-	AccessToken    string
-	SystemURL      string
-	ServiceID      string
-	Environment    string
-	CurrentVersion int
+	Name        string          `json:"name"`
+	AccessToken string          `json:"access_token"`
+	SystemURL   string          `json:"system_url"`
+	Services    []ServiceConfig `json:"services"`
+	Environment string          `json:"environment"`
+
+	resources map[string]serviceResources
+}
+
+// ServiceConfig selects a 3scale service to be exposed through Envoy.
+type ServiceConfig struct {
+	ID               string                  `json:"id"`
+	Endpoints        EndpointsConfig         `json:"endpoints"`
+	HealthCheck      *HealthCheckConfig      `json:"health_check"`
+	OutlierDetection *OutlierDetectionConfig `json:"outlier_detection"`
+	CircuitBreakers  *CircuitBreakersConfig  `json:"circuit_breakers"`
+	TLS              *TLSConfig              `json:"tls"`
+	RateLimits       []RateLimitConfig       `json:"rate_limits"`
+}
+
+// serviceResources are the Envoy resources generated from the proxy config of a service.
+type serviceResources struct {
+	version     int
+	clusters    []cache.Resource
+	endpoints   []cache.Resource
+	upstreams   []upstream
+	virtualHost route.VirtualHost
+}
+
+// upstream is an API backend reached through one of the clusters of a service.
+type upstream struct {
+	clusterName string
+	url         *url.URL
+}
+
+// threescaleTenant returns the Admin portal of the tenant and its access token.
+func (c *ThreescaleConfig) threescaleTenant() threescale_client.Tenant {
+	return threescale_client.Tenant{SystemURL: c.SystemURL, AccessToken: c.AccessToken}
 }
 
-func (c *ThreescaleConfig) newSystemClient() (*sysC.ThreeScaleClient, error) {
-	sysURL, err := url.ParseRequestURI(c.SystemURL)
+// GetConfig refreshes the Envoy resources of every selected service of the tenant, and reports
+// whether any of them changed. Services that fail to refresh keep their previous resources, and
+// their errors are returned together once all the other services have been processed.
+func (c *ThreescaleConfig) GetConfig(source threescale_client.ProxyConfigSource) (bool, error) {
+	services, err := c.selectedServices(source)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	scheme, host, port := c.parseURL(sysURL)
-	ap, err := sysC.NewAdminPortal(scheme, host, port)
-	if err != nil {
-		return nil, err
+	if c.resources == nil {
+		c.resources = make(map[string]serviceResources)
+	}
+
+	var changed bool
+	var failures []string
+	selected := make(map[string]bool, len(services))
+	for _, service := range services {
+		selected[service.ID] = true
+		serviceChanged, err := c.refreshService(source, service, false)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("service %s: %v", service.ID, err))
+			continue
+		}
+		changed = changed || serviceChanged
 	}
 
-	return sysC.NewThreeScale(ap, &http.Client{}), nil
+	// Drop the services that are not selected anymore.
+	for id := range c.resources {
+		if !selected[id] {
+			delete(c.resources, id)
+			changed = true
+		}
+	}
+
+	if len(failures) > 0 {
+		return changed, errors.New(strings.Join(failures, "; "))
+	}
+	return changed, nil
 }
-func (c *ThreescaleConfig) GetConfig(config threescale.ProxyConfigCache, version int32, AuthPort, PublicPort uint, Host string) (cache.Snapshot, int32) {
 
-	// Generate the External AuthZ Cluster for envoy
-	var clusterCache []cache.Resource
-	var newVersion int32
-	clusterCache = c.generateAuthZCluster(clusterCache, AuthPort, Host)
+// selectedServices returns the configured services, or every service of the tenant if none is configured.
+func (c *ThreescaleConfig) selectedServices(source threescale_client.ProxyConfigSource) ([]ServiceConfig, error) {
+	if len(c.Services) > 0 {
+		return c.Services, nil
+	}
 
-	systemClient, err := c.newSystemClient()
+	ids, err := source.ListServices(c.threescaleTenant())
 	if err != nil {
-		return cache.Snapshot{}, version
+		return nil, err
 	}
 
-	proxyConf, err := config.Get(&conf.Params{
-		ServiceId:   c.ServiceID,
-		SystemUrl:   c.SystemURL,
-		AccessToken: c.AccessToken,
-	}, systemClient)
+	services := make([]ServiceConfig, 0, len(ids))
+	for _, id := range ids {
+		services = append(services, ServiceConfig{ID: id})
+	}
+	return services, nil
+}
 
+func (c *ThreescaleConfig) refreshService(source threescale_client.ProxyConfigSource, service ServiceConfig, force bool) (bool, error) {
+	proxyConf, err := source.GetProxyConfig(c.threescaleTenant(), service.ID)
 	if err != nil {
-		return cache.Snapshot{}, version
+		return false, err
 	}
+	return c.updateService(service, proxyConf, force)
+}
 
-	if c.CurrentVersion == proxyConf.ProxyConfig.Version {
-		return cache.Snapshot{}, version
+// RefreshService gets the proxy config of a selected service and regenerates its resources, even when its
+// version didn't change. It reports whether the resources changed.
+func (c *ThreescaleConfig) RefreshService(source threescale_client.ProxyConfigSource, serviceID string) (bool, error) {
+	services, err := c.selectedServices(source)
+	if err != nil {
+		return false, err
 	}
+	for _, service := range services {
+		if service.ID != serviceID {
+			continue
+		}
 
-	apiBackend := proxyConf.ProxyConfig.Content.Proxy.APIBackend
-	proxyEndpoint := proxyConf.ProxyConfig.Content.Proxy.Endpoint
-	// Generate the Service Cluster for envoy
-	clusterCache = c.generateServiceCluster(clusterCache, apiBackend)
-
-	//
-	// Generate the Route for the service.
-	//
-	contextExtensions := map[string]string{"service_id": c.ServiceID, "system_url": c.SystemURL, "access_token": c.AccessToken}
+		if c.resources == nil {
+			c.resources = make(map[string]serviceResources)
+		}
+		return c.refreshService(source, service, true)
+	}
+	return false, fmt.Errorf("service %s is not selected in tenant %s", serviceID, c.Name)
+}
 
-	checkSettings := extAuthService.ExtAuthzPerRoute_CheckSettings{CheckSettings: &extAuthService.CheckSettings{ContextExtensions: contextExtensions}}
+// updateService regenerates the resources of a service when its proxy config version changed, or
+// when forced, and resolves its endpoints again. Invalid resources are not kept.
+func (c *ThreescaleConfig) updateService(service ServiceConfig, proxyConf threescale_client.ProxyConfig, force bool) (bool, error) {
+	var err error
+	current, ok := c.resources[service.ID]
+	changed := !ok || current.version != proxyConf.ProxyConfig.Version
+	if changed || force {
+		// The endpoints resolved last are kept for the clusters whose addresses can't be resolved anymore.
+		previousEndpoints := current.endpoints
+		current, err = c.newServiceResources(service, proxyConf)
+		if err != nil {
+			return false, err
+		}
+		current.endpoints = previousEndpoints
+	}
 
-	extAuthzPerRoute := extAuthService.ExtAuthzPerRoute{
-		Override: &checkSettings,
+	// The endpoints are resolved on every refresh, as they can change without a new proxy config.
+	endpointsChanged, err := c.resolveEndpoints(service, &current)
+	if err != nil {
+		return false, err
+	}
+	if err := validateService(current); err != nil {
+		return false, fmt.Errorf("invalid Envoy configuration: %v", err)
 	}
 
-	extAuthConf, _ := util.MessageToStruct(&extAuthzPerRoute)
+	c.resources[service.ID] = current
+	return changed || force || endpointsChanged, nil
+}
 
-	proxyEndpointURL, err := url.Parse(proxyEndpoint)
+func (c *ThreescaleConfig) newServiceResources(service ServiceConfig, proxyConf threescale_client.ProxyConfig) (serviceResources, error) {
+	var product productConfig
+	if err := json.Unmarshal(proxyConf.Raw, &product); err != nil {
+		return serviceResources{}, fmt.Errorf("invalid proxy config: %v", err)
+	}
+	return c.newProductResources(service, proxyConf.ProxyConfigElement, product)
+}
 
+// newProductResources generates the resources of a service from its proxy config, and the parts of it
+// decoded as a product config.
+func (c *ThreescaleConfig) newProductResources(service ServiceConfig, proxyConf sysC.ProxyConfigElement, product productConfig) (serviceResources, error) {
+	proxyEndpointURL, err := url.Parse(proxyConf.ProxyConfig.Content.Proxy.Endpoint)
 	if err != nil {
-		return cache.Snapshot{}, version
+		return serviceResources{}, err
 	}
 
-	apiBackendURL, err := url.Parse(apiBackend)
-
+	backends, err := serviceBackends(product, proxyConf)
 	if err != nil {
-		return cache.Snapshot{}, version
+		return serviceResources{}, err
 	}
 
-	clusterName := strings.Replace(apiBackendURL.Hostname(), ".", "_", -1)
+	contextExtensions := map[string]string{"service_id": service.ID, "service_name": c.resourceName(service.ID), "system_url": c.SystemURL, "access_token": c.AccessToken}
 
-	r := c.newRoute(clusterName, apiBackendURL)
+	extAuthConf, err := newExtAuthzPerRoute(contextExtensions)
+	if err != nil {
+		return serviceResources{}, err
+	}
+
+	var clusters []cache.Resource
+	var upstreams []upstream
+	// clusterFor returns the cluster of an upstream, generating it the first time. Upstreams sharing the
+	// same host and port share the cluster.
+	clusterFor := func(u *url.URL) string {
+		clusterName := c.resourceName(service.ID, strings.Replace(u.Hostname(), ".", "_", -1), strconv.Itoa(int(backendPort(u))))
+		if !hasUpstream(upstreams, clusterName) {
+			clusters = append(clusters, c.generateServiceCluster(clusterName, u, service))
+			upstreams = append(upstreams, upstream{clusterName: clusterName, url: u})
+		}
+		return clusterName
+	}
 
 	//
-	// Generate the VirtualHost for the service
+	// Translate the APIcast policies, their routes are matched before the ones of the backends.
 	//
+	policies := translatePolicies(service.ID, product.ProxyConfig.Content.Proxy.PolicyChain)
+	routes := policies.newRoutes(backends, clusterFor)
+
+	for _, b := range backends {
+		clusterName := clusterFor(b.url)
+
+		//
+		// Generate the Routes for the backend. The mapping rules are scoped to the backend the request is routed to.
+		//
+		backendExtensions := map[string]string{"backend_path": b.mountPath, "backend_paths": strings.Join(mountPaths(backends), ",")}
+		for k, v := range contextExtensions {
+			backendExtensions[k] = v
+		}
+		backendExtAuthConf, err := newExtAuthzPerRoute(backendExtensions)
+		if err != nil {
+			return serviceResources{}, err
+		}
 
-	v := c.newVirtualHost(proxyConf, proxyEndpointURL, r, extAuthConf)
+		for _, r := range c.newBackendRoutes(clusterName, b) {
+			r.PerFilterConfig = map[string]*types.Struct{
+				util.ExternalAuthorization: backendExtAuthConf,
+			}
+			routes = append(routes, r)
+		}
+	}
 
 	//
-	// Generate the HTTPConnectionManager for the service
+	// Generate the VirtualHost for the service
 	//
-
-	envoyGrpcConfig := c.newExternalAuthService()
-
-	envoyConf, err := util.MessageToStruct(&envoyGrpcConfig)
-	if err != nil {
-		panic(err)
+	v := c.newVirtualHost(c.resourceName(service.ID), proxyEndpointURL, routes, extAuthConf)
+	if err := policies.apply(&v); err != nil {
+		return serviceResources{}, err
 	}
 
-	manager := c.newHTTPManager(v, envoyConf)
+	return serviceResources{
+		version:     proxyConf.ProxyConfig.Version,
+		clusters:    clusters,
+		upstreams:   upstreams,
+		virtualHost: v,
+	}, nil
+}
 
-	pbst, err := util.MessageToStruct(manager)
-	if err != nil {
-		panic(err)
+func hasUpstream(upstreams []upstream, clusterName string) bool {
+	for _, u := range upstreams {
+		if u.clusterName == clusterName {
+			return true
+		}
 	}
+	return false
+}
 
-	//
-	// Generate the Listeners for the service
-
-	listenersCache := c.newListenersCache(pbst, PublicPort)
-	routesCache := []cache.Resource{&r}
-
-	// Create the cache snapshot and add all the caches.
-	// Set the local currentVersion pointer to the new config version, and increase the version for the snapshot.
-	newVersion = version + 1
-	c.CurrentVersion = proxyConf.ProxyConfig.Version
+// newExtAuthzPerRoute returns the External AuthZ filter config passing the given context extensions to the authorizer.
+func newExtAuthzPerRoute(contextExtensions map[string]string) (*types.Struct, error) {
+	checkSettings := extAuthService.ExtAuthzPerRoute_CheckSettings{CheckSettings: &extAuthService.CheckSettings{ContextExtensions: contextExtensions}}
 
-	snapshot := cache.NewSnapshot(fmt.Sprintf("%d", newVersion), nil, clusterCache, routesCache, listenersCache)
+	extAuthzPerRoute := extAuthService.ExtAuthzPerRoute{
+		Override: &checkSettings,
+	}
 
-	return snapshot, newVersion
+	return util.MessageToStruct(&extAuthzPerRoute)
 }
 
-// TODO: Create better and more generic constructors for Clusters, Listeners, Routes...
-func (c *ThreescaleConfig) generateServiceCluster(clusterCache []cache.Resource, apiBackend string) []cache.Resource {
+// resolveEndpoints refreshes the load assignments of the EDS clusters of a service, and reports whether they changed.
+// A cluster whose addresses can't be resolved keeps the last ones resolved, it only fails the service without them.
+func (c *ThreescaleConfig) resolveEndpoints(service ServiceConfig, resources *serviceResources) (bool, error) {
+	if !service.Endpoints.usesEDS() {
+		resources.endpoints = nil
+		return false, nil
+	}
+
+	var endpoints []cache.Resource
+	for _, u := range resources.upstreams {
+		loadAssignment, err := service.Endpoints.loadAssignment(u.clusterName, u.url.Hostname(), backendPort(u.url))
+		if err != nil {
+			last := resourcesByName(resources.endpoints)[u.clusterName]
+			if last == nil {
+				return false, err
+			}
+			log.WithField("service_id", service.ID).WithField("cluster", u.clusterName).
+				Warnf("Failed to resolve the endpoints, keeping the last ones: %v", err)
+			endpoints = append(endpoints, last)
+			continue
+		}
+		endpoints = append(endpoints, loadAssignment)
+	}
 
-	apiBackendURL, err := url.Parse(apiBackend)
+	previous, err := newVersionedResources(resources.endpoints)
 	if err != nil {
-		return nil
+		return false, err
+	}
+	current, err := newVersionedResources(endpoints)
+	if err != nil {
+		return false, err
 	}
 
-	clusterName := strings.Replace(apiBackendURL.Hostname(), ".", "_", -1)
+	resources.endpoints = endpoints
+	return previous.Version != current.Version, nil
+}
 
-	var port uint32
-	if apiBackendURL.Port() == "" {
-		if apiBackendURL.Scheme == "http" {
-			port = uint32(80)
-		} else if apiBackendURL.Scheme == "https" {
-			port = uint32(443)
-		}
-	} else {
-		i, _ := strconv.Atoi(apiBackendURL.Port())
-		port = uint32(i)
+// Resources returns the clusters, endpoints and virtual hosts of every service of the tenant, ordered by service ID.
+func (c *ThreescaleConfig) Resources() ([]cache.Resource, []cache.Resource, []route.VirtualHost) {
+	ids := make([]string, 0, len(c.resources))
+	for id := range c.resources {
+		ids = append(ids, id)
 	}
-
-	apiBackendAddress := &core.Address{
-		Address: &core.Address_SocketAddress{
-			SocketAddress: &core.SocketAddress{
-				Protocol: core.TCP,
-				Address:  apiBackendURL.Hostname(),
-				PortSpecifier: &core.SocketAddress_PortValue{
-					PortValue: port,
-				},
-				Ipv4Compat: true,
-			},
-		},
+	sort.Strings(ids)
+
+	var clusters, endpoints []cache.Resource
+	var virtualHosts []route.VirtualHost
+	for _, id := range ids {
+		clusters = append(clusters, c.resources[id].clusters...)
+		endpoints = append(endpoints, c.resources[id].endpoints...)
+		virtualHosts = append(virtualHosts, c.resources[id].virtualHost)
 	}
+	return clusters, endpoints, virtualHosts
+}
+
+// resourceName namespaces the given parts with the tenant name, so resources generated from
+// different tenants never collide in the merged snapshot.
+func (c *ThreescaleConfig) resourceName(parts ...string) string {
+	return strings.Join(append([]string{c.Name}, parts...), "_")
+}
+
+// TODO: Create better and more generic constructors for Clusters, Listeners, Routes...
+func (c *ThreescaleConfig) generateServiceCluster(clusterName string, apiBackendURL *url.URL, service ServiceConfig) *v2.Cluster {
+	endpoints := service.Endpoints
 
 	apiBackendCluster := &v2.Cluster{
 		Name: clusterName,
 		ClusterDiscoveryType: &v2.Cluster_Type{
-			Type: v2.Cluster_LOGICAL_DNS,
+			Type: endpoints.discoveryType(),
 		},
 		ConnectTimeout: 5 * time.Second,
 		LbPolicy:       v2.Cluster_ROUND_ROBIN,
-		LoadAssignment: &v2.ClusterLoadAssignment{
-			ClusterName: clusterName,
-			Endpoints: []endpoint.LocalityLbEndpoints{{
-				LbEndpoints: []endpoint.LbEndpoint{{
-					HostIdentifier: &endpoint.LbEndpoint_Endpoint{
-						Endpoint: &endpoint.Endpoint{
-							Address: apiBackendAddress,
-						},
-					},
-				},},
-			},},
-		},
 	}
 
-	if apiBackendURL.Scheme == "https" {
-		apiBackendCluster.TlsContext = &auth.UpstreamTlsContext{
-			CommonTlsContext:   nil,
-			Sni:                apiBackendURL.Hostname(),
-			AllowRenegotiation: false,
-			MaxSessionKeys:     nil,
-		}
-	}
-	clusterCache = append(clusterCache, apiBackendCluster)
-	return clusterCache
-}
-func (c *ThreescaleConfig) generateAuthZCluster(clusterCache []cache.Resource, AuthPort uint, Host string) []cache.Resource {
-	// externalAuthZ Cluster
-	externalAuthZ := Host
-	externalAuthZPort := uint32(AuthPort)
-	extAuthzAddress := &core.Address{
-		Address: &core.Address_SocketAddress{
-			SocketAddress: &core.SocketAddress{
-				Protocol: core.TCP,
-				Address:  externalAuthZ,
-				PortSpecifier: &core.SocketAddress_PortValue{
-					PortValue: externalAuthZPort,
+	if endpoints.usesEDS() {
+		apiBackendCluster.EdsClusterConfig = &v2.Cluster_EdsClusterConfig{
+			EdsConfig: &core.ConfigSource{
+				ConfigSourceSpecifier: &core.ConfigSource_Ads{
+					Ads: &core.AggregatedConfigSource{},
 				},
-				Ipv4Compat: true,
 			},
-		},
-	}
-	clusterName := "extauthz"
-
-	extAuthZCluster := &v2.Cluster{
-		Name: clusterName,
-		ClusterDiscoveryType: &v2.Cluster_Type{
-			Type: v2.Cluster_LOGICAL_DNS,
-		},
-		ConnectTimeout: 5 * time.Second,
-		LbPolicy:       v2.Cluster_ROUND_ROBIN,
-		LoadAssignment: &v2.ClusterLoadAssignment{
-			ClusterName: clusterName,
-			Endpoints: []endpoint.LocalityLbEndpoints{{
-				LbEndpoints: []endpoint.LbEndpoint{{
-					HostIdentifier: &endpoint.LbEndpoint_Endpoint{
-						Endpoint: &endpoint.Endpoint{
-							Address: extAuthzAddress,
-						},
-					},
-				},},
-			},},
-		},
+		}
+	} else {
+		apiBackendCluster.LoadAssignment = newLoadAssignment(clusterName, []string{apiBackendURL.Hostname()}, backendPort(apiBackendURL))
 	}
 
-	// Enable HTTP2 support
-
-	extAuthZCluster.Http2ProtocolOptions = &core.Http2ProtocolOptions{
-		HpackTableSize:              nil,
-		MaxConcurrentStreams:        nil,
-		InitialStreamWindowSize:     nil,
-		InitialConnectionWindowSize: nil,
-		AllowConnect:                false,
-		AllowMetadata:               false,
+	if apiBackendURL.Scheme == "https" {
+		apiBackendCluster.TlsContext = service.TLS.upstreamTLSContext(apiBackendURL.Hostname())
 	}
 
-	clusterCache = append(clusterCache, extAuthZCluster)
-	return clusterCache
+	service.applyClusterHealth(apiBackendCluster)
+	return apiBackendCluster
 }
 
-func (c *ThreescaleConfig) newListenersCache(pbst *types.Struct, PublicPort uint) []cache.Resource {
-	listenersCache := []cache.Resource{
-		&v2.Listener{
-			Name: "listener_0",
-			Address: core.Address{
-				Address: &core.Address_SocketAddress{
-					SocketAddress: &core.SocketAddress{
-						Protocol: core.TCP,
-						Address:  "0.0.0.0",
-						PortSpecifier: &core.SocketAddress_PortValue{
-							PortValue: uint32(PublicPort),
-						},
-					},
-				},
-			},
-			FilterChains: []listener.FilterChain{{
-				Filters: []listener.Filter{{
-					Name:       util.HTTPConnectionManager,
-					ConfigType: &listener.Filter_Config{Config: pbst},
-				}},
-			}},
-		},
-	}
-	return listenersCache
-}
-func (c *ThreescaleConfig) newRoute(clusterName string, apiBackendURL *url.URL) route.Route {
-	r := route.Route{
-		Match: route.RouteMatch{
-			PathSpecifier: &route.RouteMatch_Prefix{
-				Prefix: apiBackendURL.Path,
-			},
-		},
-		Action: &route.Route_Route{
-			Route: &route.RouteAction{
-				ClusterSpecifier: &route.RouteAction_Cluster{
-					Cluster: clusterName,
-				},
-				HostRewriteSpecifier: &route.RouteAction_HostRewrite{
-					HostRewrite: apiBackendURL.Hostname(),
-				},
-			},
-		},
-	}
-	return r
-}
-func (c *ThreescaleConfig) newExternalAuthService() extAuthService.ExtAuthz {
-	envoyGrpcConfig := extAuthService.ExtAuthz{
-		Services: &extAuthService.ExtAuthz_GrpcService{
-			GrpcService: &core.GrpcService{
-				TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
-					EnvoyGrpc: &core.GrpcService_EnvoyGrpc{
-						ClusterName: "extauthz",
-					},
-				},
-				Timeout: &types.Duration{
-					Seconds: 5,
-					Nanos:   0,
-				},
-			},
-		},
-		FailureModeAllow: false,
+// backendPort returns the port of an API backend URL, or the default port of its scheme.
+func backendPort(apiBackendURL *url.URL) uint32 {
+	var port uint32
+	if apiBackendURL.Port() == "" {
+		if apiBackendURL.Scheme == "http" {
+			port = uint32(80)
+		} else if apiBackendURL.Scheme == "https" {
+			port = uint32(443)
+		}
+	} else {
+		i, _ := strconv.Atoi(apiBackendURL.Port())
+		port = uint32(i)
 	}
-	return envoyGrpcConfig
+	return port
 }
 
-func (c *ThreescaleConfig) newHTTPManager(v route.VirtualHost, envoyConf *types.Struct) *hcm.HttpConnectionManager {
-	manager := &hcm.HttpConnectionManager{
-		CodecType:  hcm.AUTO,
-		StatPrefix: "ingress_http",
-		RouteSpecifier: &hcm.HttpConnectionManager_RouteConfig{
-			RouteConfig: &v2.RouteConfiguration{
-				Name:         "local_route",
-				VirtualHosts: []route.VirtualHost{v},
-			},
-		},
-		HttpFilters: []*hcm.HttpFilter{
-			{
-				Name: util.ExternalAuthorization,
-				ConfigType: &hcm.HttpFilter_Config{
-					Config: envoyConf,
-				},
-			},
-			{
-				Name: util.Router,
-			},
-		},
-	}
-	return manager
-}
-func (c *ThreescaleConfig) newVirtualHost(proxyConf sysC.ProxyConfigElement, proxyEndpointURL *url.URL, r route.Route, extAuthConf *types.Struct) route.VirtualHost {
+func (c *ThreescaleConfig) newVirtualHost(name string, proxyEndpointURL *url.URL, routes []route.Route, extAuthConf *types.Struct) route.VirtualHost {
 	v := route.VirtualHost{
-		Name:    strconv.Itoa(int(proxyConf.ProxyConfig.Content.Proxy.ServiceID)),
+		Name:    name,
 		Domains: []string{proxyEndpointURL.Hostname()},
-		Routes:  []route.Route{r},
+		Routes:  routes,
+		// The usage of authorized requests is rate limited locally, the headers carrying it are not sent upstream.
+		RateLimits:             newRateLimits(name),
+		RequestHeadersToRemove: []string{appHeader, usageHeader},
 		PerFilterConfig: map[string]*types.Struct{
 			util.ExternalAuthorization: extAuthConf,
 		},
 	}
 	return v
 }
-func (c *ThreescaleConfig) parseURL(url *url.URL) (string, string, int) {
-	scheme := url.Scheme
-	if scheme == "" {
-		scheme = "https"
-	}
-
-	host, port, _ := net.SplitHostPort(url.Host)
-	if port == "" {
-		if scheme == "http" {
-			port = "80"
-		} else if scheme == "https" {
-			port = "443"
-		}
-	}
-
-	if host == "" {
-		host = url.Host
-	}
-
-	p, _ := strconv.Atoi(port)
-	return scheme, host, p
-}
@@ -0,0 +1,340 @@
+package threescale_control_plane
+
+import (
+	"3scale-envoy/pkg/fake_threescale"
+	"3scale-envoy/pkg/threescale_client"
+	"fmt"
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAccessToken = "test-access-token"
+
+// configFixture serves the proxy configs recorded from 3scale in testdata: a service with a single API
+// backend, a product composed of two backends with a headers policy, and a service whose API backend URL
+// is invalid.
+const configFixture = `
+access_token: test-access-token
+services:
+  - id: "2555417777777"
+    name: echo_api
+    service_token: test-service-token
+    proxy_config: testdata/proxy_configs/2555417777777.json
+    metrics:
+      - name: hits
+        methods: [hello]
+  - id: "2555417777778"
+    name: product
+    service_token: test-service-token
+    proxy_config: testdata/proxy_configs/2555417777778.json
+    metrics:
+      - name: hits
+        methods: [hello]
+  - id: "2555417777779"
+    name: broken_api
+    service_token: test-service-token
+    proxy_config: testdata/proxy_configs/2555417777779.json
+`
+
+// newTestSystem serves the services of a fixture through the fake 3scale Account Management API.
+func newTestSystem(t *testing.T, fixture string) *httptest.Server {
+	f, err := fake_threescale.ParseFixture([]byte(fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(fake_threescale.NewServer(f))
+}
+
+func newTestProxyCache() *threescale_client.CachingSource {
+	return threescale_client.NewCachingSource(threescale_client.NewSystemClient(&http.Client{}), time.Minute, 30*time.Second, 1, 100)
+}
+
+// routeMatches describes the matches of the routes of a virtual host, with the cluster and the path prefix
+// rewrite of each one.
+func routeMatches(v route.VirtualHost) []string {
+	var matches []string
+	for _, r := range v.Routes {
+		action := r.GetRoute()
+		switch {
+		case r.Match.GetPath() != "":
+			matches = append(matches, fmt.Sprintf("path %s -> %s%s", r.Match.GetPath(), action.GetCluster(), action.PrefixRewrite))
+		default:
+			matches = append(matches, fmt.Sprintf("prefix %s -> %s%s", r.Match.GetPrefix(), action.GetCluster(), action.PrefixRewrite))
+		}
+	}
+	return matches
+}
+
+func TestGetConfig(t *testing.T) {
+	system := newTestSystem(t, configFixture)
+	defer system.Close()
+
+	tests := []struct {
+		name        string
+		accessToken string
+		services    []ServiceConfig
+		wantErr     string
+		wantChanged bool
+		// wantClusters are the names and types of the generated clusters.
+		wantClusters []string
+		wantDomains  []string
+		wantRoutes   []string
+		// wantHeaders are the request headers added by the policies of the virtual hosts.
+		wantHeaders []string
+	}{
+		{
+			name:         "single backend service",
+			services:     []ServiceConfig{{ID: "2555417777777"}},
+			wantChanged:  true,
+			wantClusters: []string{"test_2555417777777_10_0_0_1_8080 LOGICAL_DNS"},
+			wantDomains:  []string{"echo-api.example.com"},
+			wantRoutes:   []string{"prefix / -> test_2555417777777_10_0_0_1_8080"},
+		},
+		{
+			name:         "endpoints resolved by the control plane",
+			services:     []ServiceConfig{{ID: "2555417777777", Endpoints: EndpointsConfig{Type: EndpointsDNS}}},
+			wantChanged:  true,
+			wantClusters: []string{"test_2555417777777_10_0_0_1_8080 EDS"},
+			wantDomains:  []string{"echo-api.example.com"},
+			wantRoutes:   []string{"prefix / -> test_2555417777777_10_0_0_1_8080"},
+		},
+		{
+			name:         "endpoints resolved by Envoy",
+			services:     []ServiceConfig{{ID: "2555417777777", Endpoints: EndpointsConfig{Type: EndpointsStrictDNS}}},
+			wantChanged:  true,
+			wantClusters: []string{"test_2555417777777_10_0_0_1_8080 STRICT_DNS"},
+			wantDomains:  []string{"echo-api.example.com"},
+			wantRoutes:   []string{"prefix / -> test_2555417777777_10_0_0_1_8080"},
+		},
+		{
+			name:        "product with several backends",
+			services:    []ServiceConfig{{ID: "2555417777778"}},
+			wantChanged: true,
+			wantClusters: []string{
+				"test_2555417777778_10_0_0_2_8080 LOGICAL_DNS",
+				"test_2555417777778_10_0_0_3_443 LOGICAL_DNS",
+			},
+			wantDomains: []string{"product.example.com"},
+			wantRoutes: []string{
+				"path /echo -> test_2555417777778_10_0_0_2_8080/api",
+				"prefix /echo/ -> test_2555417777778_10_0_0_2_8080/api/",
+				"prefix / -> test_2555417777778_10_0_0_3_443",
+			},
+			wantHeaders: []string{"X-Gateway: 3scale-envoy"},
+		},
+		{
+			name:        "every service of the tenant",
+			wantErr:     "service 2555417777779:",
+			wantChanged: true,
+			wantClusters: []string{
+				"test_2555417777777_10_0_0_1_8080 LOGICAL_DNS",
+				"test_2555417777778_10_0_0_2_8080 LOGICAL_DNS",
+				"test_2555417777778_10_0_0_3_443 LOGICAL_DNS",
+			},
+			wantDomains: []string{"echo-api.example.com", "product.example.com"},
+			wantRoutes: []string{
+				"prefix / -> test_2555417777777_10_0_0_1_8080",
+				"path /echo -> test_2555417777778_10_0_0_2_8080/api",
+				"prefix /echo/ -> test_2555417777778_10_0_0_2_8080/api/",
+				"prefix / -> test_2555417777778_10_0_0_3_443",
+			},
+			wantHeaders: []string{"X-Gateway: 3scale-envoy"},
+		},
+		{
+			name:     "unknown service",
+			services: []ServiceConfig{{ID: "1"}},
+			wantErr:  "service 1:",
+		},
+		{
+			name:        "invalid proxy config keeps the other services",
+			services:    []ServiceConfig{{ID: "2555417777779"}, {ID: "2555417777777"}},
+			wantErr:     "service 2555417777779:",
+			wantChanged: true,
+			wantClusters: []string{
+				"test_2555417777777_10_0_0_1_8080 LOGICAL_DNS",
+			},
+			wantDomains: []string{"echo-api.example.com"},
+			wantRoutes:  []string{"prefix / -> test_2555417777777_10_0_0_1_8080"},
+		},
+		{
+			name:        "invalid access token",
+			accessToken: "invalid",
+			wantErr:     "403",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accessToken := tt.accessToken
+			if accessToken == "" {
+				accessToken = testAccessToken
+			}
+			c := &ThreescaleConfig{Name: "test", AccessToken: accessToken, SystemURL: system.URL + "/", Services: tt.services}
+
+			changed, err := c.GetConfig(newTestProxyCache())
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+			if changed != tt.wantChanged {
+				t.Errorf("changed = %t, want %t", changed, tt.wantChanged)
+			}
+
+			clusters, endpoints, virtualHosts := c.Resources()
+			var gotClusters, gotDomains, gotRoutes, gotHeaders []string
+			for _, r := range clusters {
+				cluster := r.(*v2.Cluster)
+				gotClusters = append(gotClusters, cluster.Name+" "+cluster.GetType().String())
+			}
+			for _, v := range virtualHosts {
+				gotDomains = append(gotDomains, v.Domains...)
+				gotRoutes = append(gotRoutes, routeMatches(v)...)
+				for _, h := range v.RequestHeadersToAdd {
+					gotHeaders = append(gotHeaders, h.Header.Key+": "+h.Header.Value)
+				}
+			}
+			if !reflect.DeepEqual(gotClusters, tt.wantClusters) {
+				t.Errorf("clusters = %v, want %v", gotClusters, tt.wantClusters)
+			}
+			if !reflect.DeepEqual(gotDomains, tt.wantDomains) {
+				t.Errorf("domains = %v, want %v", gotDomains, tt.wantDomains)
+			}
+			if !reflect.DeepEqual(gotRoutes, tt.wantRoutes) {
+				t.Errorf("routes = %v, want %v", gotRoutes, tt.wantRoutes)
+			}
+			if !reflect.DeepEqual(gotHeaders, tt.wantHeaders) {
+				t.Errorf("request headers = %v, want %v", gotHeaders, tt.wantHeaders)
+			}
+
+			// Every EDS cluster gets the addresses of its API backend.
+			for _, r := range endpoints {
+				loadAssignment := r.(*v2.ClusterLoadAssignment)
+				if len(loadAssignment.Endpoints) == 0 || len(loadAssignment.Endpoints[0].LbEndpoints) != 1 {
+					t.Errorf("cluster %s: unexpected endpoints %v", loadAssignment.ClusterName, loadAssignment.Endpoints)
+				}
+			}
+			var edsClusters int
+			for _, cluster := range gotClusters {
+				if strings.HasSuffix(cluster, " EDS") {
+					edsClusters++
+				}
+			}
+			if len(endpoints) != edsClusters {
+				t.Errorf("got %d load assignments for %d EDS clusters", len(endpoints), edsClusters)
+			}
+		})
+	}
+}
+
+func TestGetConfigRefresh(t *testing.T) {
+	system := newTestSystem(t, configFixture)
+	defer system.Close()
+
+	c := &ThreescaleConfig{
+		Name:        "test",
+		AccessToken: testAccessToken,
+		SystemURL:   system.URL + "/",
+		Services:    []ServiceConfig{{ID: "2555417777777"}, {ID: "2555417777778"}},
+	}
+	proxyCache := newTestProxyCache()
+
+	if changed, err := c.GetConfig(proxyCache); err != nil || !changed {
+		t.Fatalf("first refresh: changed = %t, err = %v", changed, err)
+	}
+	if changed, err := c.GetConfig(proxyCache); err != nil || changed {
+		t.Errorf("refresh without changes: changed = %t, err = %v", changed, err)
+	}
+
+	// The resources of the services that are not selected anymore are dropped.
+	c.Services = c.Services[:1]
+	if changed, err := c.GetConfig(proxyCache); err != nil || !changed {
+		t.Fatalf("refresh dropping a service: changed = %t, err = %v", changed, err)
+	}
+	if _, _, virtualHosts := c.Resources(); len(virtualHosts) != 1 || virtualHosts[0].Name != "test_2555417777777" {
+		t.Errorf("virtual hosts = %v, want test_2555417777777 only", virtualHosts)
+	}
+
+	// A forced refresh regenerates the resources even if the proxy config version didn't change.
+	if changed, err := c.RefreshService(proxyCache, "2555417777777"); err != nil || !changed {
+		t.Errorf("forced refresh: changed = %t, err = %v", changed, err)
+	}
+	if _, err := c.RefreshService(proxyCache, "2555417777778"); err == nil {
+		t.Error("forced refresh of a service that is not selected: expected an error")
+	}
+}
+
+func TestGetConfigEndpointsLookupFailure(t *testing.T) {
+	system := newTestSystem(t, configFixture)
+	defer system.Close()
+
+	f, err := ioutil.TempFile("", "backend-addresses")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	c := &ThreescaleConfig{
+		Name:        "test",
+		AccessToken: testAccessToken,
+		SystemURL:   system.URL + "/",
+		Services:    []ServiceConfig{{ID: "2555417777777", Endpoints: EndpointsConfig{Type: EndpointsFile, File: f.Name()}}},
+	}
+	proxyCache := newTestProxyCache()
+	addresses := func() []string {
+		_, endpoints, _ := c.Resources()
+		var addresses []string
+		for _, r := range endpoints {
+			for _, e := range r.(*v2.ClusterLoadAssignment).Endpoints[0].LbEndpoints {
+				address := e.GetEndpoint().Address.GetSocketAddress()
+				addresses = append(addresses, fmt.Sprintf("%s:%d", address.Address, address.GetPortValue()))
+			}
+		}
+		return addresses
+	}
+
+	// A service is not published until its endpoints are resolved once.
+	if err := ioutil.WriteFile(f.Name(), []byte("backend.invalid\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetConfig(proxyCache); err == nil || !strings.Contains(err.Error(), "service 2555417777777:") {
+		t.Fatalf("error = %v, want the lookup to fail the service", err)
+	}
+	if _, _, virtualHosts := c.Resources(); len(virtualHosts) != 0 {
+		t.Errorf("virtual hosts = %v, want none", virtualHosts)
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte("10.0.0.5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := c.GetConfig(proxyCache); err != nil || !changed {
+		t.Fatalf("refresh: changed = %t, err = %v", changed, err)
+	}
+	if got := addresses(); !reflect.DeepEqual(got, []string{"10.0.0.5:8080"}) {
+		t.Fatalf("endpoints = %v, want 10.0.0.5:8080", got)
+	}
+
+	// Once resolved, a lookup failure keeps the last endpoints, also when the resources are regenerated.
+	if err := ioutil.WriteFile(f.Name(), []byte("backend.invalid\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := c.GetConfig(proxyCache); err != nil || changed {
+		t.Errorf("refresh failing the lookup: changed = %t, err = %v", changed, err)
+	}
+	if _, err := c.RefreshService(proxyCache, "2555417777777"); err != nil {
+		t.Errorf("forced refresh failing the lookup: %v", err)
+	}
+	if got := addresses(); !reflect.DeepEqual(got, []string{"10.0.0.5:8080"}) {
+		t.Errorf("endpoints = %v, want the last ones resolved", got)
+	}
+}
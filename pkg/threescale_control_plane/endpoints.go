@@ -0,0 +1,184 @@
+package threescale_control_plane
+
+import (
+	"bufio"
+	"fmt"
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Endpoints types, selecting where the addresses of an API backend come from. Without a type, Envoy
+// resolves the backend hostname itself, like with EndpointsLogicalDNS.
+const (
+	// The control plane resolves the backend hostname and publishes the addresses through EDS. The control
+	// plane must be able to resolve it.
+	EndpointsDNS = "dns"
+	// The addresses are listed in the config and published through EDS.
+	EndpointsStatic = "static"
+	// The addresses are read from a file on every refresh and published through EDS.
+	EndpointsFile = "file"
+	// Envoy resolves the backend hostname itself, and load balances across all the addresses.
+	EndpointsStrictDNS = "strict_dns"
+	// Envoy resolves the backend hostname itself, and connects to the first address.
+	EndpointsLogicalDNS = "logical_dns"
+)
+
+// EndpointsConfig configures how the addresses of the API backend of a service are discovered.
+type EndpointsConfig struct {
+	Type string `json:"type"`
+	// Addresses as "host" or "host:port", the port of the API backend is used when missing.
+	Addresses []string `json:"addresses"`
+	// File with one address per line, in the same format as Addresses. Lines starting with '#' are ignored.
+	File string `json:"file"`
+}
+
+func (e EndpointsConfig) validate() error {
+	switch e.Type {
+	case "", EndpointsDNS, EndpointsStrictDNS, EndpointsLogicalDNS:
+	case EndpointsStatic:
+		if len(e.Addresses) == 0 {
+			return fmt.Errorf("%s endpoints require addresses", e.Type)
+		}
+	case EndpointsFile:
+		if e.File == "" {
+			return fmt.Errorf("%s endpoints require a file", e.Type)
+		}
+	default:
+		return fmt.Errorf("unknown endpoints type %q", e.Type)
+	}
+	return nil
+}
+
+// usesEDS reports whether the clusters are EDS typed, and their endpoints resolved by the control plane.
+func (e EndpointsConfig) usesEDS() bool {
+	return e.Type == EndpointsDNS || e.Type == EndpointsStatic || e.Type == EndpointsFile
+}
+
+// discoveryType returns the Envoy cluster type matching the endpoints type.
+func (e EndpointsConfig) discoveryType() v2.Cluster_DiscoveryType {
+	switch e.Type {
+	case EndpointsStrictDNS:
+		return v2.Cluster_STRICT_DNS
+	case EndpointsDNS, EndpointsStatic, EndpointsFile:
+		return v2.Cluster_EDS
+	default:
+		return v2.Cluster_LOGICAL_DNS
+	}
+}
+
+// loadAssignment resolves the endpoints of an upstream cluster. The returned addresses are sorted,
+// so the assignment only changes when the set of addresses changes.
+func (e EndpointsConfig) loadAssignment(clusterName string, host string, port uint32) (*v2.ClusterLoadAssignment, error) {
+	var addresses []string
+	switch e.Type {
+	case EndpointsStatic:
+		addresses = e.Addresses
+	case EndpointsFile:
+		fileAddresses, err := readAddressesFile(e.File)
+		if err != nil {
+			return nil, err
+		}
+		addresses = fileAddresses
+	case EndpointsDNS:
+		addresses = []string{host}
+	default:
+		// Envoy resolves the hostname itself.
+		return newLoadAssignment(clusterName, []string{host}, port), nil
+	}
+
+	var resolved []string
+	for _, address := range addresses {
+		addressHost, addressPort, err := splitAddress(address, port)
+		if err != nil {
+			return nil, err
+		}
+
+		ips, err := net.LookupIP(addressHost)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			resolved = append(resolved, net.JoinHostPort(ip.String(), strconv.Itoa(int(addressPort))))
+		}
+	}
+	if len(resolved) == 0 {
+		return nil, fmt.Errorf("no endpoints found for cluster %s", clusterName)
+	}
+	sort.Strings(resolved)
+
+	return newLoadAssignment(clusterName, resolved, port), nil
+}
+
+// newLoadAssignment builds the load assignment of a cluster from a list of "host[:port]" addresses.
+func newLoadAssignment(clusterName string, addresses []string, port uint32) *v2.ClusterLoadAssignment {
+	lbEndpoints := make([]endpoint.LbEndpoint, 0, len(addresses))
+	for _, address := range addresses {
+		// The addresses were already validated when resolving them.
+		host, addressPort, _ := splitAddress(address, port)
+		lbEndpoints = append(lbEndpoints, endpoint.LbEndpoint{
+			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+				Endpoint: &endpoint.Endpoint{
+					Address: &core.Address{
+						Address: &core.Address_SocketAddress{
+							SocketAddress: &core.SocketAddress{
+								Protocol: core.TCP,
+								Address:  host,
+								PortSpecifier: &core.SocketAddress_PortValue{
+									PortValue: addressPort,
+								},
+								Ipv4Compat: true,
+							},
+						},
+					},
+				},
+			},
+		})
+	}
+
+	return &v2.ClusterLoadAssignment{
+		ClusterName: clusterName,
+		Endpoints: []endpoint.LocalityLbEndpoints{{
+			LbEndpoints: lbEndpoints,
+		}},
+	}
+}
+
+// splitAddress splits a "host[:port]" address, using the default port when it is missing.
+func splitAddress(address string, defaultPort uint32) (string, uint32, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		// No port in the address.
+		return strings.Trim(address, "[]"), defaultPort, nil
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port in address %s", address)
+	}
+	return host, uint32(p), nil
+}
+
+func readAddressesFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var addresses []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addresses = append(addresses, line)
+	}
+	return addresses, scanner.Err()
+}
@@ -2,22 +2,37 @@ package threescale_control_plane
 
 import (
 	"3scale-envoy/pkg/threescale_authorizer"
+	"3scale-envoy/pkg/tracing"
 	"context"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	authZ "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	envoyType "github.com/envoyproxy/go-control-plane/envoy/type"
 	"github.com/gogo/googleapis/google/rpc"
-	"google.golang.org/grpc"
+	"github.com/gogo/protobuf/types"
 	"net/url"
+	"strings"
 )
 
 type envoyAuth struct {
-	server     grpc.Server
-	authorizer threescale_authorizer.Authorizer
+	authorizer  *threescale_authorizer.Authorizer
+	rateLimiter *rateLimiter
+	accessLogs  *accessLogWriter
 }
 
 func (ea envoyAuth) Check(ctx context.Context, ar *authZ.CheckRequest) (*authZ.CheckResponse, error) {
+	entry := log.WithField("request_id", requestID(ar)).WithField("service_id", ar.Attributes.ContextExtensions["service_id"])
+
+	if parent, ok := tracing.Extract(ar.Attributes.Request.Http.Headers); ok {
+		ctx = tracing.ContextWithRemoteParent(ctx, parent)
+	}
+	span, ctx := tracing.StartSpan(ctx, "ext_authz check", tracing.Server)
+	defer span.Finish()
+	span.SetTag("request_id", requestID(ar))
+	span.SetTag("service_id", ar.Attributes.ContextExtensions["service_id"])
 
 	requestHTTP, err := url.ParseRequestURI(ar.Attributes.Request.Http.Path)
 	if err != nil {
+		entry.WithField("decision", threescale_authorizer.Denied.String()).Infof("Invalid request path: %v", err)
 		return &authZ.CheckResponse{
 			Status: &rpc.Status{
 				Code:    7,
@@ -31,6 +46,7 @@ func (ea envoyAuth) Check(ctx context.Context, ar *authZ.CheckRequest) (*authZ.C
 	if ar.Attributes.ContextExtensions["service_id"] == "" ||
 		ar.Attributes.ContextExtensions["system_url"] == "" ||
 		ar.Attributes.ContextExtensions["access_token"] == "" {
+		entry.WithField("decision", threescale_authorizer.Denied.String()).Info("Route without 3scale service")
 		return &authZ.CheckResponse{
 			Status: &rpc.Status{
 				Code:    7,
@@ -48,13 +64,31 @@ func (ea envoyAuth) Check(ctx context.Context, ar *authZ.CheckRequest) (*authZ.C
 		SystemUrl:   ar.Attributes.ContextExtensions["system_url"],
 		AccessToken: ar.Attributes.ContextExtensions["access_token"],
 		Path:        requestHTTP.Path,
+		Query:       requestHTTP.Query(),
 		Method:      ar.Attributes.Request.Http.Method,
 		AppID:       requestHTTP.Query().Get("app_id"),
 		AppKey:      requestHTTP.Query().Get("app_key"),
 		UserKey:     requestHTTP.Query().Get("user_key"),
+		BackendPath: ar.Attributes.ContextExtensions["backend_path"],
+		RequestID:   requestID(ar),
+	}
+	if backendPaths := ar.Attributes.ContextExtensions["backend_paths"]; backendPaths != "" {
+		request.BackendPaths = strings.Split(backendPaths, ",")
 	}
 
-	if ea.authorizer.AuthRep(request) {
+	result := ea.authorizer.AuthRep(ctx, request)
+	span.SetTag("decision", result.Decision.String())
+	ea.accessLogs.authorized(request.RequestID, request.ServiceId, result)
+	entry.WithField("decision", result.Decision.String()).WithField("app_id", result.App).Info("Authorization decision")
+
+	switch result.Decision {
+	case threescale_authorizer.Authorized:
+		// The application and its usage are passed to the rate limit filter as request headers.
+		serviceName := ar.Attributes.ContextExtensions["service_name"]
+		if ea.rateLimiter != nil && serviceName != "" {
+			ea.rateLimiter.setAppLimits(serviceName, result.App, result.UsageReports)
+		}
+
 		return &authZ.CheckResponse{
 			Status: &rpc.Status{
 				Code:    0,
@@ -62,10 +96,30 @@ func (ea envoyAuth) Check(ctx context.Context, ar *authZ.CheckRequest) (*authZ.C
 				Details: nil,
 			},
 			HttpResponse: &authZ.CheckResponse_OkResponse{
-				OkResponse: nil,
+				OkResponse: &authZ.OkHttpResponse{
+					Headers: []*core.HeaderValueOption{
+						newHeader(appHeader, result.App),
+						newHeader(usageHeader, formatUsage(result.Usage)),
+					},
+				},
 			},
 		}, nil
-	} else {
+	case threescale_authorizer.NoMappingRuleMatched:
+		// Like APIcast, requests not matching any mapping rule are answered with a 404.
+		return &authZ.CheckResponse{
+			Status: &rpc.Status{
+				Code:    5,
+				Message: "no_mapping_rule_matched",
+				Details: nil,
+			},
+			HttpResponse: &authZ.CheckResponse_DeniedResponse{
+				DeniedResponse: &authZ.DeniedHttpResponse{
+					Status: &envoyType.HttpStatus{Code: envoyType.StatusCode_NotFound},
+					Body:   "No Mapping Rule matched",
+				},
+			},
+		}, nil
+	default:
 		return &authZ.CheckResponse{
 			Status: &rpc.Status{
 				Code:    7,
@@ -76,3 +130,20 @@ func (ea envoyAuth) Check(ctx context.Context, ar *authZ.CheckRequest) (*authZ.C
 		}, nil
 	}
 }
+
+// requestID returns the x-request-id header of a request, the ID its access log is sent with. The ID of
+// the HTTP request attributes is the internal stream ID of Envoy, only used when the header is missing.
+func requestID(ar *authZ.CheckRequest) string {
+	if id := ar.Attributes.Request.Http.Headers["x-request-id"]; id != "" {
+		return id
+	}
+	return ar.Attributes.Request.Http.Id
+}
+
+// newHeader returns a header replacing any value sent by the client.
+func newHeader(key, value string) *core.HeaderValueOption {
+	return &core.HeaderValueOption{
+		Header: &core.HeaderValue{Key: key, Value: value},
+		Append: &types.BoolValue{Value: false},
+	}
+}
@@ -0,0 +1,360 @@
+package threescale_control_plane
+
+import (
+	"3scale-envoy/pkg/fake_threescale"
+	"3scale-envoy/pkg/threescale_authorizer"
+	"3scale-envoy/pkg/threescale_client"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	accessLogData "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v2"
+	als "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v2"
+	authZ "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	envoyType "github.com/envoyproxy/go-control-plane/envoy/type"
+	"github.com/gogo/protobuf/types"
+	"google.golang.org/grpc"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const checkFixture = `
+access_token: test-access-token
+services:
+  - id: "1001"
+    service_token: test-service-token
+    endpoint: https://echo-api.example.com
+    api_backend: http://10.0.0.1:8080
+    metrics:
+      - name: hits
+        methods: [get_hello]
+    mapping_rules:
+      - {method: GET, pattern: "/hello$", metric: get_hello}
+      - {method: POST, pattern: "/", metric: hits}
+    applications:
+      - app_id: app
+        app_keys: [app-key]
+      - user_key: user-key
+      - app_id: suspended
+        app_keys: [suspended-key]
+        suspended: true
+      - app_id: limited
+        app_keys: [limited-key]
+        limits:
+          - {metric: hits, period: eternity, value: 0}
+  - id: "1002"
+    service_token: test-service-token
+    endpoint: https://product.example.com
+    backends:
+      - {name: echo, path: /echo, private_endpoint: "http://10.0.0.2:8080"}
+      - {name: other, path: /other, private_endpoint: "http://10.0.0.3:8080"}
+    mapping_rules:
+      - {method: GET, pattern: "/echo/hello", metric: hits}
+    applications:
+      - app_id: app
+        app_keys: [app-key]
+`
+
+func TestCheck(t *testing.T) {
+	system := newTestSystem(t, checkFixture)
+	defer system.Close()
+
+	service := map[string]string{"service_id": "1001", "system_url": system.URL + "/", "access_token": testAccessToken}
+	product := map[string]string{"service_id": "1002", "system_url": system.URL + "/", "access_token": testAccessToken, "backend_paths": "/echo,/other"}
+	with := func(extensions map[string]string, key, value string) map[string]string {
+		copied := map[string]string{key: value}
+		for k, v := range extensions {
+			if k != key {
+				copied[k] = v
+			}
+		}
+		return copied
+	}
+
+	tests := []struct {
+		name       string
+		extensions map[string]string
+		method     string
+		path       string
+		wantCode   int32
+		wantApp    string
+		wantUsage  string
+		wantStatus envoyType.StatusCode
+	}{
+		{
+			name:       "app id and app key",
+			extensions: service,
+			method:     "GET",
+			path:       "/hello?app_id=app&app_key=app-key",
+			wantCode:   0,
+			wantApp:    "app",
+			wantUsage:  "get_hello=1,hits=1",
+		},
+		{
+			name:       "user key",
+			extensions: service,
+			method:     "POST",
+			path:       "/hello?user_key=user-key",
+			wantCode:   0,
+			wantApp:    "user_key:0845e3658edc1c91",
+			wantUsage:  "hits=1",
+		},
+		{
+			name:       "invalid app key",
+			extensions: service,
+			method:     "GET",
+			path:       "/hello?app_id=app&app_key=invalid",
+			wantCode:   7,
+		},
+		{
+			name:       "missing app key",
+			extensions: service,
+			method:     "GET",
+			path:       "/hello?app_id=app",
+			wantCode:   7,
+		},
+		{
+			name:       "unknown app id",
+			extensions: service,
+			method:     "GET",
+			path:       "/hello?app_id=unknown&app_key=app-key",
+			wantCode:   7,
+		},
+		{
+			name:       "unknown user key",
+			extensions: service,
+			method:     "GET",
+			path:       "/hello?user_key=unknown",
+			wantCode:   7,
+		},
+		{
+			name:       "missing credentials",
+			extensions: service,
+			method:     "GET",
+			path:       "/hello",
+			wantCode:   7,
+		},
+		{
+			name:       "suspended application",
+			extensions: service,
+			method:     "GET",
+			path:       "/hello?app_id=suspended&app_key=suspended-key",
+			wantCode:   7,
+		},
+		{
+			name:       "usage limits exceeded",
+			extensions: service,
+			method:     "GET",
+			path:       "/hello?app_id=limited&app_key=limited-key",
+			wantCode:   7,
+		},
+		{
+			name:       "no mapping rule matched",
+			extensions: service,
+			method:     "GET",
+			path:       "/hello/world?app_id=app&app_key=app-key",
+			wantCode:   5,
+			wantStatus: envoyType.StatusCode_NotFound,
+		},
+		{
+			name:       "invalid request path",
+			extensions: service,
+			method:     "GET",
+			path:       "hello",
+			wantCode:   7,
+		},
+		{
+			name:       "route without 3scale service",
+			extensions: map[string]string{},
+			method:     "GET",
+			path:       "/hello?app_id=app&app_key=app-key",
+			wantCode:   7,
+		},
+		{
+			name:       "invalid access token",
+			extensions: with(service, "access_token", "invalid"),
+			method:     "GET",
+			path:       "/hello?app_id=app&app_key=app-key",
+			wantCode:   7,
+		},
+		{
+			name:       "unknown service",
+			extensions: with(service, "service_id", "9999"),
+			method:     "GET",
+			path:       "/hello?app_id=app&app_key=app-key",
+			wantCode:   7,
+		},
+		{
+			name:       "mapping rule of the backend the request is routed to",
+			extensions: with(product, "backend_path", "/echo"),
+			method:     "GET",
+			path:       "/echo/hello?app_id=app&app_key=app-key",
+			wantCode:   0,
+			wantApp:    "app",
+			wantUsage:  "hits=1",
+		},
+		{
+			name:       "mapping rule of another backend",
+			extensions: with(product, "backend_path", "/other"),
+			method:     "GET",
+			path:       "/echo/hello?app_id=app&app_key=app-key",
+			wantCode:   5,
+			wantStatus: envoyType.StatusCode_NotFound,
+		},
+	}
+
+	// The proxy configs are cached per access token, so the authorizer is shared by every case.
+	proxyCache := newTestProxyCache()
+	ea := envoyAuth{authorizer: threescale_authorizer.NewAuthorizer(proxyCache, threescale_client.NewBackendClient(&http.Client{}), nil)}
+	// The metrics are loaded with the proxy configs by the control plane, not while a request waits.
+	tenant := threescale_client.Tenant{SystemURL: system.URL + "/", AccessToken: testAccessToken}
+	proxyConf, err := proxyCache.GetProxyConfig(tenant, "1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ea.authorizer.LoadMetricHierarchy(tenant, "1001", proxyConf.ProxyConfig.Version); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := &authZ.CheckRequest{Attributes: &authZ.AttributeContext{
+				Request: &authZ.AttributeContext_Request{Http: &authZ.AttributeContext_HttpRequest{
+					Method: tt.method,
+					Path:   tt.path,
+					Host:   "echo-api.example.com",
+				}},
+				ContextExtensions: tt.extensions,
+			}}
+
+			resp, err := ea.Check(context.Background(), request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status.Code != tt.wantCode {
+				t.Fatalf("code = %d (%s), want %d", resp.Status.Code, resp.Status.Message, tt.wantCode)
+			}
+
+			switch response := resp.HttpResponse.(type) {
+			case *authZ.CheckResponse_OkResponse:
+				headers := make(map[string]string)
+				for _, h := range response.OkResponse.Headers {
+					headers[h.Header.Key] = h.Header.Value
+				}
+				if headers[appHeader] != tt.wantApp {
+					t.Errorf("%s = %q, want %q", appHeader, headers[appHeader], tt.wantApp)
+				}
+				if headers[usageHeader] != tt.wantUsage {
+					t.Errorf("%s = %q, want %q", usageHeader, headers[usageHeader], tt.wantUsage)
+				}
+			case *authZ.CheckResponse_DeniedResponse:
+				if tt.wantCode == 0 {
+					t.Fatal("unexpected denied response")
+				}
+				var status envoyType.StatusCode
+				if denied := response.DeniedResponse; denied != nil {
+					status = denied.Status.Code
+				}
+				if status != tt.wantStatus {
+					t.Errorf("status = %s, want %s", status, tt.wantStatus)
+				}
+			default:
+				t.Fatalf("unexpected response %T", resp.HttpResponse)
+			}
+		})
+	}
+}
+
+// accessLogStream replays access log messages to the access log service.
+type accessLogStream struct {
+	grpc.ServerStream
+	messages []*als.StreamAccessLogsMessage
+}
+
+func (s *accessLogStream) Recv() (*als.StreamAccessLogsMessage, error) {
+	if len(s.messages) == 0 {
+		return nil, io.EOF
+	}
+	msg := s.messages[0]
+	s.messages = s.messages[1:]
+	return msg, nil
+}
+
+func (s *accessLogStream) SendAndClose(*als.StreamAccessLogsResponse) error {
+	return nil
+}
+
+func TestCheckAccessLog(t *testing.T) {
+	fixture, err := fake_threescale.ParseFixture([]byte(checkFixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := fake_threescale.NewServer(fixture)
+	system := httptest.NewServer(fake)
+	defer system.Close()
+
+	backend := threescale_client.NewBackendClient(&http.Client{})
+	reporter := threescale_authorizer.NewReporter(backend, time.Hour, true)
+	var logs bytes.Buffer
+	writer := &accessLogWriter{out: &logs, pending: make(map[string]authorization)}
+	ea := envoyAuth{authorizer: threescale_authorizer.NewAuthorizer(newTestProxyCache(), backend, reporter), accessLogs: writer}
+
+	// Envoy sets the ID of the request attributes to its stream ID, the access log only has x-request-id.
+	resp, err := ea.Check(context.Background(), &authZ.CheckRequest{Attributes: &authZ.AttributeContext{
+		Request: &authZ.AttributeContext_Request{Http: &authZ.AttributeContext_HttpRequest{
+			Id:      "12345678901234567890",
+			Method:  "GET",
+			Path:    "/hello?app_id=app&app_key=app-key",
+			Host:    "echo-api.example.com",
+			Headers: map[string]string{"x-request-id": "4f6a5e1c-d5b4-4c0e-9f2a-6d7b8c9d0e1f"},
+		}},
+		ContextExtensions: map[string]string{"service_id": "1001", "system_url": system.URL + "/", "access_token": testAccessToken},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status.Code != 0 {
+		t.Fatalf("code = %d (%s), want 0", resp.Status.Code, resp.Status.Message)
+	}
+
+	stream := &accessLogStream{messages: []*als.StreamAccessLogsMessage{{
+		LogEntries: &als.StreamAccessLogsMessage_HttpLogs{HttpLogs: &als.StreamAccessLogsMessage_HTTPAccessLogEntries{
+			LogEntry: []*accessLogData.HTTPAccessLogEntry{{
+				Request: &accessLogData.HTTPRequestProperties{
+					RequestId:     "4f6a5e1c-d5b4-4c0e-9f2a-6d7b8c9d0e1f",
+					RequestMethod: core.GET,
+					Path:          "/hello?app_id=app&app_key=app-key",
+				},
+				Response: &accessLogData.HTTPResponseProperties{ResponseCode: &types.UInt32Value{Value: 200}},
+			}},
+		}},
+	}}}
+	if err := (&accessLogService{reporter: reporter, writer: writer}).StreamAccessLogs(stream); err != nil {
+		t.Fatal(err)
+	}
+
+	// Run flushes the pending batches once its context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	reporter.Run(ctx)
+
+	var reported []fake_threescale.Transaction
+	for _, transaction := range fake.Transactions() {
+		if transaction.Code != 0 {
+			reported = append(reported, transaction)
+		}
+	}
+	if len(reported) != 1 || reported[0].Code != 200 || reported[0].Request != "GET /hello" {
+		t.Errorf("reported transactions = %+v, want a single GET /hello with code 200", reported)
+	}
+
+	var entry accessLogEntry
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.ServiceID != "1001" || entry.AppID != "app" || entry.Decision != "authorized" {
+		t.Errorf("access log = %+v, want the service, application and decision of the check", entry)
+	}
+}
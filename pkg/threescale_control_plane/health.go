@@ -0,0 +1,40 @@
+package threescale_control_plane
+
+import (
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Names of the gRPC services whose health is reported, besides the overall server health.
+const (
+	authorizationServiceName = "envoy.service.auth.v2.Authorization"
+	rateLimitServiceName     = "envoy.service.ratelimit.v2.RateLimitService"
+	accessLogServiceName     = "envoy.service.accesslog.v2.AccessLogService"
+	discoveryServiceName     = "envoy.service.discovery.v2.AggregatedDiscoveryService"
+)
+
+// readiness reports the serving status of a gRPC server through the gRPC health checking protocol.
+// It starts as NOT_SERVING, until the server is marked as ready.
+type readiness struct {
+	server   *health.Server
+	services []string
+}
+
+func newReadiness(services ...string) *readiness {
+	r := &readiness{
+		server:   health.NewServer(),
+		services: append([]string{""}, services...),
+	}
+	r.setServing(false)
+	return r
+}
+
+func (r *readiness) setServing(serving bool) {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if serving {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	for _, s := range r.services {
+		r.server.SetServingStatus(s, status)
+	}
+}
@@ -0,0 +1,168 @@
+package threescale_control_plane
+
+import (
+	"fmt"
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/cluster"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/gogo/protobuf/types"
+	"time"
+)
+
+// Health check types.
+const (
+	HealthCheckHTTP = "http"
+	HealthCheckGRPC = "grpc"
+)
+
+const (
+	defaultHealthCheckInterval           = 10 * time.Second
+	defaultHealthCheckTimeout            = time.Second
+	defaultHealthCheckHealthyThreshold   = 1
+	defaultHealthCheckUnhealthyThreshold = 3
+	defaultHealthCheckPath               = "/"
+)
+
+// HealthCheckConfig configures the active health checking of the API backends of a service.
+type HealthCheckConfig struct {
+	// Type is either "http" (default) or "grpc".
+	Type string `json:"type"`
+	// Path requested by HTTP health checks, "/" by default.
+	Path string `json:"path"`
+	// ServiceName sent in gRPC health checks, empty by default to check the whole server.
+	ServiceName        string   `json:"service_name"`
+	Interval           Duration `json:"interval"`
+	Timeout            Duration `json:"timeout"`
+	HealthyThreshold   uint32   `json:"healthy_threshold"`
+	UnhealthyThreshold uint32   `json:"unhealthy_threshold"`
+}
+
+// OutlierDetectionConfig configures the passive ejection of misbehaving API backend hosts.
+// Fields left empty use the Envoy defaults.
+type OutlierDetectionConfig struct {
+	Consecutive5xx     uint32   `json:"consecutive_5xx"`
+	Interval           Duration `json:"interval"`
+	BaseEjectionTime   Duration `json:"base_ejection_time"`
+	MaxEjectionPercent uint32   `json:"max_ejection_percent"`
+}
+
+// CircuitBreakersConfig configures the limits of the connections and requests sent to the API backends.
+// Fields left empty use the Envoy defaults.
+type CircuitBreakersConfig struct {
+	MaxConnections     uint32 `json:"max_connections"`
+	MaxPendingRequests uint32 `json:"max_pending_requests"`
+	MaxRequests        uint32 `json:"max_requests"`
+	MaxRetries         uint32 `json:"max_retries"`
+}
+
+func (h *HealthCheckConfig) validate() error {
+	switch h.Type {
+	case "", HealthCheckHTTP, HealthCheckGRPC:
+	default:
+		return fmt.Errorf("unknown health check type %q", h.Type)
+	}
+	if h.Timeout.Duration > 0 && h.Interval.Duration > 0 && h.Timeout.Duration > h.Interval.Duration {
+		return fmt.Errorf("health check timeout is longer than its interval")
+	}
+	return nil
+}
+
+// healthCheck returns the Envoy health check for the config, filling in the defaults.
+func (h *HealthCheckConfig) healthCheck() *core.HealthCheck {
+	interval := durationOrDefault(h.Interval, defaultHealthCheckInterval)
+	timeout := durationOrDefault(h.Timeout, defaultHealthCheckTimeout)
+
+	hc := &core.HealthCheck{
+		Interval:           &interval,
+		Timeout:            &timeout,
+		HealthyThreshold:   &types.UInt32Value{Value: uint32OrDefault(h.HealthyThreshold, defaultHealthCheckHealthyThreshold)},
+		UnhealthyThreshold: &types.UInt32Value{Value: uint32OrDefault(h.UnhealthyThreshold, defaultHealthCheckUnhealthyThreshold)},
+	}
+
+	if h.Type == HealthCheckGRPC {
+		hc.HealthChecker = &core.HealthCheck_GrpcHealthCheck_{
+			GrpcHealthCheck: &core.HealthCheck_GrpcHealthCheck{
+				ServiceName: h.ServiceName,
+			},
+		}
+	} else {
+		path := h.Path
+		if path == "" {
+			path = defaultHealthCheckPath
+		}
+		hc.HealthChecker = &core.HealthCheck_HttpHealthCheck_{
+			HttpHealthCheck: &core.HealthCheck_HttpHealthCheck{
+				Path: path,
+			},
+		}
+	}
+	return hc
+}
+
+func (o *OutlierDetectionConfig) outlierDetection() *cluster.OutlierDetection {
+	return &cluster.OutlierDetection{
+		Consecutive_5Xx:    uint32Value(o.Consecutive5xx),
+		Interval:           durationValue(o.Interval),
+		BaseEjectionTime:   durationValue(o.BaseEjectionTime),
+		MaxEjectionPercent: uint32Value(o.MaxEjectionPercent),
+	}
+}
+
+func (c *CircuitBreakersConfig) circuitBreakers() *cluster.CircuitBreakers {
+	return &cluster.CircuitBreakers{
+		Thresholds: []*cluster.CircuitBreakers_Thresholds{{
+			Priority:           core.RoutingPriority_DEFAULT,
+			MaxConnections:     uint32Value(c.MaxConnections),
+			MaxPendingRequests: uint32Value(c.MaxPendingRequests),
+			MaxRequests:        uint32Value(c.MaxRequests),
+			MaxRetries:         uint32Value(c.MaxRetries),
+		}},
+	}
+}
+
+// applyClusterHealth sets the health checking, outlier detection and circuit breakers of a service on one of its clusters.
+func (s ServiceConfig) applyClusterHealth(c *v2.Cluster) {
+	if s.HealthCheck != nil {
+		c.HealthChecks = []*core.HealthCheck{s.HealthCheck.healthCheck()}
+		if s.HealthCheck.Type == HealthCheckGRPC {
+			// gRPC health checks are only supported over HTTP/2.
+			c.Http2ProtocolOptions = &core.Http2ProtocolOptions{}
+		}
+	}
+	if s.OutlierDetection != nil {
+		c.OutlierDetection = s.OutlierDetection.outlierDetection()
+	}
+	if s.CircuitBreakers != nil {
+		c.CircuitBreakers = s.CircuitBreakers.circuitBreakers()
+	}
+}
+
+func durationOrDefault(d Duration, def time.Duration) time.Duration {
+	if d.Duration <= 0 {
+		return def
+	}
+	return d.Duration
+}
+
+func uint32OrDefault(v uint32, def uint32) uint32 {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+// durationValue returns nil for empty durations, so Envoy uses its own default.
+func durationValue(d Duration) *types.Duration {
+	if d.Duration <= 0 {
+		return nil
+	}
+	return types.DurationProto(d.Duration)
+}
+
+// uint32Value returns nil for empty values, so Envoy uses its own default.
+func uint32Value(v uint32) *types.UInt32Value {
+	if v == 0 {
+		return nil
+	}
+	return &types.UInt32Value{Value: v}
+}
@@ -0,0 +1,73 @@
+package threescale_control_plane
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+const metricsNamespace = "threescale_envoy"
+
+var (
+	xdsResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "xds_responses_total",
+		Help:      "Discovery responses sent to Envoy.",
+	}, []string{"node", "type_url"})
+	xdsAcks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "xds_acks_total",
+		Help:      "Discovery responses accepted by Envoy.",
+	}, []string{"node", "type_url"})
+	xdsNacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "xds_nacks_total",
+		Help:      "Discovery responses rejected by Envoy.",
+	}, []string{"node", "type_url"})
+	xdsRejected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "xds_rejected",
+		Help:      "Whether the last discovery response of a resource type was rejected by Envoy (1) or not (0).",
+	}, []string{"node", "type_url"})
+	xdsRollbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "xds_rollbacks_total",
+		Help:      "Snapshots rolled back to the last one accepted by Envoy.",
+	}, []string{"node"})
+)
+
+func init() {
+	prometheus.MustRegister(xdsResponses, xdsAcks, xdsNacks, xdsRejected, xdsRollbacks)
+}
+
+// deleteNodeMetrics drops the series of a node that is gone, so they are not exported forever.
+func deleteNodeMetrics(node string) {
+	for _, typ := range resourceTypes {
+		xdsResponses.DeleteLabelValues(node, typ)
+		xdsAcks.DeleteLabelValues(node, typ)
+		xdsNacks.DeleteLabelValues(node, typ)
+		xdsRejected.DeleteLabelValues(node, typ)
+	}
+	xdsRollbacks.DeleteLabelValues(node)
+}
+
+// RunMetricsServer serves the Prometheus metrics of the control plane on /metrics.
+func RunMetricsServer(ctx context.Context, port uint) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Infof("Starting Metrics Server on Port %d", port)
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Metrics server stopped: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	if err := server.Shutdown(context.Background()); err != nil {
+		log.Error(err)
+	}
+}
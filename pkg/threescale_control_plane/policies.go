@@ -0,0 +1,411 @@
+package threescale_control_plane
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	rbacFilter "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/rbac/v2"
+	rbac "github.com/envoyproxy/go-control-plane/envoy/config/rbac/v2alpha"
+	"github.com/envoyproxy/go-control-plane/pkg/util"
+	"github.com/gogo/protobuf/types"
+	logger "github.com/sirupsen/logrus"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// rbacFilterName is the name of the Envoy HTTP RBAC filter, not part of the well known names yet.
+const rbacFilterName = "envoy.filters.http.rbac"
+
+// APIcast policies translated to Envoy.
+const (
+	policyAPIcast      = "apicast"
+	policyCORS         = "cors"
+	policyHeaders      = "headers"
+	policyURLRewriting = "url_rewriting"
+	policyIPCheck      = "ip_check"
+	policyUpstream     = "upstream"
+)
+
+// policyConfig is an APIcast policy of the policy chain of a service.
+type policyConfig struct {
+	Name          string          `json:"name"`
+	Version       string          `json:"version"`
+	Configuration json.RawMessage `json:"configuration"`
+}
+
+type corsPolicyConfig struct {
+	AllowHeaders     []string `json:"allow_headers"`
+	AllowMethods     []string `json:"allow_methods"`
+	AllowOrigin      string   `json:"allow_origin"`
+	AllowCredentials *bool    `json:"allow_credentials"`
+	MaxAge           int      `json:"max_age"`
+}
+
+type headerCommand struct {
+	Op        string `json:"op"`
+	Header    string `json:"header"`
+	Value     string `json:"value"`
+	ValueType string `json:"value_type"`
+}
+
+type headersPolicyConfig struct {
+	Request  []headerCommand `json:"request"`
+	Response []headerCommand `json:"response"`
+}
+
+type rewriteCommand struct {
+	Op      string   `json:"op"`
+	Regex   string   `json:"regex"`
+	Replace string   `json:"replace"`
+	Methods []string `json:"methods"`
+}
+
+type urlRewritingPolicyConfig struct {
+	Commands          []rewriteCommand  `json:"commands"`
+	QueryArgsCommands []json.RawMessage `json:"query_args_commands"`
+}
+
+type ipCheckPolicyConfig struct {
+	IPs             []string `json:"ips"`
+	CheckType       string   `json:"check_type"`
+	ClientIPSources []string `json:"client_ip_sources"`
+}
+
+type upstreamRule struct {
+	Regex string `json:"regex"`
+	URL   string `json:"url"`
+}
+
+type upstreamPolicyConfig struct {
+	Rules []upstreamRule `json:"rules"`
+}
+
+// servicePolicies is the Envoy equivalent of the policy chain of a service.
+type servicePolicies struct {
+	cors                    *route.CorsPolicy
+	requestHeadersToAdd     []*core.HeaderValueOption
+	requestHeadersToRemove  []string
+	responseHeadersToAdd    []*core.HeaderValueOption
+	responseHeadersToRemove []string
+	rbac                    *rbac.RBAC
+	// upstreams and rewrites are routed before the backends, in that order.
+	rewrites  []prefixRewrite
+	upstreams []upstreamOverride
+}
+
+// prefixRewrite replaces the path prefix of the requests matching it, before they are routed to a backend.
+type prefixRewrite struct {
+	prefix  string
+	replace string
+}
+
+// upstreamOverride sends the requests whose path matches regex to url instead of the API backend.
+type upstreamOverride struct {
+	regex string
+	url   *url.URL
+}
+
+// literalPrefixRegex matches the regexes that only anchor a literal path prefix, like "^/v1/".
+var literalPrefixRegex = regexp.MustCompile(`^\^/[a-zA-Z0-9/_~\-]*$`)
+
+// translatePolicies converts the policy chain of a service to Envoy features. Policies, or parts of them,
+// without an Envoy equivalent are logged and ignored.
+func translatePolicies(serviceID string, chain []policyConfig) servicePolicies {
+	var p servicePolicies
+	for _, policy := range chain {
+		entry := log.WithField("service", serviceID).WithField("policy", policy.Name)
+
+		var err error
+		switch policy.Name {
+		case policyAPIcast:
+			// The default APIcast policy, authorization is done by the External AuthZ service.
+		case policyCORS:
+			err = p.addCORS(policy.Configuration)
+		case policyHeaders:
+			err = p.addHeaders(policy.Configuration, entry)
+		case policyURLRewriting:
+			err = p.addURLRewriting(policy.Configuration, entry)
+		case policyIPCheck:
+			err = p.addIPCheck(policy.Configuration, entry)
+		case policyUpstream:
+			err = p.addUpstream(policy.Configuration, entry)
+		default:
+			entry.Warn("Unsupported APIcast policy, ignoring it")
+		}
+		if err != nil {
+			entry.Warnf("Invalid APIcast policy configuration, ignoring it: %v", err)
+		}
+	}
+	return p
+}
+
+func (p *servicePolicies) addCORS(configuration json.RawMessage) error {
+	var c corsPolicyConfig
+	if err := decodePolicy(configuration, &c); err != nil {
+		return err
+	}
+
+	origin := c.AllowOrigin
+	if origin == "" {
+		origin = "*"
+	}
+	p.cors = &route.CorsPolicy{
+		AllowOrigin:  []string{origin},
+		AllowMethods: strings.Join(c.AllowMethods, ","),
+		AllowHeaders: strings.Join(c.AllowHeaders, ","),
+	}
+	if c.MaxAge > 0 {
+		p.cors.MaxAge = strconv.Itoa(c.MaxAge)
+	}
+	if c.AllowCredentials != nil {
+		p.cors.AllowCredentials = &types.BoolValue{Value: *c.AllowCredentials}
+	}
+	return nil
+}
+
+func (p *servicePolicies) addHeaders(configuration json.RawMessage, entry *logger.Entry) error {
+	var c headersPolicyConfig
+	if err := decodePolicy(configuration, &c); err != nil {
+		return err
+	}
+
+	p.requestHeadersToAdd, p.requestHeadersToRemove = headerOptions(c.Request, p.requestHeadersToAdd, p.requestHeadersToRemove, entry)
+	p.responseHeadersToAdd, p.responseHeadersToRemove = headerOptions(c.Response, p.responseHeadersToAdd, p.responseHeadersToRemove, entry)
+	return nil
+}
+
+func headerOptions(commands []headerCommand, add []*core.HeaderValueOption, remove []string, entry *logger.Entry) ([]*core.HeaderValueOption, []string) {
+	for _, cmd := range commands {
+		if cmd.ValueType == "liquid" {
+			entry.Warnf("Unsupported liquid value for header %s, ignoring it", cmd.Header)
+			continue
+		}
+		switch cmd.Op {
+		case "set":
+			add = append(add, &core.HeaderValueOption{
+				Header: &core.HeaderValue{Key: cmd.Header, Value: cmd.Value},
+				Append: &types.BoolValue{Value: false},
+			})
+		case "push", "add":
+			add = append(add, &core.HeaderValueOption{
+				Header: &core.HeaderValue{Key: cmd.Header, Value: cmd.Value},
+				Append: &types.BoolValue{Value: true},
+			})
+		case "delete":
+			remove = append(remove, cmd.Header)
+		default:
+			entry.Warnf("Unsupported header operation %q, ignoring it", cmd.Op)
+		}
+	}
+	return add, remove
+}
+
+// addURLRewriting translates the substitutions of literal path prefixes, Envoy can't rewrite paths with regexes.
+func (p *servicePolicies) addURLRewriting(configuration json.RawMessage, entry *logger.Entry) error {
+	var c urlRewritingPolicyConfig
+	if err := decodePolicy(configuration, &c); err != nil {
+		return err
+	}
+
+	for _, cmd := range c.Commands {
+		if !literalPrefixRegex.MatchString(cmd.Regex) || strings.ContainsAny(cmd.Replace, "$%") || len(cmd.Methods) > 0 {
+			entry.Warnf("Unsupported rewrite of %q, only literal path prefixes like \"^/v1/\" can be rewritten, ignoring it", cmd.Regex)
+			continue
+		}
+		p.rewrites = append(p.rewrites, prefixRewrite{prefix: strings.TrimPrefix(cmd.Regex, "^"), replace: cmd.Replace})
+	}
+	if len(c.QueryArgsCommands) > 0 {
+		entry.Warn("Unsupported query arguments rewriting, ignoring it")
+	}
+	return nil
+}
+
+func (p *servicePolicies) addIPCheck(configuration json.RawMessage, entry *logger.Entry) error {
+	var c ipCheckPolicyConfig
+	if err := decodePolicy(configuration, &c); err != nil {
+		return err
+	}
+
+	action := rbac.RBAC_ALLOW
+	switch c.CheckType {
+	case "whitelist":
+	case "blacklist":
+		action = rbac.RBAC_DENY
+	default:
+		return fmt.Errorf("unknown check_type %q", c.CheckType)
+	}
+
+	for _, source := range c.ClientIPSources {
+		if source != "last_caller" {
+			entry.Warnf("Unsupported client IP source %q, the IP of the downstream connection is checked", source)
+		}
+	}
+
+	// An RBAC policy needs at least one principal. Without IPs, a blacklist denies nothing and a whitelist
+	// allows nothing, which is an ALLOW rule without policies.
+	if len(c.IPs) == 0 {
+		if action == rbac.RBAC_DENY {
+			entry.Warn("Empty IP blacklist, ignoring it")
+			return nil
+		}
+		entry.Warn("Empty IP whitelist, every request is denied")
+		p.rbac = &rbac.RBAC{Action: rbac.RBAC_ALLOW}
+		return nil
+	}
+
+	principals := make([]*rbac.Principal, 0, len(c.IPs))
+	for _, ip := range c.IPs {
+		cidr, err := cidrRange(ip)
+		if err != nil {
+			return err
+		}
+		principals = append(principals, &rbac.Principal{
+			Identifier: &rbac.Principal_SourceIp{SourceIp: cidr},
+		})
+	}
+
+	p.rbac = &rbac.RBAC{
+		Action: action,
+		Policies: map[string]*rbac.Policy{
+			policyIPCheck: {
+				Permissions: []*rbac.Permission{{Rule: &rbac.Permission_Any{Any: true}}},
+				Principals:  principals,
+			},
+		},
+	}
+	return nil
+}
+
+func (p *servicePolicies) addUpstream(configuration json.RawMessage, entry *logger.Entry) error {
+	var c upstreamPolicyConfig
+	if err := decodePolicy(configuration, &c); err != nil {
+		return err
+	}
+
+	for _, rule := range c.Rules {
+		if _, err := regexp.Compile(rule.Regex); err != nil {
+			return err
+		}
+		u, err := url.Parse(rule.URL)
+		if err != nil {
+			return err
+		}
+		if u.Hostname() == "" {
+			return fmt.Errorf("invalid upstream url %q", rule.URL)
+		}
+		if strings.TrimSuffix(u.Path, "/") != "" {
+			entry.Warnf("Unsupported path in upstream url %q, the path of the request is kept", rule.URL)
+		}
+		p.upstreams = append(p.upstreams, upstreamOverride{regex: rule.Regex, url: u})
+	}
+	return nil
+}
+
+// newRoutes returns the routes of the upstream overrides and path rewrites, to be matched before the
+// routes of the backends. Rewritten paths are sent to the backend mounted at the replacement prefix.
+func (p *servicePolicies) newRoutes(backends []backend, clusterFor func(u *url.URL) string) []route.Route {
+	var routes []route.Route
+	for _, o := range p.upstreams {
+		routes = append(routes, newClusterRoute(
+			route.RouteMatch{PathSpecifier: &route.RouteMatch_Regex{Regex: regexMatch(o.regex)}},
+			clusterFor(o.url), o.url.Hostname(), ""))
+	}
+
+	for _, r := range p.rewrites {
+		b := backendFor(backends, r.replace)
+		if b == nil {
+			continue
+		}
+		rest := r.replace
+		if b.mountPath != "/" {
+			rest = strings.TrimPrefix(r.replace, b.mountPath)
+		}
+		rewrite := strings.TrimSuffix(b.url.Path, "/") + rest
+		if rewrite == "" {
+			rewrite = "/"
+		}
+		routes = append(routes, newClusterRoute(
+			route.RouteMatch{PathSpecifier: &route.RouteMatch_Prefix{Prefix: r.prefix}},
+			clusterFor(b.url), b.url.Hostname(), rewrite))
+	}
+	return routes
+}
+
+// backendFor returns the backend a path is routed to, backends are ordered by the longest mount path first.
+func backendFor(backends []backend, path string) *backend {
+	for i, b := range backends {
+		if b.mountPath == "/" || path == b.mountPath || strings.HasPrefix(path, b.mountPath+"/") {
+			return &backends[i]
+		}
+	}
+	return nil
+}
+
+// apply sets the policies of the whole service on its virtual host.
+func (p *servicePolicies) apply(v *route.VirtualHost) error {
+	v.Cors = p.cors
+	v.RequestHeadersToAdd = p.requestHeadersToAdd
+	v.RequestHeadersToRemove = append(v.RequestHeadersToRemove, p.requestHeadersToRemove...)
+	v.ResponseHeadersToAdd = p.responseHeadersToAdd
+	v.ResponseHeadersToRemove = p.responseHeadersToRemove
+
+	if p.rbac != nil {
+		// The per filter configs are opaque to the snapshot validation, so the RBAC rules are validated here.
+		perRoute := &rbacFilter.RBACPerRoute{Rbac: &rbacFilter.RBAC{Rules: p.rbac}}
+		if err := perRoute.Validate(); err != nil {
+			return fmt.Errorf("invalid ip check: %v", err)
+		}
+		rbacConf, err := util.MessageToStruct(perRoute)
+		if err != nil {
+			return err
+		}
+		v.PerFilterConfig[rbacFilterName] = rbacConf
+	}
+	return nil
+}
+
+// regexMatch converts an APIcast path regex, which matches any part of the path, to an Envoy route
+// regex, which must match the whole path.
+func regexMatch(regex string) string {
+	if strings.HasPrefix(regex, "^") {
+		regex = regex[1:]
+	} else {
+		regex = ".*" + regex
+	}
+	if strings.HasSuffix(regex, "$") && !strings.HasSuffix(regex, `\$`) {
+		return regex[:len(regex)-1]
+	}
+	return regex + ".*"
+}
+
+func cidrRange(ip string) (*core.CidrRange, error) {
+	if !strings.Contains(ip, "/") {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return nil, fmt.Errorf("invalid IP %q", ip)
+		}
+		prefixLen := 32
+		if parsed.To4() == nil {
+			prefixLen = 128
+		}
+		return &core.CidrRange{AddressPrefix: ip, PrefixLen: &types.UInt32Value{Value: uint32(prefixLen)}}, nil
+	}
+
+	addr, network, err := net.ParseCIDR(ip)
+	if err != nil {
+		return nil, err
+	}
+	prefixLen, _ := network.Mask.Size()
+	return &core.CidrRange{AddressPrefix: addr.String(), PrefixLen: &types.UInt32Value{Value: uint32(prefixLen)}}, nil
+}
+
+func decodePolicy(configuration json.RawMessage, v interface{}) error {
+	if len(configuration) == 0 {
+		return nil
+	}
+	return json.Unmarshal(configuration, v)
+}
@@ -0,0 +1,70 @@
+package threescale_control_plane
+
+import (
+	"encoding/json"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	rbac "github.com/envoyproxy/go-control-plane/envoy/config/rbac/v2alpha"
+	"github.com/gogo/protobuf/types"
+	"testing"
+)
+
+func TestIPCheckPolicy(t *testing.T) {
+	tests := []struct {
+		name          string
+		configuration string
+		wantRBAC      bool
+		wantAction    rbac.RBAC_Action
+		wantPolicies  int
+	}{
+		{
+			name:          "whitelist",
+			configuration: `{"check_type": "whitelist", "ips": ["10.0.0.0/8", "192.168.1.1"]}`,
+			wantRBAC:      true,
+			wantAction:    rbac.RBAC_ALLOW,
+			wantPolicies:  1,
+		},
+		{
+			name:          "blacklist",
+			configuration: `{"check_type": "blacklist", "ips": ["10.0.0.1"]}`,
+			wantRBAC:      true,
+			wantAction:    rbac.RBAC_DENY,
+			wantPolicies:  1,
+		},
+		{
+			name:          "empty whitelist denies every request",
+			configuration: `{"check_type": "whitelist", "ips": []}`,
+			wantRBAC:      true,
+			wantAction:    rbac.RBAC_ALLOW,
+		},
+		{
+			name:          "empty blacklist is ignored",
+			configuration: `{"check_type": "blacklist"}`,
+		},
+		{
+			name:          "invalid IP is ignored",
+			configuration: `{"check_type": "whitelist", "ips": ["not an ip"]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := translatePolicies("1", []policyConfig{{Name: policyIPCheck, Configuration: json.RawMessage(tt.configuration)}})
+			if (p.rbac != nil) != tt.wantRBAC {
+				t.Fatalf("rbac = %v, want rbac %t", p.rbac, tt.wantRBAC)
+			}
+			if p.rbac != nil {
+				if p.rbac.Action != tt.wantAction || len(p.rbac.Policies) != tt.wantPolicies {
+					t.Errorf("rbac = %v, want %s with %d policies", p.rbac, tt.wantAction, tt.wantPolicies)
+				}
+			}
+
+			v := route.VirtualHost{PerFilterConfig: map[string]*types.Struct{}}
+			if err := p.apply(&v); err != nil {
+				t.Fatalf("invalid RBAC configuration: %v", err)
+			}
+			if _, ok := v.PerFilterConfig[rbacFilterName]; ok != tt.wantRBAC {
+				t.Errorf("RBAC filter configured = %t, want %t", ok, tt.wantRBAC)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package threescale_control_plane
+
+import (
+	"fmt"
+	sysC "github.com/3scale/3scale-porta-go-client/client"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// productConfig holds the parts of a proxy config that the 3scale client doesn't decode: the API
+// backends composing a 3scale product (API as a Product), each one mounted at its own path, and
+// the configuration of the APIcast policies.
+type productConfig struct {
+	ProxyConfig struct {
+		Content struct {
+			BackendAPIConfigs []backendAPIConfig `json:"backend_api_configs"`
+			Proxy             struct {
+				PolicyChain []policyConfig `json:"policy_chain"`
+			} `json:"proxy"`
+		} `json:"content"`
+	} `json:"proxy_config"`
+}
+
+type backendAPIConfig struct {
+	Path       string `json:"path"`
+	BackendAPI struct {
+		SystemName      string `json:"system_name"`
+		PrivateEndpoint string `json:"private_endpoint"`
+	} `json:"backend_api"`
+}
+
+// backend is an API backend mounted at a path of the public endpoint of a service.
+type backend struct {
+	mountPath string
+	url       *url.URL
+}
+
+// serviceBackends returns the API backends of a service, ordered by the longest mount path first so
+// the generated routes match the most specific backend. Services that are not composed of several
+// backends have a single one mounted at "/".
+func serviceBackends(product productConfig, proxyConf sysC.ProxyConfigElement) ([]backend, error) {
+	configs := product.ProxyConfig.Content.BackendAPIConfigs
+	if len(configs) == 0 {
+		apiBackendURL, err := url.Parse(proxyConf.ProxyConfig.Content.Proxy.APIBackend)
+		if err != nil {
+			return nil, err
+		}
+		return []backend{{mountPath: "/", url: apiBackendURL}}, nil
+	}
+
+	backends := make([]backend, 0, len(configs))
+	for _, config := range configs {
+		backendURL, err := url.Parse(config.BackendAPI.PrivateEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %v", config.BackendAPI.SystemName, err)
+		}
+		backends = append(backends, backend{mountPath: cleanMountPath(config.Path), url: backendURL})
+	}
+
+	sort.SliceStable(backends, func(i, j int) bool {
+		return len(backends[i].mountPath) > len(backends[j].mountPath)
+	})
+	return backends, nil
+}
+
+// newBackendRoutes returns the routes sending the requests under the mount path of a backend to its
+// cluster, replacing the mount path with the private base path of the backend.
+func (c *ThreescaleConfig) newBackendRoutes(clusterName string, b backend) []route.Route {
+	privatePath := strings.TrimSuffix(b.url.Path, "/")
+
+	newRoute := func(match route.RouteMatch, prefixRewrite string) route.Route {
+		return newClusterRoute(match, clusterName, b.url.Hostname(), prefixRewrite)
+	}
+
+	if b.mountPath == "/" {
+		var rewrite string
+		if privatePath != "" {
+			rewrite = privatePath + "/"
+		}
+		return []route.Route{newRoute(route.RouteMatch{PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/"}}, rewrite)}
+	}
+
+	// The mount path only matches whole path segments, "/foo" matches "/foo" and "/foo/bar" but not "/foobar".
+	exactRewrite := privatePath
+	if exactRewrite == "" {
+		exactRewrite = "/"
+	}
+	return []route.Route{
+		newRoute(route.RouteMatch{PathSpecifier: &route.RouteMatch_Path{Path: b.mountPath}}, exactRewrite),
+		newRoute(route.RouteMatch{PathSpecifier: &route.RouteMatch_Prefix{Prefix: b.mountPath + "/"}}, privatePath+"/"),
+	}
+}
+
+func newClusterRoute(match route.RouteMatch, clusterName, hostRewrite, prefixRewrite string) route.Route {
+	return route.Route{
+		Match: match,
+		Action: &route.Route_Route{
+			Route: &route.RouteAction{
+				ClusterSpecifier: &route.RouteAction_Cluster{
+					Cluster: clusterName,
+				},
+				HostRewriteSpecifier: &route.RouteAction_HostRewrite{
+					HostRewrite: hostRewrite,
+				},
+				PrefixRewrite: prefixRewrite,
+			},
+		},
+	}
+}
+
+// cleanMountPath normalizes a backend mount path to start with a slash and have no trailing slash.
+func cleanMountPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// mountPaths returns the mount paths of the backends, in the same order.
+func mountPaths(backends []backend) []string {
+	paths := make([]string, 0, len(backends))
+	for _, b := range backends {
+		paths = append(paths, b.mountPath)
+	}
+	return paths
+}
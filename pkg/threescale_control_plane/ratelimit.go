@@ -0,0 +1,299 @@
+package threescale_control_plane
+
+import (
+	"context"
+	"fmt"
+	backendC "github.com/3scale/3scale-go-client/client"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/ratelimit"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	rateLimitFilter "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/rate_limit/v2"
+	rateLimitConfig "github.com/envoyproxy/go-control-plane/envoy/config/ratelimit/v2"
+	rls "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v2"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rateLimitDomain = "3scale"
+
+	// Request headers set by the External AuthZ service on authorized requests, used as rate limit
+	// descriptors and removed before the request is sent upstream.
+	appHeader   = "x-3scale-app"
+	usageHeader = "x-3scale-usage"
+
+	// maxRateLimitCounters is the number of counters kept before the expired ones are removed.
+	maxRateLimitCounters = 10000
+	// maxAppLimits is the number of applications whose limits are kept before the expired ones are removed.
+	maxAppLimits = 10000
+	// appLimitsTTL is how long the limits of an application are kept once it stops being authorized.
+	appLimitsTTL = 10 * time.Minute
+)
+
+var rateLimitUnits = map[string]rls.RateLimitResponse_RateLimit_Unit{
+	"second": rls.RateLimitResponse_RateLimit_SECOND,
+	"minute": rls.RateLimitResponse_RateLimit_MINUTE,
+	"hour":   rls.RateLimitResponse_RateLimit_HOUR,
+	"day":    rls.RateLimitResponse_RateLimit_DAY,
+}
+
+var unitSeconds = map[rls.RateLimitResponse_RateLimit_Unit]int64{
+	rls.RateLimitResponse_RateLimit_SECOND: 1,
+	rls.RateLimitResponse_RateLimit_MINUTE: 60,
+	rls.RateLimitResponse_RateLimit_HOUR:   3600,
+	rls.RateLimitResponse_RateLimit_DAY:    86400,
+}
+
+// RateLimitConfig limits the usage of a metric by each application of a service.
+type RateLimitConfig struct {
+	Metric string `json:"metric"`
+	// Unit is "second", "minute", "hour" or "day".
+	Unit            string `json:"unit"`
+	RequestsPerUnit uint32 `json:"requests_per_unit"`
+}
+
+func (r *RateLimitConfig) validate() error {
+	if r.Metric == "" {
+		return fmt.Errorf("rate limit without metric")
+	}
+	if _, ok := rateLimitUnits[r.Unit]; !ok {
+		return fmt.Errorf("unknown rate limit unit %q", r.Unit)
+	}
+	if r.RequestsPerUnit == 0 {
+		return fmt.Errorf("rate limit of metric %s without requests_per_unit", r.Metric)
+	}
+	return nil
+}
+
+type metricLimit struct {
+	unit            rls.RateLimitResponse_RateLimit_Unit
+	requestsPerUnit uint32
+}
+
+type appLimitsKey struct {
+	service, app string
+}
+
+// appLimits are the limits learnt from the usage reports of an application, until they expire.
+type appLimits struct {
+	metrics map[string][]metricLimit
+	expires time.Time
+}
+
+type counterKey struct {
+	service, app, metric string
+	unit                 rls.RateLimitResponse_RateLimit_Unit
+}
+
+type counter struct {
+	window int64
+	hits   uint32
+}
+
+// rateLimiter implements the Envoy rate limit service, enforcing short window limits locally before
+// 3scale backend is reached. The limits are either configured per service, or learnt from the usage
+// reports of each application returned by 3scale backend.
+type rateLimiter struct {
+	sync.Mutex
+	serviceLimits map[string]map[string][]metricLimit
+	appLimits     map[appLimitsKey]appLimits
+	counters      map[counterKey]*counter
+	now           func() time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		serviceLimits: make(map[string]map[string][]metricLimit),
+		appLimits:     make(map[appLimitsKey]appLimits),
+		counters:      make(map[counterKey]*counter),
+		now:           time.Now,
+	}
+}
+
+// setServiceLimits replaces the limits configured for every application of a service.
+func (r *rateLimiter) setServiceLimits(service string, limits []RateLimitConfig) {
+	metrics := make(map[string][]metricLimit)
+	for _, l := range limits {
+		metrics[l.Metric] = append(metrics[l.Metric], metricLimit{unit: rateLimitUnits[l.Unit], requestsPerUnit: l.RequestsPerUnit})
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.serviceLimits[service] = metrics
+}
+
+// setAppLimits replaces the limits of an application with the ones of its usage reports. Only the
+// periods that fit a rate limit unit are enforced locally, longer ones are left to 3scale backend.
+// The limits expire when the application is not authorized again within appLimitsTTL.
+func (r *rateLimiter) setAppLimits(service, app string, reports backendC.UsageReports) {
+	metrics := make(map[string][]metricLimit)
+	for metric, report := range reports {
+		unit, ok := rateLimitUnits[string(report.Period)]
+		if !ok || report.MaxValue <= 0 {
+			continue
+		}
+		metrics[metric] = append(metrics[metric], metricLimit{unit: unit, requestsPerUnit: uint32(report.MaxValue)})
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if len(metrics) == 0 {
+		delete(r.appLimits, appLimitsKey{service, app})
+		return
+	}
+	now := r.now()
+	r.appLimits[appLimitsKey{service, app}] = appLimits{metrics: metrics, expires: now.Add(appLimitsTTL)}
+	if len(r.appLimits) > maxAppLimits {
+		r.removeExpiredAppLimits(now)
+	}
+}
+
+func (r *rateLimiter) ShouldRateLimit(ctx context.Context, req *rls.RateLimitRequest) (*rls.RateLimitResponse, error) {
+	resp := &rls.RateLimitResponse{OverallCode: rls.RateLimitResponse_OK}
+
+	r.Lock()
+	defer r.Unlock()
+
+	now := r.now()
+	for _, d := range req.Descriptors {
+		status := r.check(descriptorEntries(d.Entries), now)
+		if status.Code == rls.RateLimitResponse_OVER_LIMIT {
+			resp.OverallCode = rls.RateLimitResponse_OVER_LIMIT
+		}
+		resp.Statuses = append(resp.Statuses, status)
+	}
+
+	if len(r.counters) > maxRateLimitCounters {
+		r.removeExpiredCounters(now.Unix())
+	}
+	return resp, nil
+}
+
+// check counts the usage of a descriptor, returning the status of its most restrictive limit.
+func (r *rateLimiter) check(entries map[string]string, now time.Time) *rls.RateLimitResponse_DescriptorStatus {
+	status := &rls.RateLimitResponse_DescriptorStatus{Code: rls.RateLimitResponse_OK}
+
+	service, app := entries["generic_key"], entries["app"]
+	learnt, ok := r.appLimits[appLimitsKey{service, app}]
+	if ok && !now.Before(learnt.expires) {
+		learnt = appLimits{}
+	}
+	for metric, delta := range parseUsage(entries["usage"]) {
+		var limits []metricLimit
+		limits = append(limits, r.serviceLimits[service][metric]...)
+		limits = append(limits, learnt.metrics[metric]...)
+		for _, l := range limits {
+			key := counterKey{service: service, app: app, metric: metric, unit: l.unit}
+			c, ok := r.counters[key]
+			window := now.Unix() / unitSeconds[l.unit]
+			if !ok || c.window != window {
+				c = &counter{window: window}
+				r.counters[key] = c
+			}
+			c.hits += delta
+
+			overLimit := c.hits > l.requestsPerUnit
+			remaining := uint32(0)
+			if !overLimit {
+				remaining = l.requestsPerUnit - c.hits
+			}
+			// Report the first exceeded limit, or the one closest to be exceeded.
+			if status.CurrentLimit == nil || (status.Code == rls.RateLimitResponse_OK && (overLimit || remaining < status.LimitRemaining)) {
+				if overLimit {
+					status.Code = rls.RateLimitResponse_OVER_LIMIT
+				}
+				status.CurrentLimit = &rls.RateLimitResponse_RateLimit{RequestsPerUnit: l.requestsPerUnit, Unit: l.unit}
+				status.LimitRemaining = remaining
+			}
+		}
+	}
+	return status
+}
+
+func (r *rateLimiter) removeExpiredCounters(now int64) {
+	for key, c := range r.counters {
+		if c.window != now/unitSeconds[key.unit] {
+			delete(r.counters, key)
+		}
+	}
+}
+
+func (r *rateLimiter) removeExpiredAppLimits(now time.Time) {
+	for key, l := range r.appLimits {
+		if !now.Before(l.expires) {
+			delete(r.appLimits, key)
+		}
+	}
+}
+
+func descriptorEntries(entries []*ratelimit.RateLimitDescriptor_Entry) map[string]string {
+	m := make(map[string]string, len(entries))
+	for _, e := range entries {
+		m[e.Key] = e.Value
+	}
+	return m
+}
+
+// formatUsage encodes the metrics reported for a request as "metric=delta" pairs, sorted by metric.
+func formatUsage(usage backendC.Metrics) string {
+	pairs := make([]string, 0, len(usage))
+	for metric, delta := range usage {
+		pairs = append(pairs, metric+"="+strconv.Itoa(delta))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func parseUsage(s string) map[string]uint32 {
+	usage := make(map[string]uint32)
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		delta, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			continue
+		}
+		usage[parts[0]] += uint32(delta)
+	}
+	return usage
+}
+
+// newRateLimitFilter returns the config of the Envoy rate limit filter, calling the rate limit
+// service of the External AuthZ cluster.
+func newRateLimitFilter() *rateLimitFilter.RateLimit {
+	return &rateLimitFilter.RateLimit{
+		Domain: rateLimitDomain,
+		RateLimitService: &rateLimitConfig.RateLimitServiceConfig{
+			GrpcService: &core.GrpcService{
+				TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &core.GrpcService_EnvoyGrpc{
+						ClusterName: "extauthz",
+					},
+				},
+			},
+		},
+	}
+}
+
+// newRateLimits returns the rate limit descriptors of the routes of a service: the service, the
+// application and the usage of the request, as set by the External AuthZ service.
+func newRateLimits(service string) []*route.RateLimit {
+	return []*route.RateLimit{{
+		Actions: []*route.RateLimit_Action{
+			{ActionSpecifier: &route.RateLimit_Action_GenericKey_{
+				GenericKey: &route.RateLimit_Action_GenericKey{DescriptorValue: service},
+			}},
+			{ActionSpecifier: &route.RateLimit_Action_RequestHeaders_{
+				RequestHeaders: &route.RateLimit_Action_RequestHeaders{HeaderName: appHeader, DescriptorKey: "app"},
+			}},
+			{ActionSpecifier: &route.RateLimit_Action_RequestHeaders_{
+				RequestHeaders: &route.RateLimit_Action_RequestHeaders{HeaderName: usageHeader, DescriptorKey: "usage"},
+			}},
+		},
+	}}
+}
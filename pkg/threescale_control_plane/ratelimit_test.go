@@ -0,0 +1,52 @@
+package threescale_control_plane
+
+import (
+	"context"
+	backendC "github.com/3scale/3scale-go-client/client"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/ratelimit"
+	rls "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v2"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAppLimitsExpire(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := newRateLimiter()
+	r.now = func() time.Time { return now }
+
+	request := &rls.RateLimitRequest{Domain: rateLimitDomain, Descriptors: []*ratelimit.RateLimitDescriptor{{
+		Entries: []*ratelimit.RateLimitDescriptor_Entry{
+			{Key: "generic_key", Value: "test_1"},
+			{Key: "app", Value: "app"},
+			{Key: "usage", Value: "hits=1"},
+		},
+	}}}
+	check := func() rls.RateLimitResponse_Code {
+		resp, err := r.ShouldRateLimit(context.Background(), request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.OverallCode
+	}
+
+	r.setAppLimits("test_1", "app", backendC.UsageReports{"hits": {Period: "day", MaxValue: 1}})
+	if code := check(); code != rls.RateLimitResponse_OK {
+		t.Errorf("first request = %s, want OK", code)
+	}
+	if code := check(); code != rls.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("second request = %s, want OVER_LIMIT", code)
+	}
+
+	// The limits of an application that is not authorized anymore are forgotten.
+	now = now.Add(appLimitsTTL)
+	if code := check(); code != rls.RateLimitResponse_OK {
+		t.Errorf("request once the limits expired = %s, want OK", code)
+	}
+	for i := 0; i <= maxAppLimits; i++ {
+		r.setAppLimits("test_2", "app-"+strconv.Itoa(i), backendC.UsageReports{"hits": {Period: "day", MaxValue: 1}})
+	}
+	if _, ok := r.appLimits[appLimitsKey{"test_1", "app"}]; ok {
+		t.Error("expired application limits were not removed")
+	}
+}
@@ -0,0 +1,246 @@
+package threescale_control_plane
+
+import (
+	"3scale-envoy/pkg/logging"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	bootstrap "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v2"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/envoyproxy/go-control-plane/pkg/util"
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	"gopkg.in/yaml.v2"
+	"io"
+	"sort"
+)
+
+// renderedTypes names the resource types of a snapshot in the rendered documents.
+var renderedTypes = []struct {
+	name, typ string
+}{
+	{"clusters", cache.ClusterType},
+	{"endpoints", cache.EndpointType},
+	{"routes", cache.RouteType},
+	{"listeners", cache.ListenerType},
+}
+
+// LoadConfig fetches the configuration of every tenant once, without starting the control plane.
+func (ec *ControlPlane) LoadConfig() error {
+	if err := ec.setDefaultClients(); err != nil {
+		return err
+	}
+	for _, tenant := range ec.Tenants {
+		if _, err := tenant.GetConfig(ec.Source); err != nil {
+			return fmt.Errorf("tenant %s: %v", tenant.Name, err)
+		}
+	}
+	return nil
+}
+
+// Render writes the Envoy resources generated from the loaded configuration of the tenants, as "yaml"
+// or "json". With staticBootstrap, they are written as a complete bootstrap Envoy can run without xDS.
+// The credentials, like the access tokens of the External AuthZ context extensions, are redacted
+// unless showSecrets is set.
+func (ec *ControlPlane) Render(w io.Writer, format string, staticBootstrap, showSecrets bool) error {
+	snapshot, err := ec.newSnapshot()
+	if err != nil {
+		return err
+	}
+	if err := validateSnapshot(&snapshot); err != nil {
+		return fmt.Errorf("invalid Envoy configuration: %v", err)
+	}
+
+	var document interface{}
+	if staticBootstrap {
+		b, err := ec.newStaticBootstrap(&snapshot)
+		if err != nil {
+			return err
+		}
+		if document, err = messageDocument(b, showSecrets); err != nil {
+			return err
+		}
+	} else {
+		if document, err = snapshotDocument(&snapshot, showSecrets); err != nil {
+			return err
+		}
+	}
+	return writeDocument(w, format, document)
+}
+
+// snapshotDocument returns the resources of a snapshot grouped by type, each type ordered by name.
+func snapshotDocument(s *cache.Snapshot, showSecrets bool) (yaml.MapSlice, error) {
+	var document yaml.MapSlice
+	for _, t := range renderedTypes {
+		resources := s.GetResources(t.typ)
+		names := sortedNames(resources)
+		items := make([]interface{}, 0, len(names))
+		for _, name := range names {
+			item, err := messageDocument(resources[name], showSecrets)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		document = append(document, yaml.MapItem{Key: t.name, Value: items})
+	}
+	return document, nil
+}
+
+// newStaticBootstrap returns a bootstrap holding the resources of a snapshot, with the routes and the
+// endpoints inlined in the listeners and the clusters, as Envoy can't fetch them without xDS.
+func (ec *ControlPlane) newStaticBootstrap(s *cache.Snapshot) (*bootstrap.Bootstrap, error) {
+	b, err := ec.newBootstrapBase(DefaultNodeID, DefaultNodeCluster)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := s.GetResources(cache.EndpointType)
+	for _, name := range sortedNames(s.GetResources(cache.ClusterType)) {
+		cluster := *s.GetResources(cache.ClusterType)[name].(*v2.Cluster)
+		if cluster.GetType() == v2.Cluster_EDS {
+			loadAssignment, ok := endpoints[name].(*v2.ClusterLoadAssignment)
+			if !ok {
+				return nil, fmt.Errorf("cluster %s: missing endpoints", name)
+			}
+			cluster.ClusterDiscoveryType = &v2.Cluster_Type{Type: v2.Cluster_STATIC}
+			cluster.EdsClusterConfig = nil
+			cluster.LoadAssignment = loadAssignment
+		}
+		b.StaticResources.Clusters = append(b.StaticResources.Clusters, cluster)
+	}
+
+	routes := s.GetResources(cache.RouteType)
+	for _, name := range sortedNames(s.GetResources(cache.ListenerType)) {
+		l := *s.GetResources(cache.ListenerType)[name].(*v2.Listener)
+		chains := make([]listener.FilterChain, len(l.FilterChains))
+		copy(chains, l.FilterChains)
+		for i, chain := range chains {
+			filters := make([]listener.Filter, len(chain.Filters))
+			copy(filters, chain.Filters)
+			for j, filter := range filters {
+				if filter.Name != util.HTTPConnectionManager {
+					continue
+				}
+				config, err := inlineRoutes(filter.GetConfig(), routes)
+				if err != nil {
+					return nil, fmt.Errorf("listener %s: %v", name, err)
+				}
+				filters[j].ConfigType = &listener.Filter_Config{Config: config}
+			}
+			chains[i].Filters = filters
+		}
+		l.FilterChains = chains
+		b.StaticResources.Listeners = append(b.StaticResources.Listeners, l)
+	}
+	return b, nil
+}
+
+// inlineRoutes replaces the RDS route configuration of an HTTP connection manager by the route configuration itself.
+func inlineRoutes(config *types.Struct, routes map[string]cache.Resource) (*types.Struct, error) {
+	manager := &hcm.HttpConnectionManager{}
+	if err := util.StructToMessage(config, manager); err != nil {
+		return nil, err
+	}
+	if rds := manager.GetRds(); rds != nil {
+		routeConfig, ok := routes[rds.RouteConfigName].(*v2.RouteConfiguration)
+		if !ok {
+			return nil, fmt.Errorf("unknown route configuration %s", rds.RouteConfigName)
+		}
+		manager.RouteSpecifier = &hcm.HttpConnectionManager_RouteConfig{RouteConfig: routeConfig}
+	}
+	return util.MessageToStruct(manager)
+}
+
+func sortedNames(resources map[string]cache.Resource) []string {
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// messageDocument converts a proto message to a generic document, keeping the order of its fields. The
+// credentials found in the message are redacted unless showSecrets is set.
+func messageDocument(m proto.Message, showSecrets bool) (interface{}, error) {
+	var b bytes.Buffer
+	if err := (&jsonpb.Marshaler{OrigName: true}).Marshal(&b, m); err != nil {
+		return nil, err
+	}
+	data := b.Bytes()
+	if !showSecrets {
+		data = []byte(logging.Redact(b.String()))
+	}
+	var document yaml.MapSlice
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+// orderedObject is a JSON object keeping the order of its fields.
+type orderedObject yaml.MapSlice
+
+func (o orderedObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, item := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, err := json.Marshal(fmt.Sprint(item.Key))
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(toJSONValue(item.Value))
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+func toJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		return orderedObject(v)
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = toJSONValue(item)
+		}
+		return values
+	default:
+		return v
+	}
+}
+
+func writeDocument(w io.Writer, format string, document interface{}) error {
+	switch format {
+	case "yaml":
+		out, err := yaml.Marshal(document)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(out)
+		return err
+	case "json":
+		out, err := json.MarshalIndent(toJSONValue(document), "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(out, '\n'))
+		return err
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
@@ -0,0 +1,47 @@
+package threescale_control_plane
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRenderSecrets(t *testing.T) {
+	system := newTestSystem(t, configFixture)
+	defer system.Close()
+
+	ec := &ControlPlane{
+		Host:       "127.0.0.1",
+		AuthPort:   9090,
+		PublicPort: 10000,
+		Tenants: []*ThreescaleConfig{{
+			Name:        "test",
+			AccessToken: testAccessToken,
+			SystemURL:   system.URL + "/",
+			Services:    []ServiceConfig{{ID: "2555417777777"}},
+		}},
+		Source: newTestProxyCache(),
+	}
+	if err := ec.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, staticBootstrap := range []bool{false, true} {
+		for _, format := range []string{"yaml", "json"} {
+			var redacted, shown bytes.Buffer
+			if err := ec.Render(&redacted, format, staticBootstrap, false); err != nil {
+				t.Fatal(err)
+			}
+			if err := ec.Render(&shown, format, staticBootstrap, true); err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Contains(redacted.String(), testAccessToken) || !strings.Contains(redacted.String(), "[REDACTED]") {
+				t.Errorf("%s, bootstrap %t: the access token is not redacted:\n%s", format, staticBootstrap, redacted.String())
+			}
+			if !strings.Contains(shown.String(), testAccessToken) {
+				t.Errorf("%s, bootstrap %t: the access token is missing with showSecrets:\n%s", format, staticBootstrap, shown.String())
+			}
+		}
+	}
+}
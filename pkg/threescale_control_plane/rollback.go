@@ -0,0 +1,106 @@
+package threescale_control_plane
+
+import (
+	"fmt"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"sync"
+)
+
+var resourceTypes = []string{cache.EndpointType, cache.ClusterType, cache.RouteType, cache.ListenerType}
+
+// snapshotHistory keeps, per node, the last snapshot fully accepted by Envoy, and the versions of the
+// resource types rejected, so a rejected configuration is not published again.
+type snapshotHistory struct {
+	sync.Mutex
+	acked    map[string]cache.Snapshot
+	rejected map[nodeType]string
+}
+
+type nodeType struct {
+	node, typeURL string
+}
+
+func newSnapshotHistory() *snapshotHistory {
+	return &snapshotHistory{
+		acked:    make(map[string]cache.Snapshot),
+		rejected: make(map[nodeType]string),
+	}
+}
+
+// rejectedType returns the first resource type of a snapshot whose version has already been rejected by
+// a node. Every node gets the same configuration, so it would be rejected again.
+func (h *snapshotHistory) rejectedType(snapshot *cache.Snapshot) (string, bool) {
+	h.Lock()
+	defer h.Unlock()
+	for _, typ := range resourceTypes {
+		for key, version := range h.rejected {
+			if key.typeURL == typ && version == snapshot.GetVersion(typ) {
+				return typ, true
+			}
+		}
+	}
+	return "", false
+}
+
+// nodeAcked records the current snapshot of a node once it accepted every resource type it holds.
+func (ec *ControlPlane) nodeAcked(node string) {
+	snapshot, err := config.GetSnapshot(node)
+	if err != nil {
+		return
+	}
+	for _, typ := range resourceTypes {
+		if len(snapshot.GetResources(typ)) > 0 && ec.callbacks.ackedVersion(node, typ) != snapshot.GetVersion(typ) {
+			return
+		}
+	}
+
+	ec.history.Lock()
+	defer ec.history.Unlock()
+	ec.history.acked[node] = snapshot
+}
+
+// nodeRejected rolls a node back to its last accepted snapshot, when rollbacks are enabled. The rejected
+// version is remembered, so it is not published again until the 3scale configuration changes.
+func (ec *ControlPlane) nodeRejected(node, typeURL string) {
+	if !ec.RollbackOnNack {
+		return
+	}
+
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	current, err := config.GetSnapshot(node)
+	if err != nil {
+		return
+	}
+
+	ec.history.Lock()
+	acked, ok := ec.history.acked[node]
+	// A rejection of the version already rolled back to is a late one, of the version sent before.
+	if !ok || acked.GetVersion(typeURL) != current.GetVersion(typeURL) {
+		ec.history.rejected[nodeType{node: node, typeURL: typeURL}] = current.GetVersion(typeURL)
+	}
+	ec.history.Unlock()
+
+	entry := log.WithField("node", node).WithField("type_url", typeURL)
+	if !ok {
+		entry.Warn("No configuration accepted by Envoy to roll back to")
+		return
+	}
+	if acked.GetVersion(typeURL) == current.GetVersion(typeURL) {
+		// Already rolled back.
+		return
+	}
+
+	if err := config.SetSnapshot(node, acked); err != nil {
+		entry.Errorf("Failed to roll back the configuration: %v", err)
+		return
+	}
+	xdsRollbacks.WithLabelValues(node).Inc()
+	entry.WithField("version", acked.GetVersion(typeURL)).Warn("Rolled back to the last configuration accepted by Envoy")
+}
+
+// errRejectedSnapshot is returned when publishing a snapshot Envoy already rejected.
+func errRejectedSnapshot(typ, version string) error {
+	return fmt.Errorf("version %s of %s was rejected by Envoy, keeping the previous configuration", version, typ)
+}
@@ -0,0 +1,39 @@
+package threescale_control_plane
+
+import (
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"testing"
+)
+
+func TestNodeRejected(t *testing.T) {
+	config = cache.NewSnapshotCache(true, Hasher{}, nil)
+	ec := &ControlPlane{RollbackOnNack: true, history: newSnapshotHistory()}
+
+	// A first configuration rejected by a node, without any to roll back to, is not published again.
+	first := cache.NewSnapshot("1", nil, nil, nil, nil)
+	if err := config.SetSnapshot("node-1", first); err != nil {
+		t.Fatal(err)
+	}
+	ec.nodeRejected("node-1", cache.ClusterType)
+	if typ, rejected := ec.history.rejectedType(&first); !rejected || typ != cache.ClusterType {
+		t.Errorf("rejectedType = %q, %t, want %s", typ, rejected, cache.ClusterType)
+	}
+	if _, ok := ec.history.rejected[nodeType{node: "node-2", typeURL: cache.ClusterType}]; ok {
+		t.Error("rejection recorded for another node")
+	}
+
+	second := cache.NewSnapshot("2", nil, nil, nil, nil)
+	if _, rejected := ec.history.rejectedType(&second); rejected {
+		t.Error("new version reported as rejected")
+	}
+
+	// The rejections of a node are forgotten once it's gone.
+	ec.callbacks = &callbacks{}
+	ec.nodeDisconnected("node-1")
+	if _, rejected := ec.history.rejectedType(&first); rejected {
+		t.Error("rejection kept after the node disconnected")
+	}
+	if len(ec.history.rejected) != 0 {
+		t.Errorf("rejected = %v, want none", ec.history.rejected)
+	}
+}
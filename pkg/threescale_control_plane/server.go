@@ -1,24 +1,29 @@
 package threescale_control_plane
 
 import (
+	"3scale-envoy/pkg/logging"
 	"3scale-envoy/pkg/threescale_authorizer"
+	"3scale-envoy/pkg/threescale_client"
+	"3scale-envoy/pkg/tracing"
 	"context"
 	"fmt"
-	"github.com/3scale/3scale-istio-adapter/pkg/threescale"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	als "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v2"
 	authZ "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	rls "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v2"
 	"github.com/envoyproxy/go-control-plane/pkg/cache"
 	xds "github.com/envoyproxy/go-control-plane/pkg/server"
-	logger "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 )
 
 var (
-	log    = logger.New()
+	log    = logging.Logger
 	config cache.SnapshotCache
 )
 
@@ -32,86 +37,205 @@ type ControlPlane struct {
 	CacheUpdateRetries, CacheEntriesMax      int
 	AuthPort, XDSport, AdminPort, PublicPort uint
 	AdminEnabled                             bool
-	Config                                   ThreescaleConfig
+	ReportInterval                           time.Duration
+	ReportLogs                               bool
+	AccessLog                                AccessLogConfig
+	Tracing                                  TracingConfig
+	AdminAPI                                 AdminAPIConfig
+	Bootstrap                                BootstrapConfig
+	XDSTLS                                   XDSTLSConfig
+	MetricsPort                              uint
+	RollbackOnNack                           bool
+	Tenants                                  []*ThreescaleConfig
 	Host                                     string
+	// Source provides the proxy configs of the services, cached by the control plane, and Backend authorizes
+	// and reports the requests. Both call 3scale over HTTP when not set.
+	Source  threescale_client.ProxyConfigSource
+	Backend threescale_client.Backend
+
+	authzReadiness, xdsReadiness *readiness
+	rateLimiter                  *rateLimiter
+	callbacks                    *callbacks
+	authorizer                   *threescale_authorizer.Authorizer
+	history                      *snapshotHistory
+
+	// mu serializes the refreshes of the tenants, and guards their resources.
+	mu         sync.Mutex
+	proxyCache *threescale_client.CachingSource
 }
 
 func (ec *ControlPlane) Start() {
 
 	ctx := context.Background()
-	signal := make(chan struct{})
 	cb := &callbacks{
-		signal:   signal,
 		fetches:  0,
 		requests: 0,
 	}
+	cb.onAck = ec.nodeAcked
+	cb.onNack = ec.nodeRejected
+	cb.onNode = ec.nodeConnected
+	cb.onNodeGone = ec.nodeDisconnected
+	ec.callbacks = cb
+	ec.history = newSnapshotHistory()
 	config = cache.NewSnapshotCache(true, Hasher{}, nil)
 
-	proxyCache := threescale.NewProxyConfigCache(ec.CacheTTL, ec.CacheRefreshInterval, ec.CacheUpdateRetries, ec.CacheEntriesMax)
-	err := proxyCache.StartRefreshWorker()
-	if err != nil {
-		panic(err)
+	if ec.Tracing.enabled() {
+		tracing.Configure(ctx, ec.Tracing.CollectorURL, tracingServiceName, ec.Tracing.Sampling)
+	}
+
+	// Both servers report NOT_SERVING until the authorizer has proxy configs and the first snapshot is set.
+	ec.authzReadiness = newReadiness(authorizationServiceName, rateLimitServiceName, accessLogServiceName)
+	ec.xdsReadiness = newReadiness(discoveryServiceName)
+	ec.rateLimiter = newRateLimiter()
+
+	if err := ec.setDefaultClients(); err != nil {
+		log.Fatal(err)
 	}
-	authorizer := threescale_authorizer.NewAuthorizer(proxyCache)
+	ec.proxyCache = threescale_client.NewCachingSource(ec.Source, ec.CacheTTL, ec.CacheRefreshInterval, ec.CacheUpdateRetries, ec.CacheEntriesMax)
+	reporter := threescale_authorizer.NewReporter(ec.Backend, ec.ReportInterval, ec.ReportLogs)
+	go reporter.Run(ctx)
+	authorizer := threescale_authorizer.NewAuthorizer(ec.proxyCache, ec.Backend, reporter)
+	ec.authorizer = authorizer
 
 	srv := xds.NewServer(config, cb)
 
-	go RunManagementServer(ctx, srv, ec.XDSport)
+	xdsOptions, err := ec.XDSTLS.serverOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	xdsListener, err := net.Listen("tcp", fmt.Sprintf(":%d", ec.XDSport))
+	if err != nil {
+		log.Fatalf("Failed to listen on port %d: %v", ec.XDSport, err)
+	}
+	go RunManagementServer(ctx, srv, xdsListener, ec.xdsReadiness, xdsOptions...)
 
 	if ec.AdminEnabled {
 		go RunManagementGateway(ctx, srv, ec.AdminPort)
 	}
 
-	go RunExternalAuthzService(ctx, authorizer, ec.AuthPort)
+	if ec.AdminAPI.enabled() {
+		go ec.RunAdminAPI(ctx)
+	}
+
+	if ec.MetricsPort != 0 {
+		go RunMetricsServer(ctx, ec.MetricsPort)
+	}
+
+	accessLogs := newAccessLogWriter(ec.AccessLog)
+
+	go RunExternalAuthzService(ctx, authorizer, ec.rateLimiter, reporter, accessLogs, ec.AuthPort, ec.authzReadiness)
 
 	var waitFor time.Duration
 	waitFor = ec.CacheTTL - ec.CacheRefreshInterval + 10*time.Second
 
-	<-signal
-	var version, newVersion int32
-	version = 0
-	newVersion = 0
-
+	// The first snapshot is set right away, without waiting for Envoy to connect, so the xDS
+	// server is ready by the time load balancers and Envoy health checks probe it.
 	for {
-		log.Println("Refreshing config 3scale, version:" + fmt.Sprint(version))
-		snap := cache.Snapshot{}
-
-		snap, newVersion = ec.Config.GetConfig(*proxyCache, version, ec.AuthPort, ec.PublicPort, ec.Host)
-		if newVersion != version {
-			log.Printf("Updating new version: %d", newVersion)
-			err := config.SetSnapshot(nodeID, snap)
-			if err != nil {
-				log.Println(err)
-			}
-			version = newVersion
+		ec.refresh()
+
+		log.Debugf("Refreshing from 3scale in: %s", waitFor)
+		time.Sleep(waitFor)
+	}
+}
+
+// refresh updates the resources of every tenant, and publishes a new snapshot when any of them changed.
+func (ec *ControlPlane) refresh() {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	log.Debug("Refreshing config 3scale")
+
+	var changed bool
+	for _, tenant := range ec.Tenants {
+		tenantChanged, err := tenant.GetConfig(ec.proxyCache)
+		if err != nil {
+			// Keep the last known resources of the failing services, so other tenants can still be updated.
+			log.WithField("tenant", tenant.Name).Errorf("Failed to refresh the 3scale configuration: %v", err)
+		}
+		changed = changed || tenantChanged
+
+		for _, service := range tenant.Services {
+			ec.rateLimiter.setServiceLimits(tenant.resourceName(service.ID), service.RateLimits)
+		}
+		ec.loadMetricHierarchies(tenant)
+	}
+
+	if ec.authorizerReady() {
+		ec.authzReadiness.setServing(true)
+	}
+
+	if changed {
+		if err := ec.publishSnapshot(); err != nil {
+			log.Errorf("Failed to publish the Envoy configuration: %v", err)
 		} else {
-			log.Printf("No changes detected in the 3scale configuration.")
+			ec.xdsReadiness.setServing(true)
 		}
+	} else {
+		log.Debug("No changes detected in the 3scale configuration.")
+	}
+}
 
-		log.Printf("Refreshing from 3scale in: %s", waitFor)
-		time.Sleep(waitFor)
+// loadMetricHierarchies loads the metrics of the proxy configs of a tenant into the authorizer, so the
+// requests don't wait for them. Only the new proxy config versions are loaded.
+func (ec *ControlPlane) loadMetricHierarchies(tenant *ThreescaleConfig) {
+	if ec.authorizer == nil {
+		return
+	}
+	for id, resources := range tenant.resources {
+		if err := ec.authorizer.LoadMetricHierarchy(tenant.threescaleTenant(), id, resources.version); err != nil {
+			log.WithField("tenant", tenant.Name).WithField("service_id", id).Warnf("Failed to load the metrics of the service: %v", err)
+		}
+	}
+}
+
+// setDefaultClients calls 3scale over HTTP, with the default timeouts, when no source or backend was injected.
+func (ec *ControlPlane) setDefaultClients() error {
+	if ec.Source != nil && ec.Backend != nil {
+		return nil
+	}
+	client, err := threescale_client.NewHTTPClient(threescale_client.DefaultHTTPConfig)
+	if err != nil {
+		return err
+	}
+	if ec.Source == nil {
+		ec.Source = threescale_client.NewSystemClient(client)
+	}
+	if ec.Backend == nil {
+		ec.Backend = threescale_client.NewBackendClient(client)
 	}
+	return nil
 }
 
-// RunExternalAuthzService starts an external-authorization service for envoy
-func RunExternalAuthzService(ctx context.Context, server *threescale_authorizer.Authorizer, port uint) {
+// authorizerReady reports whether the authorizer is running and has cached the proxy config of a service,
+// so it can authorize requests without waiting for 3scale.
+func (ec *ControlPlane) authorizerReady() bool {
+	return ec.authorizer != nil && ec.proxyCache.Len() > 0
+}
+
+// RunExternalAuthzService starts an external-authorization service for envoy, together with the rate limit
+// and access log services.
+func RunExternalAuthzService(ctx context.Context, server *threescale_authorizer.Authorizer, limiter *rateLimiter, reporter *threescale_authorizer.Reporter, accessLogs *accessLogWriter, port uint, ready *readiness) {
 
 	var grpcOptions []grpc.ServerOption
 	grpcOptions = append(grpcOptions, grpc.MaxConcurrentStreams(grpcMaxConcurrentStreams))
 	grpcServer := grpc.NewServer(grpcOptions...)
 	ea := envoyAuth{
-		server:     *grpcServer,
-		authorizer: *server,
+		authorizer:  server,
+		rateLimiter: limiter,
+		accessLogs:  accessLogs,
 	}
 
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
-		log.Println("Failed to listen")
+		log.Fatalf("Failed to listen on port %d: %v", port, err)
 	}
 
 	authZ.RegisterAuthorizationServer(grpcServer, ea)
+	rls.RegisterRateLimitServiceServer(grpcServer, limiter)
+	als.RegisterAccessLogServiceServer(grpcServer, &accessLogService{reporter: reporter, writer: accessLogs})
+	healthpb.RegisterHealthServer(grpcServer, ready.server)
 
-	log.Printf("Starting Authorization Service on Port %d\n", port)
+	log.Infof("Starting Authorization Service on Port %d", port)
 	go func() {
 		if err = grpcServer.Serve(lis); err != nil {
 			log.Error(err)
@@ -123,15 +247,12 @@ func RunExternalAuthzService(ctx context.Context, server *threescale_authorizer.
 
 }
 
-// RunManagementServer starts an xDS server at the given Port.
-func RunManagementServer(ctx context.Context, server xds.Server, port uint) {
+// RunManagementServer starts an xDS server accepting the connections of lis.
+func RunManagementServer(ctx context.Context, server xds.Server, lis net.Listener, ready *readiness, options ...grpc.ServerOption) {
 	var grpcOptions []grpc.ServerOption
 	grpcOptions = append(grpcOptions, grpc.MaxConcurrentStreams(grpcMaxConcurrentStreams))
+	grpcOptions = append(grpcOptions, options...)
 	grpcServer := grpc.NewServer(grpcOptions...)
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		log.Error("Failed to listen")
-	}
 
 	// register services
 	discovery.RegisterAggregatedDiscoveryServiceServer(grpcServer, server)
@@ -139,10 +260,11 @@ func RunManagementServer(ctx context.Context, server xds.Server, port uint) {
 	v2.RegisterClusterDiscoveryServiceServer(grpcServer, server)
 	v2.RegisterRouteDiscoveryServiceServer(grpcServer, server)
 	v2.RegisterListenerDiscoveryServiceServer(grpcServer, server)
+	healthpb.RegisterHealthServer(grpcServer, ready.server)
 
-	log.Printf("Starting Management Server on Port %d\n", port)
+	log.Infof("Starting Management Server on %s", lis.Addr())
 	go func() {
-		if err = grpcServer.Serve(lis); err != nil {
+		if err := grpcServer.Serve(lis); err != nil {
 			log.Error(err)
 		}
 	}()
@@ -153,7 +275,7 @@ func RunManagementServer(ctx context.Context, server xds.Server, port uint) {
 
 // RunManagementGateway starts an HTTP gateway to an xDS server.
 func RunManagementGateway(ctx context.Context, srv xds.Server, port uint) {
-	log.Printf("Starting HTTP/1.1 gateway on Port %d\n", port)
+	log.Infof("Starting HTTP/1.1 gateway on Port %d", port)
 	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: &xds.HTTPGateway{Server: srv}}
 	go func() {
 		if err := server.ListenAndServe(); err != nil {
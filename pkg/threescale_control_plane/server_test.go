@@ -0,0 +1,181 @@
+package threescale_control_plane
+
+import (
+	"context"
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	xds "github.com/envoyproxy/go-control-plane/pkg/server"
+	"github.com/gogo/protobuf/types"
+	"google.golang.org/grpc"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+const testNodeID = "envoy-test"
+
+// xdsClient requests the resources of the control plane through ADS, acknowledging every response like
+// Envoy does.
+type xdsClient struct {
+	t      *testing.T
+	stream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesClient
+	// versions and nonces hold the last response received by type URL.
+	versions, nonces map[string]string
+}
+
+func (c *xdsClient) request(typeURL string, names ...string) {
+	err := c.stream.Send(&v2.DiscoveryRequest{
+		Node:          &core.Node{Id: testNodeID, Cluster: DefaultNodeCluster},
+		TypeUrl:       typeURL,
+		ResourceNames: names,
+		VersionInfo:   c.versions[typeURL],
+		ResponseNonce: c.nonces[typeURL],
+	})
+	if err != nil {
+		c.t.Fatalf("failed to request %s: %v", typeURL, err)
+	}
+}
+
+// receive waits for a response of the given type, acknowledges it and returns its resources.
+func (c *xdsClient) receive(typeURL string, names ...string) []cache.Resource {
+	for {
+		resp, err := c.stream.Recv()
+		if err != nil {
+			c.t.Fatalf("failed to receive %s: %v", typeURL, err)
+		}
+		c.versions[resp.TypeUrl] = resp.VersionInfo
+		c.nonces[resp.TypeUrl] = resp.Nonce
+		if resp.TypeUrl != typeURL {
+			continue
+		}
+
+		resources := make([]cache.Resource, 0, len(resp.Resources))
+		for _, r := range resp.Resources {
+			var resource types.DynamicAny
+			if err := types.UnmarshalAny(&r, &resource); err != nil {
+				c.t.Fatalf("invalid %s resource: %v", typeURL, err)
+			}
+			resources = append(resources, resource.Message.(cache.Resource))
+		}
+		c.request(typeURL, names...)
+		return resources
+	}
+}
+
+func resourceNames(resources []cache.Resource) []string {
+	names := make([]string, 0, len(resources))
+	for _, r := range resources {
+		names = append(names, cache.GetResourceName(r))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TestManagementServer runs the xDS server and fetches the configuration through ADS, checking what
+// Envoy receives and that it's updated when the 3scale services change.
+func TestManagementServer(t *testing.T) {
+	system := newTestSystem(t, configFixture)
+	defer system.Close()
+
+	ec := &ControlPlane{
+		Host:       "127.0.0.1",
+		AuthPort:   4000,
+		PublicPort: 10000,
+		Tenants: []*ThreescaleConfig{{
+			Name:        "test",
+			AccessToken: testAccessToken,
+			SystemURL:   system.URL + "/",
+			Services:    []ServiceConfig{{ID: "2555417777777", Endpoints: EndpointsConfig{Type: EndpointsDNS}}},
+		}},
+	}
+	cb := &callbacks{onAck: ec.nodeAcked, onNack: ec.nodeRejected, onNode: ec.nodeConnected, onNodeGone: ec.nodeDisconnected}
+	ec.callbacks = cb
+	ec.history = newSnapshotHistory()
+	ec.authzReadiness = newReadiness(authorizationServiceName)
+	ec.xdsReadiness = newReadiness(discoveryServiceName)
+	ec.rateLimiter = newRateLimiter()
+	ec.proxyCache = newTestProxyCache()
+	config = cache.NewSnapshotCache(true, Hasher{}, nil)
+
+	ec.refresh()
+	if _, err := config.GetSnapshot(nodeID); err != nil {
+		t.Fatalf("no snapshot published: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go RunManagementServer(ctx, xds.NewServer(config, cb), lis, ec.xdsReadiness)
+
+	conn, err := grpc.DialContext(ctx, lis.Addr().String(), grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stream, err := discovery.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &xdsClient{t: t, stream: stream, versions: map[string]string{}, nonces: map[string]string{}}
+
+	// Envoy fetches the clusters first, then their endpoints, the listeners and their routes.
+	client.request(cache.ClusterType)
+	clusters := client.receive(cache.ClusterType)
+	if got, want := resourceNames(clusters), []string{"extauthz", "test_2555417777777_10_0_0_1_8080"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("clusters = %v, want %v", got, want)
+	}
+
+	client.request(cache.EndpointType, "test_2555417777777_10_0_0_1_8080")
+	endpoints := client.receive(cache.EndpointType, "test_2555417777777_10_0_0_1_8080")
+	if len(endpoints) != 1 {
+		t.Fatalf("got %d load assignments, want 1", len(endpoints))
+	}
+	address := endpoints[0].(*v2.ClusterLoadAssignment).Endpoints[0].LbEndpoints[0].GetEndpoint().Address.GetSocketAddress()
+	if address.Address != "10.0.0.1" || address.GetPortValue() != 8080 {
+		t.Errorf("endpoint = %s:%d, want 10.0.0.1:8080", address.Address, address.GetPortValue())
+	}
+
+	client.request(cache.ListenerType)
+	listeners := client.receive(cache.ListenerType)
+	if len(listeners) != 1 {
+		t.Fatalf("got %d listeners, want 1", len(listeners))
+	}
+	if port := listeners[0].(*v2.Listener).Address.GetSocketAddress().GetPortValue(); port != 10000 {
+		t.Errorf("listener port = %d, want 10000", port)
+	}
+
+	client.request(cache.RouteType, routeConfigName)
+	routes := client.receive(cache.RouteType, routeConfigName)
+	if len(routes) != 1 {
+		t.Fatalf("got %d route configurations, want 1", len(routes))
+	}
+	virtualHosts := routes[0].(*v2.RouteConfiguration).VirtualHosts
+	if len(virtualHosts) != 1 || !reflect.DeepEqual(virtualHosts[0].Domains, []string{"echo-api.example.com"}) {
+		t.Errorf("virtual hosts = %v, want echo-api.example.com only", virtualHosts)
+	}
+
+	// A new service is pushed to the connected nodes.
+	ec.Tenants[0].Services = append(ec.Tenants[0].Services, ServiceConfig{ID: "2555417777778"})
+	ec.refresh()
+	clusters = client.receive(cache.ClusterType)
+	want := []string{"extauthz", "test_2555417777777_10_0_0_1_8080", "test_2555417777778_10_0_0_2_8080", "test_2555417777778_10_0_0_3_443"}
+	if got := resourceNames(clusters); !reflect.DeepEqual(got, want) {
+		t.Fatalf("updated clusters = %v, want %v", got, want)
+	}
+
+	// The acknowledgements are tracked per node.
+	deadline := time.Now().Add(5 * time.Second)
+	for cb.ackedVersion(testNodeID, cache.ClusterType) != client.versions[cache.ClusterType] {
+		if time.Now().After(deadline) {
+			t.Fatalf("acked cluster version = %q, want %q", cb.ackedVersion(testNodeID, cache.ClusterType), client.versions[cache.ClusterType])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
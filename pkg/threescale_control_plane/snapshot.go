@@ -0,0 +1,343 @@
+package threescale_control_plane
+
+import (
+	"fmt"
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	accessLogFilter "github.com/envoyproxy/go-control-plane/envoy/config/filter/accesslog/v2"
+	extAuthService "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/ext_authz/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/envoyproxy/go-control-plane/pkg/util"
+	"github.com/gogo/protobuf/types"
+	"time"
+
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+)
+
+const (
+	// routeConfigName is the name of the route configuration requested by the public listener through RDS.
+	routeConfigName = "local_route"
+
+	extAuthZHealthCheckInterval = 5 * time.Second
+	extAuthZHealthCheckTimeout  = time.Second
+)
+
+// newSnapshot merges the resources of every tenant into a single snapshot, together with
+// the External AuthZ cluster and the public listener shared by all of them.
+func (ec *ControlPlane) newSnapshot() (cache.Snapshot, error) {
+
+	// Generate the External AuthZ Cluster for envoy
+	clusterCache := []cache.Resource{ec.generateAuthZCluster()}
+
+	var endpointsCache []cache.Resource
+	var virtualHosts []route.VirtualHost
+	for _, tenant := range ec.Tenants {
+		clusters, endpoints, tenantVirtualHosts := tenant.Resources()
+		clusterCache = append(clusterCache, clusters...)
+		endpointsCache = append(endpointsCache, endpoints...)
+		virtualHosts = append(virtualHosts, tenantVirtualHosts...)
+	}
+
+	//
+	// Generate the HTTPConnectionManager for the services
+	//
+	envoyGrpcConfig := ec.newExternalAuthService()
+
+	envoyConf, err := util.MessageToStruct(&envoyGrpcConfig)
+	if err != nil {
+		return cache.Snapshot{}, err
+	}
+
+	rateLimitConf, err := util.MessageToStruct(newRateLimitFilter())
+	if err != nil {
+		return cache.Snapshot{}, err
+	}
+
+	manager := ec.newHTTPManager(envoyConf, rateLimitConf)
+
+	accessLog, err := newAccessLog()
+	if err != nil {
+		return cache.Snapshot{}, err
+	}
+	manager.AccessLog = []*accessLogFilter.AccessLog{accessLog}
+
+	pbst, err := util.MessageToStruct(manager)
+	if err != nil {
+		return cache.Snapshot{}, err
+	}
+
+	//
+	// Generate the Listeners for the services
+	listenersCache := ec.newListenersCache(pbst)
+
+	// The virtual hosts are served through RDS, so route changes don't replace the listener.
+	routesCache := []cache.Resource{
+		&v2.RouteConfiguration{
+			Name:         routeConfigName,
+			VirtualHosts: virtualHosts,
+		},
+	}
+
+	return newVersionedSnapshot(endpointsCache, clusterCache, routesCache, listenersCache)
+}
+
+// publishSnapshot sets a new snapshot built from the current resources of the tenants, as long as
+// any of its resource types changed. Resource types that did not change keep their version, so
+// Envoy is only sent the updated ones.
+func (ec *ControlPlane) publishSnapshot() error {
+	snap, err := ec.newSnapshot()
+	if err != nil {
+		return err
+	}
+
+	if ec.RollbackOnNack && ec.history != nil {
+		if typ, rejected := ec.history.rejectedType(&snap); rejected {
+			return errRejectedSnapshot(typ, snap.GetVersion(typ))
+		}
+	}
+
+	if err := validateSnapshot(&snap); err != nil {
+		return fmt.Errorf("invalid Envoy configuration, keeping the previous one: %v", err)
+	}
+
+	previous, _ := config.GetSnapshot(nodeID)
+
+	var updated bool
+	for _, typ := range resourceTypes {
+		current := snapshotResources(&snap, typ)
+		if changed := changedResources(snapshotResources(&previous, typ), current); len(changed) > 0 {
+			log.Infof("Updating %s to version %s, changed resources: %v", typ, current.Version, changed)
+			updated = true
+		}
+	}
+
+	if !updated {
+		log.Debug("No changes detected in the generated Envoy configuration.")
+		return nil
+	}
+	if err := config.SetSnapshot(nodeID, snap); err != nil {
+		return err
+	}
+
+	// Every connected node gets the same configuration, whatever the node ID of its bootstrap.
+	if ec.callbacks != nil {
+		for _, node := range ec.callbacks.nodeStatuses() {
+			if node.ID == nodeID || node.Streams == 0 {
+				continue
+			}
+			if err := config.SetSnapshot(node.ID, snap); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// nodeConnected serves the current snapshot to a node connecting with a node ID other than
+// DefaultNodeID, the first time it's seen.
+func (ec *ControlPlane) nodeConnected(node string) {
+	if node == nodeID {
+		return
+	}
+
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	if _, err := config.GetSnapshot(node); err == nil {
+		return
+	}
+	snap, err := config.GetSnapshot(nodeID)
+	if err != nil {
+		// The node gets the first snapshot once it's published.
+		return
+	}
+	if err := config.SetSnapshot(node, snap); err != nil {
+		log.WithField("node", node).Errorf("Failed to set the snapshot: %v", err)
+	}
+}
+
+// nodeDisconnected drops the snapshot of a node other than DefaultNodeID once its last stream is closed,
+// unless it connected again meanwhile, so the snapshots, rejections and metrics of gone nodes are not kept
+// forever.
+func (ec *ControlPlane) nodeDisconnected(node string) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	if ec.callbacks.connected(node) {
+		return
+	}
+	if ec.history != nil {
+		ec.history.Lock()
+		delete(ec.history.acked, node)
+		for key := range ec.history.rejected {
+			if key.node == node {
+				delete(ec.history.rejected, key)
+			}
+		}
+		ec.history.Unlock()
+	}
+	deleteNodeMetrics(node)
+	if node != nodeID {
+		config.ClearSnapshot(node)
+	}
+}
+
+func (ec *ControlPlane) generateAuthZCluster() *v2.Cluster {
+	// externalAuthZ Cluster
+	externalAuthZ := ec.Host
+	externalAuthZPort := uint32(ec.AuthPort)
+	extAuthzAddress := &core.Address{
+		Address: &core.Address_SocketAddress{
+			SocketAddress: &core.SocketAddress{
+				Protocol: core.TCP,
+				Address:  externalAuthZ,
+				PortSpecifier: &core.SocketAddress_PortValue{
+					PortValue: externalAuthZPort,
+				},
+				Ipv4Compat: true,
+			},
+		},
+	}
+	clusterName := "extauthz"
+
+	extAuthZCluster := &v2.Cluster{
+		Name: clusterName,
+		ClusterDiscoveryType: &v2.Cluster_Type{
+			Type: v2.Cluster_LOGICAL_DNS,
+		},
+		ConnectTimeout: 5 * time.Second,
+		LbPolicy:       v2.Cluster_ROUND_ROBIN,
+		LoadAssignment: &v2.ClusterLoadAssignment{
+			ClusterName: clusterName,
+			Endpoints: []endpoint.LocalityLbEndpoints{{
+				LbEndpoints: []endpoint.LbEndpoint{{
+					HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+						Endpoint: &endpoint.Endpoint{
+							Address: extAuthzAddress,
+						},
+					},
+				}},
+			}},
+		},
+	}
+
+	// The External AuthZ service implements the gRPC health checking protocol, so Envoy stops
+	// sending authorization requests to instances that are not serving.
+	interval := extAuthZHealthCheckInterval
+	timeout := extAuthZHealthCheckTimeout
+	extAuthZCluster.HealthChecks = []*core.HealthCheck{{
+		Interval:           &interval,
+		Timeout:            &timeout,
+		HealthyThreshold:   &types.UInt32Value{Value: 1},
+		UnhealthyThreshold: &types.UInt32Value{Value: 2},
+		HealthChecker: &core.HealthCheck_GrpcHealthCheck_{
+			GrpcHealthCheck: &core.HealthCheck_GrpcHealthCheck{},
+		},
+	}}
+
+	// Enable HTTP2 support
+
+	extAuthZCluster.Http2ProtocolOptions = &core.Http2ProtocolOptions{
+		HpackTableSize:              nil,
+		MaxConcurrentStreams:        nil,
+		InitialStreamWindowSize:     nil,
+		InitialConnectionWindowSize: nil,
+		AllowConnect:                false,
+		AllowMetadata:               false,
+	}
+
+	return extAuthZCluster
+}
+
+func (ec *ControlPlane) newListenersCache(pbst *types.Struct) []cache.Resource {
+	listenersCache := []cache.Resource{
+		&v2.Listener{
+			Name: "listener_0",
+			Address: core.Address{
+				Address: &core.Address_SocketAddress{
+					SocketAddress: &core.SocketAddress{
+						Protocol: core.TCP,
+						Address:  "0.0.0.0",
+						PortSpecifier: &core.SocketAddress_PortValue{
+							PortValue: uint32(ec.PublicPort),
+						},
+					},
+				},
+			},
+			FilterChains: []listener.FilterChain{{
+				Filters: []listener.Filter{{
+					Name:       util.HTTPConnectionManager,
+					ConfigType: &listener.Filter_Config{Config: pbst},
+				}},
+			}},
+		},
+	}
+	return listenersCache
+}
+func (ec *ControlPlane) newExternalAuthService() extAuthService.ExtAuthz {
+	envoyGrpcConfig := extAuthService.ExtAuthz{
+		Services: &extAuthService.ExtAuthz_GrpcService{
+			GrpcService: &core.GrpcService{
+				TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &core.GrpcService_EnvoyGrpc{
+						ClusterName: "extauthz",
+					},
+				},
+				Timeout: &types.Duration{
+					Seconds: 5,
+					Nanos:   0,
+				},
+			},
+		},
+		FailureModeAllow: false,
+	}
+	return envoyGrpcConfig
+}
+
+func (ec *ControlPlane) newHTTPManager(envoyConf, rateLimitConf *types.Struct) *hcm.HttpConnectionManager {
+	manager := &hcm.HttpConnectionManager{
+		CodecType:  hcm.AUTO,
+		StatPrefix: "ingress_http",
+		RouteSpecifier: &hcm.HttpConnectionManager_Rds{
+			Rds: &hcm.Rds{
+				ConfigSource: core.ConfigSource{
+					ConfigSourceSpecifier: &core.ConfigSource_Ads{
+						Ads: &core.AggregatedConfigSource{},
+					},
+				},
+				RouteConfigName: routeConfigName,
+			},
+		},
+		HttpFilters: []*hcm.HttpFilter{
+			// The CORS and RBAC filters only act on the virtual hosts of services with those APIcast policies.
+			{
+				Name: util.CORS,
+			},
+			{
+				Name: rbacFilterName,
+			},
+			{
+				Name: util.ExternalAuthorization,
+				ConfigType: &hcm.HttpFilter_Config{
+					Config: envoyConf,
+				},
+			},
+			{
+				Name: util.HTTPRateLimit,
+				ConfigType: &hcm.HttpFilter_Config{
+					Config: rateLimitConf,
+				},
+			},
+			{
+				Name: util.Router,
+			},
+		},
+	}
+	if ec.Tracing.enabled() {
+		manager.Tracing = ec.Tracing.newTracing()
+	}
+	return manager
+}
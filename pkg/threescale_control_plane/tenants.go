@@ -0,0 +1,113 @@
+package threescale_control_plane
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"time"
+)
+
+const defaultEnvironment = "production"
+
+// tenantNameRegex restricts tenant names to characters that are safe in Envoy resource names.
+var tenantNameRegex = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+
+// Duration is a time.Duration read from JSON strings such as "5s" or "1m30s".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("invalid duration %s, expected a string such as \"5s\"", b)
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// TenantsFile is the format of the file describing the 3scale tenants served by the control plane.
+type TenantsFile struct {
+	Tenants []*ThreescaleConfig `json:"tenants"`
+}
+
+// LoadTenants reads and validates the tenants described in the given JSON file.
+func LoadTenants(path string) ([]*ThreescaleConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f TenantsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("invalid tenants file %s: %v", path, err)
+	}
+
+	if err := ValidateTenants(f.Tenants); err != nil {
+		return nil, fmt.Errorf("invalid tenants file %s: %v", path, err)
+	}
+	return f.Tenants, nil
+}
+
+// ValidateTenants checks that every tenant is complete and has a unique name,
+// filling in the default environment where it is missing.
+func ValidateTenants(tenants []*ThreescaleConfig) error {
+	if len(tenants) == 0 {
+		return fmt.Errorf("no tenants configured")
+	}
+
+	names := make(map[string]bool, len(tenants))
+	for i, t := range tenants {
+		if !tenantNameRegex.MatchString(t.Name) {
+			return fmt.Errorf("tenant %d: invalid name %q, only letters, digits and '-' are allowed", i, t.Name)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("tenant %s: duplicated name", t.Name)
+		}
+		names[t.Name] = true
+
+		if t.SystemURL == "" {
+			return fmt.Errorf("tenant %s: missing system_url", t.Name)
+		}
+		if t.AccessToken == "" {
+			return fmt.Errorf("tenant %s: missing access_token", t.Name)
+		}
+		for _, s := range t.Services {
+			if s.ID == "" {
+				return fmt.Errorf("tenant %s: service without id", t.Name)
+			}
+			if err := s.Endpoints.validate(); err != nil {
+				return fmt.Errorf("tenant %s: service %s: %v", t.Name, s.ID, err)
+			}
+			if s.TLS != nil {
+				if err := s.TLS.validate(); err != nil {
+					return fmt.Errorf("tenant %s: service %s: %v", t.Name, s.ID, err)
+				}
+			}
+			for _, r := range s.RateLimits {
+				if err := r.validate(); err != nil {
+					return fmt.Errorf("tenant %s: service %s: %v", t.Name, s.ID, err)
+				}
+			}
+			if s.HealthCheck != nil {
+				if err := s.HealthCheck.validate(); err != nil {
+					return fmt.Errorf("tenant %s: service %s: %v", t.Name, s.ID, err)
+				}
+			}
+		}
+		if t.Environment == "" {
+			t.Environment = defaultEnvironment
+		}
+	}
+	return nil
+}
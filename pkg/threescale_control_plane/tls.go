@@ -0,0 +1,107 @@
+package threescale_control_plane
+
+import (
+	"fmt"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+)
+
+// DefaultUpstreamCAFile is the CA bundle, on the Envoy host, used to verify the certificates of
+// https API backends that don't configure their own.
+var DefaultUpstreamCAFile = "/etc/ssl/certs/ca-certificates.crt"
+
+var tlsVersions = map[string]auth.TlsParameters_TlsProtocol{
+	"":    auth.TlsParameters_TLS_AUTO,
+	"1.0": auth.TlsParameters_TLSv1_0,
+	"1.1": auth.TlsParameters_TLSv1_1,
+	"1.2": auth.TlsParameters_TLSv1_2,
+	"1.3": auth.TlsParameters_TLSv1_3,
+}
+
+// TLSConfig configures how Envoy connects to the https API backends of a service.
+// File paths refer to the Envoy host.
+type TLSConfig struct {
+	// CAFile is the trusted CA bundle, DefaultUpstreamCAFile when empty.
+	CAFile string `json:"ca_file"`
+	// SubjectAltNames accepted in the backend certificate, the backend hostname when empty.
+	SubjectAltNames []string `json:"subject_alt_names"`
+	// MinVersion is the minimum TLS version: "1.0", "1.1", "1.2" or "1.3".
+	MinVersion string `json:"min_version"`
+	// ClientCertFile and ClientKeyFile are presented to backends requiring mTLS.
+	ClientCertFile string `json:"client_cert_file"`
+	ClientKeyFile  string `json:"client_key_file"`
+	// SNI sent to the backend, the backend hostname when empty.
+	SNI string `json:"sni"`
+	// InsecureSkipVerify disables the verification of the backend certificate.
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+}
+
+func (t *TLSConfig) validate() error {
+	if _, ok := tlsVersions[t.MinVersion]; !ok {
+		return fmt.Errorf("unknown TLS version %q", t.MinVersion)
+	}
+	if (t.ClientCertFile == "") != (t.ClientKeyFile == "") {
+		return fmt.Errorf("both client_cert_file and client_key_file are required for mTLS")
+	}
+	if t.InsecureSkipVerify && (t.CAFile != "" || len(t.SubjectAltNames) > 0) {
+		return fmt.Errorf("insecure_skip_verify can't be used together with ca_file or subject_alt_names")
+	}
+	return nil
+}
+
+// upstreamTLSContext returns the TLS context used to connect to an API backend, verifying its
+// certificate against the trust store and its hostname unless verification is disabled.
+func (t *TLSConfig) upstreamTLSContext(hostname string) *auth.UpstreamTlsContext {
+	if t == nil {
+		t = &TLSConfig{}
+	}
+
+	sni := t.SNI
+	if sni == "" {
+		sni = hostname
+	}
+
+	common := &auth.CommonTlsContext{
+		TlsParams: &auth.TlsParameters{
+			TlsMinimumProtocolVersion: tlsVersions[t.MinVersion],
+		},
+	}
+
+	if !t.InsecureSkipVerify {
+		caFile := t.CAFile
+		if caFile == "" {
+			caFile = DefaultUpstreamCAFile
+		}
+		subjectAltNames := t.SubjectAltNames
+		if len(subjectAltNames) == 0 {
+			subjectAltNames = []string{hostname}
+		}
+
+		common.ValidationContextType = &auth.CommonTlsContext_ValidationContext{
+			ValidationContext: &auth.CertificateValidationContext{
+				TrustedCa:            fileDataSource(caFile),
+				VerifySubjectAltName: subjectAltNames,
+			},
+		}
+	}
+
+	if t.ClientCertFile != "" {
+		common.TlsCertificates = []*auth.TlsCertificate{{
+			CertificateChain: fileDataSource(t.ClientCertFile),
+			PrivateKey:       fileDataSource(t.ClientKeyFile),
+		}}
+	}
+
+	return &auth.UpstreamTlsContext{
+		CommonTlsContext: common,
+		Sni:              sni,
+	}
+}
+
+func fileDataSource(path string) *core.DataSource {
+	return &core.DataSource{
+		Specifier: &core.DataSource_Filename{
+			Filename: path,
+		},
+	}
+}
@@ -0,0 +1,31 @@
+package threescale_control_plane
+
+import (
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	envoyType "github.com/envoyproxy/go-control-plane/envoy/type"
+)
+
+// tracingServiceName is the name of the control plane in the exported traces.
+const tracingServiceName = "3scale-envoy"
+
+// TracingConfig sets where the spans of the External AuthZ service are sent. Tracing is disabled when
+// CollectorURL is empty.
+type TracingConfig struct {
+	// CollectorURL is the Zipkin v2 spans endpoint of a Zipkin or Jaeger collector.
+	CollectorURL string
+	// Sampling is the percentage of the requests traced, both by Envoy and by the control plane.
+	Sampling float64
+}
+
+func (t TracingConfig) enabled() bool {
+	return t.CollectorURL != ""
+}
+
+// newTracing returns the tracing settings of the public HTTP connection manager. Envoy sends the
+// spans to the tracer of its bootstrap config.
+func (t TracingConfig) newTracing() *hcm.HttpConnectionManager_Tracing {
+	return &hcm.HttpConnectionManager_Tracing{
+		OperationName:  hcm.INGRESS,
+		RandomSampling: &envoyType.Percent{Value: t.Sampling},
+	}
+}
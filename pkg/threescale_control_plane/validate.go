@@ -0,0 +1,177 @@
+package threescale_control_plane
+
+import (
+	"errors"
+	"fmt"
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/envoyproxy/go-control-plane/pkg/util"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// validateSnapshot checks that a snapshot is consistent before it's published: every resource passes the
+// validation rules of its proto definition, every cluster and route configuration referenced exists, and
+// no two listeners bind the same port. All the problems found are returned together.
+func validateSnapshot(s *cache.Snapshot) error {
+	var problems []string
+	for _, typ := range resourceTypes {
+		problems = append(problems, validateResources(typ, s.GetResources(typ))...)
+	}
+
+	clusters := s.GetResources(cache.ClusterType)
+	for name, r := range s.GetResources(cache.RouteType) {
+		if rc, ok := r.(*v2.RouteConfiguration); ok {
+			problems = append(problems, validateRouteClusters(name, rc, clusters)...)
+		}
+	}
+
+	problems = append(problems, validateListeners(s.GetResources(cache.ListenerType), s.GetResources(cache.RouteType))...)
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validateService checks the resources generated from the proxy config of a service, so a malformed one
+// only fails its service instead of every snapshot published afterwards.
+func validateService(resources serviceResources) error {
+	clusters := resourcesByName(resources.clusters)
+	problems := validateResources(cache.ClusterType, clusters)
+	problems = append(problems, validateResources(cache.EndpointType, resourcesByName(resources.endpoints))...)
+
+	v := resources.virtualHost
+	if err := v.Validate(); err != nil {
+		problems = append(problems, fmt.Sprintf("virtual host %s: %v", v.Name, err))
+	}
+	problems = append(problems, validateRouteClusters(v.Name, &v2.RouteConfiguration{VirtualHosts: []route.VirtualHost{v}}, clusters)...)
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func resourcesByName(resources []cache.Resource) map[string]cache.Resource {
+	named := make(map[string]cache.Resource, len(resources))
+	for _, r := range resources {
+		named[cache.GetResourceName(r)] = r
+	}
+	return named
+}
+
+func validateResources(typ string, resources map[string]cache.Resource) []string {
+	var problems []string
+	for name, r := range resources {
+		v, ok := r.(interface{ Validate() error })
+		if !ok || reflect.ValueOf(r).IsNil() {
+			problems = append(problems, fmt.Sprintf("%s %s: missing resource", typ, name))
+			continue
+		}
+		if err := v.Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("%s %s: %v", typ, name, err))
+		}
+	}
+	return problems
+}
+
+// validateRouteClusters checks that the clusters of every route of a route configuration exist.
+func validateRouteClusters(name string, rc *v2.RouteConfiguration, clusters map[string]cache.Resource) []string {
+	var problems []string
+	for _, vh := range rc.VirtualHosts {
+		for _, r := range vh.Routes {
+			for _, cluster := range routeClusters(r) {
+				if _, ok := clusters[cluster]; !ok {
+					problems = append(problems, fmt.Sprintf("route configuration %s: virtual host %s routes to unknown cluster %s", name, vh.Name, cluster))
+				}
+			}
+		}
+	}
+	return problems
+}
+
+func routeClusters(r route.Route) []string {
+	action := r.GetRoute()
+	if action == nil {
+		return nil
+	}
+	if cluster := action.GetCluster(); cluster != "" {
+		return []string{cluster}
+	}
+	var clusters []string
+	if weighted := action.GetWeightedClusters(); weighted != nil {
+		for _, c := range weighted.Clusters {
+			clusters = append(clusters, c.Name)
+		}
+	}
+	return clusters
+}
+
+// validateListeners checks that no two listeners bind the same port, and that the route configurations
+// requested through RDS by their HTTP connection managers exist.
+func validateListeners(listeners, routes map[string]cache.Resource) []string {
+	var problems []string
+
+	// Listeners on a wildcard address conflict with any other listener on the same port.
+	bound := make(map[uint32][]string)
+	names := make([]string, 0, len(listeners))
+	for name := range listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		l, ok := listeners[name].(*v2.Listener)
+		if !ok {
+			continue
+		}
+
+		if address := l.Address.GetSocketAddress(); address != nil {
+			port := address.GetPortValue()
+			for _, other := range bound[port] {
+				otherAddress := listeners[other].(*v2.Listener).Address.GetSocketAddress().Address
+				if otherAddress == address.Address || isWildcardAddress(otherAddress) || isWildcardAddress(address.Address) {
+					problems = append(problems, fmt.Sprintf("listener %s: port %d already bound by listener %s", name, port, other))
+				}
+			}
+			bound[port] = append(bound[port], name)
+		}
+
+		for _, chain := range l.FilterChains {
+			for _, filter := range chain.Filters {
+				if filter.Name != util.HTTPConnectionManager {
+					continue
+				}
+				problems = append(problems, validateHTTPManager(name, filter, routes)...)
+			}
+		}
+	}
+	return problems
+}
+
+func validateHTTPManager(listenerName string, filter listener.Filter, routes map[string]cache.Resource) []string {
+	manager := &hcm.HttpConnectionManager{}
+	if err := util.StructToMessage(filter.GetConfig(), manager); err != nil {
+		return []string{fmt.Sprintf("listener %s: invalid HTTP connection manager: %v", listenerName, err)}
+	}
+	if err := manager.Validate(); err != nil {
+		return []string{fmt.Sprintf("listener %s: invalid HTTP connection manager: %v", listenerName, err)}
+	}
+	if rds := manager.GetRds(); rds != nil {
+		if _, ok := routes[rds.RouteConfigName]; !ok {
+			return []string{fmt.Sprintf("listener %s: unknown route configuration %s", listenerName, rds.RouteConfigName)}
+		}
+	}
+	return nil
+}
+
+func isWildcardAddress(address string) bool {
+	return address == "0.0.0.0" || address == "::"
+}
@@ -0,0 +1,245 @@
+package threescale_control_plane
+
+import (
+	"3scale-envoy/pkg/threescale_client"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/envoyproxy/go-control-plane/pkg/util"
+	"github.com/gogo/protobuf/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resourceList returns the resources of a type of a snapshot, ordered by name.
+func resourceList(s *cache.Snapshot, typ string) []cache.Resource {
+	resources := s.GetResources(typ)
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]cache.Resource, 0, len(names))
+	for _, name := range names {
+		list = append(list, resources[name])
+	}
+	return list
+}
+
+func newTestListener(name, address string, port uint32, config *types.Struct) *v2.Listener {
+	return &v2.Listener{
+		Name: name,
+		Address: core.Address{
+			Address: &core.Address_SocketAddress{
+				SocketAddress: &core.SocketAddress{
+					Address:       address,
+					PortSpecifier: &core.SocketAddress_PortValue{PortValue: port},
+				},
+			},
+		},
+		FilterChains: []listener.FilterChain{{
+			Filters: []listener.Filter{{
+				Name:       util.HTTPConnectionManager,
+				ConfigType: &listener.Filter_Config{Config: config},
+			}},
+		}},
+	}
+}
+
+func TestValidateSnapshot(t *testing.T) {
+	system := newTestSystem(t, configFixture)
+	defer system.Close()
+
+	ec := &ControlPlane{
+		Host:       "127.0.0.1",
+		AuthPort:   9090,
+		PublicPort: 10000,
+		Tenants: []*ThreescaleConfig{{
+			Name:        "test",
+			AccessToken: testAccessToken,
+			SystemURL:   system.URL + "/",
+			Services:    []ServiceConfig{{ID: "2555417777777"}},
+		}},
+		Source: newTestProxyCache(),
+	}
+	if err := ec.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	valid, err := ec.newSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := resourceList(&valid, cache.ListenerType)[0].(*v2.Listener).FilterChains[0].Filters[0].GetConfig()
+
+	tests := []struct {
+		name string
+		// modify changes the resources of the valid snapshot.
+		modify  func(endpoints, clusters, routes, listeners *[]cache.Resource)
+		wantErr string
+	}{
+		{
+			name:   "valid snapshot",
+			modify: func(endpoints, clusters, routes, listeners *[]cache.Resource) {},
+		},
+		{
+			name: "route to an unknown cluster",
+			modify: func(endpoints, clusters, routes, listeners *[]cache.Resource) {
+				var kept []cache.Resource
+				for _, r := range *clusters {
+					if cache.GetResourceName(r) == "extauthz" {
+						kept = append(kept, r)
+					}
+				}
+				*clusters = kept
+			},
+			wantErr: "virtual host test_2555417777777 routes to unknown cluster test_2555417777777_10_0_0_1_8080",
+		},
+		{
+			name: "invalid cluster",
+			modify: func(endpoints, clusters, routes, listeners *[]cache.Resource) {
+				*clusters = append(*clusters, &v2.Cluster{
+					Name:           "invalid",
+					ConnectTimeout: time.Second,
+					LoadAssignment: newLoadAssignment("invalid", []string{"10.0.0.1"}, 99999),
+				})
+			},
+			wantErr: "Cluster invalid: invalid Cluster.LoadAssignment",
+		},
+		{
+			name: "port already bound",
+			modify: func(endpoints, clusters, routes, listeners *[]cache.Resource) {
+				*listeners = append(*listeners, newTestListener("listener_1", "127.0.0.1", 10000, manager))
+			},
+			wantErr: "listener listener_1: port 10000 already bound by listener listener_0",
+		},
+		{
+			name: "HTTP connection manager failing the struct conversion",
+			modify: func(endpoints, clusters, routes, listeners *[]cache.Resource) {
+				config := &types.Struct{Fields: map[string]*types.Value{
+					"stat_prefix":   {Kind: &types.Value_StringValue{StringValue: "ingress_http"}},
+					"unknown_field": {Kind: &types.Value_BoolValue{BoolValue: true}},
+				}}
+				*listeners = []cache.Resource{newTestListener("listener_0", "0.0.0.0", 10000, config)}
+			},
+			wantErr: "listener listener_0: invalid HTTP connection manager",
+		},
+		{
+			name: "unknown route configuration",
+			modify: func(endpoints, clusters, routes, listeners *[]cache.Resource) {
+				*routes = nil
+			},
+			wantErr: "listener listener_0: unknown route configuration local_route",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoints := resourceList(&valid, cache.EndpointType)
+			clusters := resourceList(&valid, cache.ClusterType)
+			routes := resourceList(&valid, cache.RouteType)
+			listeners := resourceList(&valid, cache.ListenerType)
+			tt.modify(&endpoints, &clusters, &routes, &listeners)
+
+			snapshot, err := newVersionedSnapshot(endpoints, clusters, routes, listeners)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = validateSnapshot(&snapshot)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetConfigMalformedProxyConfig(t *testing.T) {
+	recorded, err := ioutil.ReadFile("testdata/proxy_configs/2555417777777.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "proxy_configs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		// replace changes the recorded proxy config of the malformed service.
+		replace []string
+		wantErr string
+	}{
+		{
+			name:    "unparseable API backend URL",
+			replace: []string{`"api_backend": "http://10.0.0.1:8080"`, `"api_backend": "http://[::1"`},
+			wantErr: "service 2555417777780:",
+		},
+		{
+			name:    "API backend port out of range",
+			replace: []string{`"api_backend": "http://10.0.0.1:8080"`, `"api_backend": "http://10.0.0.1:99999"`},
+			wantErr: "service 2555417777780: invalid Envoy configuration:",
+		},
+		{
+			name:    "unparseable public endpoint",
+			replace: []string{`"endpoint": "https://echo-api.example.com:443"`, `"endpoint": "https://echo api.example.com:443"`},
+			wantErr: "service 2555417777780:",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			malformed := strings.Replace(string(recorded), "2555417777777", "2555417777780", -1)
+			malformed = strings.Replace(malformed, tt.replace[0], tt.replace[1], 1)
+			if malformed == strings.Replace(string(recorded), "2555417777777", "2555417777780", -1) {
+				t.Fatalf("%s not found in the recorded proxy config", tt.replace[0])
+			}
+			path := filepath.Join(dir, "2555417777780.json")
+			if err := ioutil.WriteFile(path, []byte(malformed), 0644); err != nil {
+				t.Fatal(err)
+			}
+			source, err := threescale_client.NewFileSource(path, "testdata/proxy_configs/2555417777777.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The malformed service is skipped with an error, the refresh of the other one goes on.
+			c := &ThreescaleConfig{Name: "test", AccessToken: testAccessToken, SystemURL: "https://3scale-admin.example.com/"}
+			changed, err := c.GetConfig(source)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+			if strings.Contains(err.Error(), "2555417777777") {
+				t.Errorf("error = %v, want only the malformed service to fail", err)
+			}
+			if !changed {
+				t.Error("changed = false, want the other service refreshed")
+			}
+			if _, ok := c.resources["2555417777780"]; ok {
+				t.Error("resources kept for the malformed service")
+			}
+
+			// The resources of the other service are published.
+			ec := &ControlPlane{Host: "127.0.0.1", AuthPort: 9090, PublicPort: 10000, Tenants: []*ThreescaleConfig{c}}
+			snapshot, err := ec.newSnapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := validateSnapshot(&snapshot); err != nil {
+				t.Errorf("invalid snapshot: %v", err)
+			}
+			if _, ok := snapshot.GetResources(cache.ClusterType)["test_2555417777777_10_0_0_1_8080"]; !ok {
+				t.Errorf("clusters = %v, want the one of service 2555417777777", resourceList(&snapshot, cache.ClusterType))
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package threescale_control_plane
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/gogo/protobuf/jsonpb"
+	"sort"
+)
+
+// resourceHash returns a hash of the content of a resource. The JSON encoding is used instead of the
+// binary one because it sorts map keys, which makes the hash stable across snapshots.
+func resourceHash(r cache.Resource) (string, error) {
+	var b bytes.Buffer
+	if err := (&jsonpb.Marshaler{OrigName: true}).Marshal(&b, r); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b.Bytes())
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// newVersionedResources groups the resources of a type, versioning the group with a hash of the
+// names and contents of its resources. The version only changes when a resource is added, removed
+// or modified, so Envoy is not sent resource types that did not change.
+func newVersionedResources(items []cache.Resource) (cache.Resources, error) {
+	indexed := cache.IndexResourcesByName(items)
+
+	names := make([]string, 0, len(indexed))
+	for name := range indexed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		hash, err := resourceHash(indexed[name])
+		if err != nil {
+			return cache.Resources{}, err
+		}
+		h.Write([]byte(name + "=" + hash + ";"))
+	}
+
+	return cache.Resources{
+		Version: hex.EncodeToString(h.Sum(nil)[:8]),
+		Items:   indexed,
+	}, nil
+}
+
+// changedResources returns the names of the resources added, modified or removed between two groups.
+func changedResources(previous, current cache.Resources) []string {
+	var changed []string
+	if previous.Version == current.Version {
+		return changed
+	}
+
+	for name, r := range current.Items {
+		old, ok := previous.Items[name]
+		if !ok {
+			changed = append(changed, name)
+			continue
+		}
+		oldHash, _ := resourceHash(old)
+		newHash, _ := resourceHash(r)
+		if oldHash != newHash {
+			changed = append(changed, name)
+		}
+	}
+	for name := range previous.Items {
+		if _, ok := current.Items[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// newVersionedSnapshot creates a snapshot where each resource type is versioned by its content.
+func newVersionedSnapshot(endpoints, clusters, routes, listeners []cache.Resource) (cache.Snapshot, error) {
+	var snapshot cache.Snapshot
+	var err error
+
+	if snapshot.Endpoints, err = newVersionedResources(endpoints); err != nil {
+		return cache.Snapshot{}, err
+	}
+	if snapshot.Clusters, err = newVersionedResources(clusters); err != nil {
+		return cache.Snapshot{}, err
+	}
+	if snapshot.Routes, err = newVersionedResources(routes); err != nil {
+		return cache.Snapshot{}, err
+	}
+	if snapshot.Listeners, err = newVersionedResources(listeners); err != nil {
+		return cache.Snapshot{}, err
+	}
+	return snapshot, nil
+}
+
+// snapshotResources returns the resource group of a type from a snapshot.
+func snapshotResources(s *cache.Snapshot, typ string) cache.Resources {
+	return cache.Resources{
+		Version: s.GetVersion(typ),
+		Items:   s.GetResources(typ),
+	}
+}
@@ -0,0 +1,83 @@
+package tracing
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	traceIDRegex = regexp.MustCompile(`^[0-9a-f]{16}([0-9a-f]{16})?$`)
+	spanIDRegex  = regexp.MustCompile(`^[0-9a-f]{16}$`)
+)
+
+// Extract returns the context of the span that sent a request, from its B3 headers, as set by the
+// Envoy Zipkin tracer, or its W3C traceparent header. Header names must be lower case.
+func Extract(headers map[string]string) (SpanContext, bool) {
+	if b3 := headers["b3"]; b3 != "" {
+		return extractB3Single(b3)
+	}
+	if traceID := headers["x-b3-traceid"]; traceID != "" {
+		return newSpanContext(traceID, headers["x-b3-spanid"], b3Sampled(headers["x-b3-sampled"], headers["x-b3-flags"]))
+	}
+	if traceparent := headers["traceparent"]; traceparent != "" {
+		return extractTraceparent(traceparent)
+	}
+	return SpanContext{}, false
+}
+
+// extractB3Single parses the "b3: {TraceId}-{SpanId}-{SamplingState}-{ParentSpanId}" header.
+func extractB3Single(b3 string) (SpanContext, bool) {
+	parts := strings.Split(strings.ToLower(b3), "-")
+	if len(parts) < 2 {
+		// A lone sampling state, like "0", carries no trace.
+		return SpanContext{}, false
+	}
+	var sampled *bool
+	if len(parts) > 2 {
+		sampled = b3Sampled(parts[2], parts[2])
+	}
+	return newSpanContext(parts[0], parts[1], sampled)
+}
+
+// extractTraceparent parses the "traceparent: {version}-{trace-id}-{parent-id}-{trace-flags}" header.
+func extractTraceparent(traceparent string) (SpanContext, bool) {
+	parts := strings.Split(strings.ToLower(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return SpanContext{}, false
+	}
+	sampled := flags&1 == 1
+	return newSpanContext(parts[1], parts[2], &sampled)
+}
+
+func b3Sampled(sampled, flags string) *bool {
+	var s bool
+	switch {
+	case flags == "1" || flags == "d":
+		s = true
+	case sampled == "1" || sampled == "true":
+		s = true
+	case sampled == "0" || sampled == "false":
+		s = false
+	default:
+		return nil
+	}
+	return &s
+}
+
+func newSpanContext(traceID, spanID string, sampled *bool) (SpanContext, bool) {
+	traceID, spanID = strings.ToLower(traceID), strings.ToLower(spanID)
+	if !traceIDRegex.MatchString(traceID) || !spanIDRegex.MatchString(spanID) || isZero(traceID) || isZero(spanID) {
+		return SpanContext{}, false
+	}
+	return SpanContext{TraceID: traceID, SpanID: spanID, Sampled: sampled}, true
+}
+
+// isZero reports whether an ID is all zeros, which is invalid.
+func isZero(id string) bool {
+	return strings.Trim(id, "0") == ""
+}
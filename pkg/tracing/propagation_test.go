@@ -0,0 +1,207 @@
+package tracing
+
+import (
+	"testing"
+)
+
+func TestExtract(t *testing.T) {
+	const (
+		traceID   = "463ac35c9f6413ad48485a3953bb6124"
+		traceID64 = "48485a3953bb6124"
+		spanID    = "a2fb4a1d1a96d312"
+	)
+
+	tests := []struct {
+		name        string
+		headers     map[string]string
+		wantOK      bool
+		wantTraceID string
+		wantSpanID  string
+		// wantSampled is "true", "false", or "" when the sampling decision is deferred.
+		wantSampled string
+	}{
+		{
+			name:        "b3 single header",
+			headers:     map[string]string{"b3": traceID + "-" + spanID + "-1-0020000000000001"},
+			wantOK:      true,
+			wantTraceID: traceID,
+			wantSpanID:  spanID,
+			wantSampled: "true",
+		},
+		{
+			name:        "b3 single header not sampled",
+			headers:     map[string]string{"b3": traceID + "-" + spanID + "-0"},
+			wantOK:      true,
+			wantTraceID: traceID,
+			wantSpanID:  spanID,
+			wantSampled: "false",
+		},
+		{
+			name:        "b3 single header debug",
+			headers:     map[string]string{"b3": traceID + "-" + spanID + "-d"},
+			wantOK:      true,
+			wantTraceID: traceID,
+			wantSpanID:  spanID,
+			wantSampled: "true",
+		},
+		{
+			name:        "b3 single header with a deferred decision",
+			headers:     map[string]string{"b3": traceID64 + "-" + spanID},
+			wantOK:      true,
+			wantTraceID: traceID64,
+			wantSpanID:  spanID,
+		},
+		{
+			name:        "b3 single header in upper case",
+			headers:     map[string]string{"b3": "463AC35C9F6413AD48485A3953BB6124-A2FB4A1D1A96D312-1"},
+			wantOK:      true,
+			wantTraceID: traceID,
+			wantSpanID:  spanID,
+			wantSampled: "true",
+		},
+		{
+			name:    "b3 single header with only a sampling state",
+			headers: map[string]string{"b3": "0"},
+		},
+		{
+			name:    "b3 single header with a short span id",
+			headers: map[string]string{"b3": traceID + "-a2fb4a1d"},
+		},
+		{
+			name:    "b3 single header with an invalid trace id",
+			headers: map[string]string{"b3": "not-a-trace"},
+		},
+		{
+			name:    "b3 single header with a zero trace id",
+			headers: map[string]string{"b3": "00000000000000000000000000000000-" + spanID + "-1"},
+		},
+		{
+			name:        "b3 multi headers",
+			headers:     map[string]string{"x-b3-traceid": traceID, "x-b3-spanid": spanID, "x-b3-sampled": "1"},
+			wantOK:      true,
+			wantTraceID: traceID,
+			wantSpanID:  spanID,
+			wantSampled: "true",
+		},
+		{
+			name:        "b3 multi headers not sampled",
+			headers:     map[string]string{"x-b3-traceid": traceID64, "x-b3-spanid": spanID, "x-b3-sampled": "0"},
+			wantOK:      true,
+			wantTraceID: traceID64,
+			wantSpanID:  spanID,
+			wantSampled: "false",
+		},
+		{
+			name:        "b3 multi headers debug flag",
+			headers:     map[string]string{"x-b3-traceid": traceID, "x-b3-spanid": spanID, "x-b3-flags": "1"},
+			wantOK:      true,
+			wantTraceID: traceID,
+			wantSpanID:  spanID,
+			wantSampled: "true",
+		},
+		{
+			name:        "b3 multi headers with a deferred decision",
+			headers:     map[string]string{"x-b3-traceid": traceID, "x-b3-spanid": spanID},
+			wantOK:      true,
+			wantTraceID: traceID,
+			wantSpanID:  spanID,
+		},
+		{
+			name:    "b3 multi headers without span id",
+			headers: map[string]string{"x-b3-traceid": traceID, "x-b3-sampled": "1"},
+		},
+		{
+			name:    "b3 multi headers with a non hex trace id",
+			headers: map[string]string{"x-b3-traceid": "463ac35c9f6413ad48485a3953bb612z", "x-b3-spanid": spanID},
+		},
+		{
+			name:        "traceparent sampled",
+			headers:     map[string]string{"traceparent": "00-" + traceID + "-" + spanID + "-01"},
+			wantOK:      true,
+			wantTraceID: traceID,
+			wantSpanID:  spanID,
+			wantSampled: "true",
+		},
+		{
+			name:        "traceparent not sampled",
+			headers:     map[string]string{"traceparent": "00-" + traceID + "-" + spanID + "-00"},
+			wantOK:      true,
+			wantTraceID: traceID,
+			wantSpanID:  spanID,
+			wantSampled: "false",
+		},
+		{
+			name:        "traceparent with other flags",
+			headers:     map[string]string{"traceparent": "00-" + traceID + "-" + spanID + "-0b"},
+			wantOK:      true,
+			wantTraceID: traceID,
+			wantSpanID:  spanID,
+			wantSampled: "true",
+		},
+		{
+			name:        "traceparent of a future version",
+			headers:     map[string]string{"traceparent": "01-" + traceID + "-" + spanID + "-0a-extra"},
+			wantOK:      true,
+			wantTraceID: traceID,
+			wantSpanID:  spanID,
+			wantSampled: "false",
+		},
+		{
+			name:    "traceparent with an invalid version",
+			headers: map[string]string{"traceparent": "ff-" + traceID + "-" + spanID + "-01"},
+		},
+		{
+			name:    "traceparent with a 64 bit trace id",
+			headers: map[string]string{"traceparent": "00-" + traceID64 + "-" + spanID + "-01"},
+		},
+		{
+			name:    "traceparent with a zero span id",
+			headers: map[string]string{"traceparent": "00-" + traceID + "-0000000000000000-01"},
+		},
+		{
+			name:    "traceparent with invalid flags",
+			headers: map[string]string{"traceparent": "00-" + traceID + "-" + spanID + "-zz"},
+		},
+		{
+			name:    "traceparent missing parts",
+			headers: map[string]string{"traceparent": "00-" + traceID + "-" + spanID},
+		},
+		{
+			name: "b3 takes precedence over traceparent",
+			headers: map[string]string{
+				"b3":          traceID + "-" + spanID + "-1",
+				"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00",
+			},
+			wantOK:      true,
+			wantTraceID: traceID,
+			wantSpanID:  spanID,
+			wantSampled: "true",
+		},
+		{
+			name:    "no trace headers",
+			headers: map[string]string{"x-request-id": "4f6a5e1c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Extract(tt.headers)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %t, want %t (%+v)", ok, tt.wantOK, got)
+			}
+			if got.TraceID != tt.wantTraceID || got.SpanID != tt.wantSpanID {
+				t.Errorf("ids = %s/%s, want %s/%s", got.TraceID, got.SpanID, tt.wantTraceID, tt.wantSpanID)
+			}
+			var sampled string
+			if got.Sampled != nil {
+				sampled = "false"
+				if *got.Sampled {
+					sampled = "true"
+				}
+			}
+			if sampled != tt.wantSampled {
+				t.Errorf("sampled = %q, want %q", sampled, tt.wantSampled)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	mathrand "math/rand"
+	"sync"
+	"time"
+)
+
+// Span kinds, as defined by Zipkin.
+const (
+	Server = "SERVER"
+	Client = "CLIENT"
+)
+
+// SpanContext identifies a span across processes.
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+	// Sampled is nil when the upstream process deferred the sampling decision.
+	Sampled *bool
+}
+
+// Span is an operation being traced. Every method of a nil Span is a no-op, so spans that are
+// not sampled, or created while tracing is disabled, don't need to be checked.
+type Span struct {
+	sync.Mutex
+	tracer   *tracer
+	context  SpanContext
+	parentID string
+	name     string
+	kind     string
+	start    time.Time
+	tags     map[string]string
+}
+
+// SetTag annotates the span with a key/value pair.
+func (s *Span) SetTag(key, value string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.tags[key] = value
+}
+
+// Finish ends the span and queues it to be exported.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.tracer.exporter.export(s.toZipkin(time.Now()))
+}
+
+// tracer creates the spans of a service and sends them to an exporter.
+type tracer struct {
+	serviceName string
+	// sampling is the percentage of new traces that are sampled.
+	sampling float64
+	exporter *zipkinExporter
+}
+
+// current is nil, disabling tracing, until Configure is called.
+var (
+	currentMu sync.RWMutex
+	current   *tracer
+)
+
+// Configure enables tracing, sending the spans of serviceName to a Zipkin v2 collector URL, like
+// "http://zipkin:9411/api/v2/spans". sampling is the percentage of the new traces that are sampled,
+// traces started by Envoy keep the decision of Envoy. Spans are exported until the context is done.
+func Configure(ctx context.Context, collectorURL, serviceName string, sampling float64) {
+	exporter := newZipkinExporter(collectorURL)
+	go exporter.run(ctx)
+
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	current = &tracer{serviceName: serviceName, sampling: sampling, exporter: exporter}
+}
+
+// Enabled reports whether tracing has been configured.
+func Enabled() bool {
+	currentMu.RLock()
+	defer currentMu.RUnlock()
+	return current != nil
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// ContextWithRemoteParent returns a context whose spans are children of a span of another process.
+func ContextWithRemoteParent(ctx context.Context, parent SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, parent)
+}
+
+// StartSpan starts a span, child of the span of the context, or of its remote parent. The returned
+// context holds the new span. The span is nil when tracing is disabled or the trace is not sampled.
+func StartSpan(ctx context.Context, name, kind string) (*Span, context.Context) {
+	currentMu.RLock()
+	t := current
+	currentMu.RUnlock()
+	if t == nil {
+		return nil, ctx
+	}
+
+	var parent SpanContext
+	if s, ok := ctx.Value(spanKey{}).(*Span); ok {
+		parent = s.context
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		parent = remote
+	}
+
+	sampled := mathrand.Float64()*100 < t.sampling
+	if parent.Sampled != nil {
+		sampled = *parent.Sampled
+	}
+	if !sampled {
+		return nil, ctx
+	}
+
+	span := &Span{
+		tracer:   t,
+		context:  SpanContext{TraceID: parent.TraceID, SpanID: newID(8), Sampled: &sampled},
+		parentID: parent.SpanID,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+		tags:     make(map[string]string),
+	}
+	if span.context.TraceID == "" {
+		span.context.TraceID = newID(16)
+	}
+	return span, context.WithValue(ctx, spanKey{}, span)
+}
+
+// newID returns a random ID of n bytes, hex encoded.
+func newID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		mathrand.Read(b)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,131 @@
+package tracing
+
+import (
+	"3scale-envoy/pkg/logging"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// exportInterval is how often the finished spans are sent to the collector.
+	exportInterval = time.Second
+	// maxQueuedSpans is the number of finished spans kept while the collector can't be reached.
+	maxQueuedSpans = 10000
+	// maxBatchSize is the number of spans sent to the collector in a single call.
+	maxBatchSize = 500
+)
+
+var log = logging.Logger
+
+// zipkinSpan is a span in the Zipkin v2 JSON format, also accepted by the Jaeger collector.
+type zipkinSpan struct {
+	TraceID       string            `json:"traceId"`
+	ID            string            `json:"id"`
+	ParentID      string            `json:"parentId,omitempty"`
+	Name          string            `json:"name"`
+	Kind          string            `json:"kind,omitempty"`
+	Timestamp     int64             `json:"timestamp"`
+	Duration      int64             `json:"duration"`
+	LocalEndpoint zipkinEndpoint    `json:"localEndpoint"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName"`
+}
+
+func (s *Span) toZipkin(end time.Time) zipkinSpan {
+	tags := make(map[string]string, len(s.tags))
+	for k, v := range s.tags {
+		tags[k] = v
+	}
+	return zipkinSpan{
+		TraceID:       s.context.TraceID,
+		ID:            s.context.SpanID,
+		ParentID:      s.parentID,
+		Name:          s.name,
+		Kind:          s.kind,
+		Timestamp:     s.start.UnixNano() / int64(time.Microsecond),
+		Duration:      end.Sub(s.start).Nanoseconds() / int64(time.Microsecond),
+		LocalEndpoint: zipkinEndpoint{ServiceName: s.tracer.serviceName},
+		Tags:          tags,
+	}
+}
+
+// zipkinExporter sends the finished spans to a Zipkin v2 collector in batches.
+type zipkinExporter struct {
+	sync.Mutex
+	url        string
+	spans      []zipkinSpan
+	httpClient *http.Client
+}
+
+func newZipkinExporter(url string) *zipkinExporter {
+	return &zipkinExporter{url: url, httpClient: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (e *zipkinExporter) export(span zipkinSpan) {
+	e.Lock()
+	defer e.Unlock()
+	if len(e.spans) >= maxQueuedSpans {
+		return
+	}
+	e.spans = append(e.spans, span)
+}
+
+// run flushes the finished spans every exportInterval, until the context is done.
+func (e *zipkinExporter) run(ctx context.Context) {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			e.flush()
+			return
+		case <-ticker.C:
+			e.flush()
+		}
+	}
+}
+
+func (e *zipkinExporter) flush() {
+	e.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.Unlock()
+
+	for len(spans) > 0 {
+		n := len(spans)
+		if n > maxBatchSize {
+			n = maxBatchSize
+		}
+		if err := e.send(spans[:n]); err != nil {
+			log.Warnf("Failed to export %d spans: %v", n, err)
+		}
+		spans = spans[n:]
+	}
+}
+
+func (e *zipkinExporter) send(spans []zipkinSpan) error {
+	body, err := json.Marshal(spans)
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.httpClient.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// collector stands in for a Zipkin collector, keeping the batches of spans it receives.
+type collector struct {
+	sync.Mutex
+	batches [][]zipkinSpan
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/api/v2/spans" || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	var spans []zipkinSpan
+	if err := json.NewDecoder(r.Body).Decode(&spans); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.batches = append(c.batches, spans)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// useTracer replaces the configured tracer until the returned function is called.
+func useTracer(t *tracer) func() {
+	currentMu.Lock()
+	previous := current
+	current = t
+	currentMu.Unlock()
+	return func() {
+		currentMu.Lock()
+		current = previous
+		currentMu.Unlock()
+	}
+}
+
+func TestZipkinExporter(t *testing.T) {
+	c := &collector{}
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	exporter := newZipkinExporter(server.URL + "/api/v2/spans")
+	tr := &tracer{serviceName: "3scale-envoy", sampling: 0, exporter: exporter}
+	defer useTracer(tr)()
+
+	sampled := true
+	remote := SpanContext{TraceID: "463ac35c9f6413ad48485a3953bb6124", SpanID: "a2fb4a1d1a96d312", Sampled: &sampled}
+	parent, ctx := StartSpan(ContextWithRemoteParent(context.Background(), remote), "ext_authz check", Server)
+	parent.SetTag("service_id", "2555417777777")
+	child, _ := StartSpan(ctx, "3scale authrep", Client)
+	child.Finish()
+	parent.Finish()
+
+	// Traces not sampled by Envoy are not exported, whatever the local sampling.
+	notSampled := false
+	if span, _ := StartSpan(ContextWithRemoteParent(context.Background(), SpanContext{TraceID: remote.TraceID, SpanID: remote.SpanID, Sampled: &notSampled}), "ignored", Server); span != nil {
+		t.Error("span of a trace that is not sampled")
+	}
+	exporter.flush()
+
+	if len(c.batches) != 1 || len(c.batches[0]) != 2 {
+		t.Fatalf("batches = %v, want a single batch of 2 spans", c.batches)
+	}
+	gotChild, gotParent := c.batches[0][0], c.batches[0][1]
+
+	if gotParent.TraceID != remote.TraceID || gotParent.ParentID != remote.SpanID || gotParent.ID == "" || gotParent.ID == remote.SpanID {
+		t.Errorf("parent span ids = %s/%s/%s, want a new span of trace %s under %s", gotParent.TraceID, gotParent.ParentID, gotParent.ID, remote.TraceID, remote.SpanID)
+	}
+	if gotChild.TraceID != remote.TraceID || gotChild.ParentID != gotParent.ID {
+		t.Errorf("child span ids = %s/%s, want trace %s under %s", gotChild.TraceID, gotChild.ParentID, remote.TraceID, gotParent.ID)
+	}
+	if gotParent.Name != "ext_authz check" || gotParent.Kind != Server || gotChild.Name != "3scale authrep" || gotChild.Kind != Client {
+		t.Errorf("spans = %+v, %+v, want the names and kinds they were started with", gotParent, gotChild)
+	}
+	if gotParent.LocalEndpoint.ServiceName != "3scale-envoy" || gotParent.Tags["service_id"] != "2555417777777" {
+		t.Errorf("parent span = %+v, want the service name and tags", gotParent)
+	}
+	if gotParent.Timestamp == 0 || gotParent.Timestamp > gotChild.Timestamp || gotParent.Duration < gotChild.Duration {
+		t.Errorf("parent span times = %d+%d, want it to include the child %d+%d", gotParent.Timestamp, gotParent.Duration, gotChild.Timestamp, gotChild.Duration)
+	}
+
+	// A new trace gets its own 128 bit trace ID.
+	c.batches = nil
+	tr.sampling = 100
+	root, _ := StartSpan(context.Background(), "root", Server)
+	root.Finish()
+	exporter.flush()
+	if len(c.batches) != 1 || len(c.batches[0][0].TraceID) != 32 || c.batches[0][0].ParentID != "" {
+		t.Errorf("batches = %v, want a root span of a new trace", c.batches)
+	}
+}
+
+func TestZipkinExporterBatches(t *testing.T) {
+	c := &collector{}
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	exporter := newZipkinExporter(server.URL + "/api/v2/spans")
+	for i := 0; i < maxBatchSize+1; i++ {
+		exporter.export(zipkinSpan{TraceID: "463ac35c9f6413ad48485a3953bb6124", ID: "a2fb4a1d1a96d312", Name: "span"})
+	}
+	exporter.flush()
+
+	if len(c.batches) != 2 || len(c.batches[0]) != maxBatchSize || len(c.batches[1]) != 1 {
+		t.Errorf("got %d batches, want %d spans then 1", len(c.batches), maxBatchSize)
+	}
+
+	// The spans a collector rejects are dropped rather than queued again.
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer rejecting.Close()
+	failing := newZipkinExporter(rejecting.URL)
+	failing.export(zipkinSpan{Name: "span"})
+	if err := failing.send(failing.spans); err == nil {
+		t.Error("expected an error from a collector answering 503")
+	}
+	failing.flush()
+	if len(failing.spans) != 0 {
+		t.Errorf("%d spans queued after a failed flush", len(failing.spans))
+	}
+}